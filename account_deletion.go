@@ -0,0 +1,304 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"grysha11/httpServersGo/internal/apierror"
+	"grysha11/httpServersGo/internal/auth"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// defaultDeletionGracePeriod is how long a deleted account can still be
+// restored by logging in again before it is purged for good.
+const defaultDeletionGracePeriod = 30 * 24 * time.Hour
+
+// defaultPurgeInterval is how often the background purge runs.
+const defaultPurgeInterval = time.Hour
+
+// loadDeletionGracePeriod reads ACCOUNT_DELETION_GRACE_PERIOD, e.g. "720h".
+func loadDeletionGracePeriod() (time.Duration, error) {
+	value := os.Getenv("ACCOUNT_DELETION_GRACE_PERIOD")
+	if value == "" {
+		return defaultDeletionGracePeriod, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("ACCOUNT_DELETION_GRACE_PERIOD: %w", err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("ACCOUNT_DELETION_GRACE_PERIOD must not be negative")
+	}
+	return d, nil
+}
+
+// checkUserActive rejects access tokens of accounts that were deleted after
+// the token was issued. API keys of deleted accounts are already rejected
+// by TouchAPIKey. Purged accounts have no row left; the handlers that load
+// the user report those themselves.
+func (cfg *apiConfig) checkUserActive(ctx context.Context, userID uuid.UUID) error {
+	deletedAt, err := cfg.DB.GetUserDeletedAt(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if deletedAt.Valid {
+		return apierror.Unauthorized("account has been deleted", nil)
+	}
+	return nil
+}
+
+// handleDeleteAccount schedules the account for deletion. The user is logged
+// out everywhere and disappears from the API right away, but the data is
+// only removed by purgeDeletedAccounts once the grace period is over.
+func (cfg *apiConfig) handleDeleteAccount(w http.ResponseWriter, r *http.Request) error {
+	type parameters struct {
+		CurrentPassword	string	`json:"current_password"`
+	}
+	type ResponseSuccess struct {
+		DeletedAt	time.Time	`json:"deleted_at"`
+		PurgeAfter	time.Time	`json:"purge_after"`
+	}
+
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
+	}
+
+	params := parameters{}
+	err := decodeJSON(w, r, &params)
+	if err != nil {
+		return err
+	}
+
+	user, err := cfg.DB.GetUserByID(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.Unauthorized("user no longer exists", err)
+	}
+	if err != nil {
+		return err
+	}
+	err = cfg.reauthenticate(r, user, params.CurrentPassword)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := cfg.DB.SoftDeleteUser(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.Conflict("account is already scheduled for deletion", err)
+	}
+	if err != nil {
+		return err
+	}
+	err = cfg.DB.RevokeAllSessions(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+	cfg.recordAuditEvent(r.Context(), userID, auditAccountDeleted, nil)
+
+	return respondWithJSON(w, 202, ResponseSuccess{
+		DeletedAt: deleted.DeletedAt.Time,
+		PurgeAfter: deleted.DeletedAt.Time.Add(cfg.DeletionGracePeriod),
+	})
+}
+
+// restoreDeletedAccount cancels a pending deletion when the user logs in
+// again during the grace period.
+func (cfg *apiConfig) restoreDeletedAccount(ctx context.Context, userID uuid.UUID) error {
+	rows, err := cfg.DB.RestoreUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		cfg.recordAuditEvent(ctx, userID, auditAccountRestored, nil)
+	}
+	return nil
+}
+
+// purgeDeletedAccounts removes accounts whose grace period is over. Their
+// chirps that have replies are kept as tombstones without an author, so the
+// threads stay intact; everything else goes with them through ON DELETE
+// CASCADE.
+func (cfg *apiConfig) purgeDeletedAccounts(ctx context.Context) error {
+	rows, err := cfg.DB.PurgeDeletedUsers(ctx, time.Now().UTC().Add(-cfg.DeletionGracePeriod))
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		log.Printf("Purged %d deleted accounts\n", rows)
+	}
+	return nil
+}
+
+// runPurgeJobs runs the purge jobs every interval until ctx is done.
+func (cfg *apiConfig) runPurgeJobs(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := cfg.purgeDeletedAccounts(ctx); err != nil {
+			log.Printf("Error purging deleted accounts: %v\n", err)
+		}
+		if err := cfg.purgeDeletedChirps(ctx); err != nil {
+			log.Printf("Error purging deleted chirps: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// AccountExport is everything chirpy stores about a user that they can ask
+// for a copy of.
+type AccountExport struct {
+	ExportedAt		time.Time		`json:"exported_at"`
+	Profile			User			`json:"profile"`
+	Subscription	Subscription	`json:"subscription"`
+	Chirps			[]Chirp			`json:"chirps"`
+	Sessions		[]Session		`json:"sessions"`
+}
+
+type Subscription struct {
+	Plan		string	`json:"plan"`
+	IsChirpyRed	bool	`json:"is_chirpy_red"`
+}
+
+func (cfg *apiConfig) exportAccount(ctx context.Context, userID uuid.UUID) (AccountExport, error) {
+	user, err := cfg.DB.GetUserByID(ctx, userID)
+	if err != nil {
+		return AccountExport{}, err
+	}
+
+	plan := "free"
+	if user.IsChirpyRed {
+		plan = "chirpy_red"
+	}
+	export := AccountExport{
+		ExportedAt: time.Now().UTC(),
+		Profile: User{
+			ID: user.ID,
+			CreatedAt: user.CreatedAt,
+			UpdatedAt: user.UpdatedAt,
+			Email: user.Email,
+			IsChirpyRed: user.IsChirpyRed,
+			IsEmailVerified: user.EmailVerifiedAt.Valid,
+			Role: user.Role,
+		},
+		Subscription: Subscription{
+			Plan: plan,
+			IsChirpyRed: user.IsChirpyRed,
+		},
+		Chirps: []Chirp{},
+		Sessions: []Session{},
+	}
+
+	chirps, err := cfg.DB.GetChirpsByAuthor(ctx, userID)
+	if err != nil {
+		return AccountExport{}, err
+	}
+	for _, chirp := range chirps {
+		export.Chirps = append(export.Chirps, chirpFromDB(chirp))
+	}
+
+	tokens, err := cfg.DB.ListActiveSessions(ctx, userID)
+	if err != nil {
+		return AccountExport{}, err
+	}
+	for _, token := range tokens {
+		export.Sessions = append(export.Sessions, Session{
+			ID: token.FamilyID,
+			CreatedAt: token.SessionStartedAt,
+			LastUsedAt: token.LastUsedAt,
+			ExpiresAt: token.ExpiresAt,
+			UserAgent: token.UserAgent,
+			IPAddress: token.IpAddress,
+		})
+	}
+	return export, nil
+}
+
+// handleExportAccount sends the user a copy of their data, as a single JSON
+// document or, with ?format=zip, as an archive with one file per section.
+func (cfg *apiConfig) handleExportAccount(w http.ResponseWriter, r *http.Request) error {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "zip" {
+		return apierror.Validation(map[string]string{
+			"format": "must be json or zip",
+		})
+	}
+
+	export, err := cfg.exportAccount(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	filename := fmt.Sprintf("chirpy-export-%s.%s", export.ExportedAt.Format("20060102"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Cache-Control", "no-store")
+	if format == "json" {
+		return respondWithJSON(w, 200, export)
+	}
+
+	files := []struct {
+		name	string
+		data	any
+	}{
+		{"profile.json", export.Profile},
+		{"subscription.json", export.Subscription},
+		{"chirps.json", export.Chirps},
+		{"sessions.json", export.Sessions},
+	}
+	// Everything is marshaled before the first byte is written, so a
+	// failure can still be reported as an error response.
+	encoded := make([][]byte, len(files))
+	for i, file := range files {
+		encoded[i], err = json.MarshalIndent(file.data, "", "  ")
+		if err != nil {
+			return fmt.Errorf("marshaling %s: %w", file.name, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.WriteHeader(200)
+	archive := zip.NewWriter(w)
+	for i, file := range files {
+		f, err := archive.CreateHeader(&zip.FileHeader{
+			Name: file.name,
+			Method: zip.Deflate,
+			Modified: export.ExportedAt,
+		})
+		if err != nil {
+			log.Printf("Error writing export for user %v: %v\n", userID, err)
+			return nil
+		}
+		if _, err := f.Write(encoded[i]); err != nil {
+			log.Printf("Error writing export for user %v: %v\n", userID, err)
+			return nil
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("Error writing export for user %v: %v\n", userID, err)
+	}
+	return nil
+}
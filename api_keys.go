@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"grysha11/httpServersGo/internal/apierror"
+	"grysha11/httpServersGo/internal/auth"
+	"grysha11/httpServersGo/internal/database"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const maxAPIKeyNameLength = 100
+
+// APIKey is a personal API key as shown to its owner. Key is only set in
+// the response that creates it, afterwards only the prefix is known.
+type APIKey struct {
+	ID			uuid.UUID	`json:"id"`
+	CreatedAt	time.Time	`json:"created_at"`
+	Name		string		`json:"name"`
+	Prefix		string		`json:"prefix"`
+	Scopes		[]string	`json:"scopes"`
+	LastUsedAt	*time.Time	`json:"last_used_at"`
+	Key			string		`json:"key,omitempty"`
+}
+
+func apiKeyFromDB(key database.ApiKey) APIKey {
+	res := APIKey{
+		ID: key.ID,
+		CreatedAt: key.CreatedAt,
+		Name: key.Name,
+		Prefix: key.Prefix,
+		Scopes: key.Scopes,
+	}
+	if key.LastUsedAt.Valid {
+		res.LastUsedAt = &key.LastUsedAt.Time
+	}
+	return res
+}
+
+// lookupAPIKey authenticates a personal API key and records that it was
+// used.
+func (cfg *apiConfig) lookupAPIKey(ctx context.Context, keyHash string) (auth.APIKey, error) {
+	key, err := cfg.DB.TouchAPIKey(ctx, keyHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return auth.APIKey{}, auth.ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return auth.APIKey{}, err
+	}
+	return auth.APIKey{
+		ID: key.ID,
+		UserID: key.UserID,
+		Scopes: key.Scopes,
+	}, nil
+}
+
+func (cfg *apiConfig) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) error {
+	type parameters struct {
+		Name	string		`json:"name"`
+		Scopes	[]string	`json:"scopes"`
+	}
+
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
+	}
+
+	params := parameters{}
+	err := decodeJSON(w, r, &params)
+	if err != nil {
+		return err
+	}
+
+	problems := map[string]string{}
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" {
+		problems["name"] = "is required"
+	} else if len(params.Name) > maxAPIKeyNameLength {
+		problems["name"] = "is too long"
+	}
+	if len(params.Scopes) == 0 {
+		problems["scopes"] = "must contain at least one scope"
+	}
+	for _, scope := range params.Scopes {
+		if !auth.ValidScope(scope) {
+			problems["scopes"] = "must only contain " + strings.Join(auth.Scopes, ", ")
+		}
+	}
+	if len(problems) > 0 {
+		return apierror.Validation(problems)
+	}
+	slices.Sort(params.Scopes)
+	params.Scopes = slices.Compact(params.Scopes)
+
+	rawKey, prefix := auth.MakeAPIKey()
+	key, err := cfg.DB.CreateAPIKey(r.Context(), database.CreateAPIKeyParams{
+		UserID: userID,
+		Name: params.Name,
+		Prefix: prefix,
+		KeyHash: auth.HashToken(rawKey),
+		Scopes: params.Scopes,
+	})
+	if err != nil {
+		return err
+	}
+
+	res := apiKeyFromDB(key)
+	res.Key = rawKey
+	return respondWithJSON(w, 201, res)
+}
+
+func (cfg *apiConfig) handleListAPIKeys(w http.ResponseWriter, r *http.Request) error {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
+	}
+
+	keys, err := cfg.DB.ListAPIKeys(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	res := make([]APIKey, 0, len(keys))
+	for _, key := range keys {
+		res = append(res, apiKeyFromDB(key))
+	}
+	return respondWithJSON(w, 200, res)
+}
+
+func (cfg *apiConfig) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) error {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
+	}
+
+	keyID, err := parseUUIDPathValue(r, "keyID")
+	if err != nil {
+		return err
+	}
+
+	rows, err := cfg.DB.RevokeAPIKey(r.Context(), database.RevokeAPIKeyParams{
+		ID: keyID,
+		UserID: userID,
+	})
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return apierror.NotFound("api key not found", nil)
+	}
+
+	w.WriteHeader(204)
+	return nil
+}
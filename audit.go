@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"grysha11/httpServersGo/internal/database"
+	"log"
+
+	"github.com/google/uuid"
+)
+
+const (
+	auditRefreshTokenReuse = "refresh_token_reuse"
+	auditAccountLocked = "account_locked"
+	auditAccountUnlocked = "account_unlocked"
+	auditPasswordReset = "password_reset"
+	auditPasswordChanged = "password_changed"
+	auditEmailChanged = "email_changed"
+	auditTwoFactorEnabled = "two_factor_enabled"
+	auditTwoFactorDisabled = "two_factor_disabled"
+	auditRecoveryCodeUsed = "recovery_code_used"
+	auditIdentityLinked = "identity_linked"
+	auditRoleChanged = "role_changed"
+	auditAccountDeleted = "account_deleted"
+	auditAccountRestored = "account_restored"
+)
+
+// recordAuditEvent stores a security relevant event. Failing to record an
+// event is logged but never fails the request that triggered it.
+func (cfg *apiConfig) recordAuditEvent(ctx context.Context, userID uuid.UUID, eventType string, details map[string]any) {
+	data, err := json.Marshal(details)
+	if err != nil {
+		log.Printf("Error marshaling audit event %s: %v\n", eventType, err)
+		return
+	}
+
+	_, err = cfg.DB.CreateAuditEvent(ctx, database.CreateAuditEventParams{
+		UserID: uuid.NullUUID{UUID: userID, Valid: userID != uuid.Nil},
+		EventType: eventType,
+		Details: data,
+	})
+	if err != nil {
+		log.Printf("Error recording audit event %s for user %v: %v\n", eventType, userID, err)
+	}
+}
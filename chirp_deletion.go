@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"grysha11/httpServersGo/internal/apierror"
+	"grysha11/httpServersGo/internal/auth"
+	"grysha11/httpServersGo/internal/database"
+	"grysha11/httpServersGo/internal/pagination"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// defaultChirpDeletionGracePeriod is how long a deleted chirp can be restored
+// by its author before it is purged.
+const defaultChirpDeletionGracePeriod = 7 * 24 * time.Hour
+
+// ModeratedChirp is what moderators see of a chirp: on top of the public
+// view it has the body as the author wrote it and whether moderation flagged
+// it.
+type ModeratedChirp struct {
+	Chirp
+	OriginalBody	*string	`json:"original_body,omitempty"`
+	Flagged			bool	`json:"flagged"`
+}
+
+func moderatedChirpFromDB(chirp database.Chirp) ModeratedChirp {
+	res := ModeratedChirp{
+		Chirp: chirpFromDB(chirp),
+		Flagged: chirp.Flagged,
+	}
+	if chirp.OriginalBody.Valid {
+		res.OriginalBody = &chirp.OriginalBody.String
+	}
+	return res
+}
+
+// loadChirpDeletionGracePeriod reads CHIRP_DELETION_GRACE_PERIOD, e.g. "168h".
+func loadChirpDeletionGracePeriod() (time.Duration, error) {
+	value := os.Getenv("CHIRP_DELETION_GRACE_PERIOD")
+	if value == "" {
+		return defaultChirpDeletionGracePeriod, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("CHIRP_DELETION_GRACE_PERIOD: %w", err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("CHIRP_DELETION_GRACE_PERIOD must not be negative")
+	}
+	return d, nil
+}
+
+func (cfg *apiConfig) handleRestoreChirp(w http.ResponseWriter, r *http.Request) error {
+	chirpID, err := parseUUIDPathValue(r, "chirpID")
+	if err != nil {
+		return err
+	}
+
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
+	}
+
+	chirp, err := cfg.DB.GetChirpByIDWithDeleted(r.Context(), chirpID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.NotFound("chirp not found", err)
+	}
+	if err != nil {
+		return err
+	}
+	// Other users can't see deleted chirps, so they don't learn that this
+	// one exists either.
+	if chirp.UserID.UUID != userID {
+		if chirp.DeletedAt.Valid {
+			return apierror.NotFound("chirp not found", nil)
+		}
+		return apierror.Forbidden("you are not the author of this chirp")
+	}
+	if !chirp.DeletedAt.Valid {
+		return apierror.Conflict("chirp is not deleted", nil)
+	}
+
+	deletedAfter := time.Now().UTC().Add(-cfg.ChirpDeletionGracePeriod)
+	restored, err := cfg.DB.RestoreChirpByID(r.Context(), database.RestoreChirpByIDParams{
+		ID: chirpID,
+		UserID: userID,
+		DeletedAfter: deletedAfter,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.Forbidden("chirp can no longer be restored")
+	}
+	if err != nil {
+		return err
+	}
+
+	return cfg.respondWithChirp(w, r, 200, restored)
+}
+
+// handleGetChirpForModeration returns a chirp even if it was deleted.
+func (cfg *apiConfig) handleGetChirpForModeration(w http.ResponseWriter, r *http.Request) error {
+	chirpID, err := parseUUIDPathValue(r, "chirpID")
+	if err != nil {
+		return err
+	}
+
+	chirp, err := cfg.DB.GetChirpByIDWithDeleted(r.Context(), chirpID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.NotFound("chirp not found", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	return respondWithJSON(w, 200, moderatedChirpFromDB(chirp))
+}
+
+// handleListDeletedChirps lists deleted chirps that haven't been purged yet,
+// most recently deleted first.
+func (cfg *apiConfig) handleListDeletedChirps(w http.ResponseWriter, r *http.Request) error {
+	type ResponsePage struct {
+		Chirps		[]ModeratedChirp	`json:"chirps"`
+		NextCursor	string			`json:"next_cursor,omitempty"`
+	}
+
+	query := r.URL.Query()
+	limit, err := pagination.ParseLimit(query.Get("limit"))
+	if err != nil {
+		return apierror.BadRequest(err.Error(), err)
+	}
+
+	authorID := uuid.NullUUID{}
+	if authorIDString := query.Get("author_id"); authorIDString != "" {
+		authorID.UUID, err = uuid.Parse(authorIDString)
+		if err != nil {
+			return apierror.BadRequest("invalid author ID", err)
+		}
+		authorID.Valid = true
+	}
+
+	// The cursor holds the deletion time of the last chirp rather than
+	// its creation time, since that is what the list is sorted by.
+	beforeDeletedAt := sql.NullTime{}
+	beforeID := uuid.NullUUID{}
+	if cursorString := query.Get("cursor"); cursorString != "" {
+		cursor, err := pagination.DecodeCursor(cursorString)
+		if err != nil {
+			return apierror.BadRequest("invalid cursor", err)
+		}
+		beforeDeletedAt = sql.NullTime{Time: cursor.CreatedAt, Valid: true}
+		beforeID = uuid.NullUUID{UUID: cursor.ID, Valid: true}
+	}
+
+	chirps, err := cfg.DB.ListDeletedChirps(r.Context(), database.ListDeletedChirpsParams{
+		AuthorID: authorID,
+		BeforeDeletedAt: beforeDeletedAt,
+		BeforeID: beforeID,
+		PageLimit: int32(limit + 1),
+	})
+	if err != nil {
+		return err
+	}
+
+	nextCursor := ""
+	if len(chirps) > limit {
+		chirps = chirps[:limit]
+		last := chirps[len(chirps)-1]
+		next := pagination.Cursor{CreatedAt: last.DeletedAt.Time, ID: last.ID}
+		nextCursor = next.Encode()
+		w.Header().Set("Link", pagination.NextLink("/admin/chirps/deleted", query, next))
+	}
+
+	res := make([]ModeratedChirp, len(chirps))
+	for i, chirp := range chirps {
+		res[i] = moderatedChirpFromDB(chirp)
+	}
+	return respondWithJSON(w, 200, ResponsePage{
+		Chirps: res,
+		NextCursor: nextCursor,
+	})
+}
+
+// purgeDeletedChirps removes chirps whose grace period is over, along with
+// their revisions.
+func (cfg *apiConfig) purgeDeletedChirps(ctx context.Context) error {
+	rows, err := cfg.DB.PurgeDeletedChirps(ctx, time.Now().UTC().Add(-cfg.ChirpDeletionGracePeriod))
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		log.Printf("Purged %d deleted chirps\n", rows)
+	}
+	return nil
+}
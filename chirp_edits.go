@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"grysha11/httpServersGo/internal/apierror"
+	"grysha11/httpServersGo/internal/auth"
+	"grysha11/httpServersGo/internal/database"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// defaultChirpEditWindow is how long after posting a chirp can be edited.
+const defaultChirpEditWindow = 15 * time.Minute
+
+// ChirpRevision is an earlier body of an edited chirp. WrittenAt is when the
+// body was posted or last edited, ReplacedAt when it was edited away.
+type ChirpRevision struct {
+	ID			uuid.UUID	`json:"id"`
+	Body		string		`json:"body"`
+	WrittenAt	time.Time	`json:"written_at"`
+	ReplacedAt	time.Time	`json:"replaced_at"`
+}
+
+// loadChirpEditWindow reads CHIRP_EDIT_WINDOW, e.g. "30m". Zero disables
+// editing.
+func loadChirpEditWindow() (time.Duration, error) {
+	value := os.Getenv("CHIRP_EDIT_WINDOW")
+	if value == "" {
+		return defaultChirpEditWindow, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("CHIRP_EDIT_WINDOW: %w", err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("CHIRP_EDIT_WINDOW must not be negative")
+	}
+	return d, nil
+}
+
+func (cfg *apiConfig) handleEditChirp(w http.ResponseWriter, r *http.Request) error {
+	type parameters struct {
+		Body	string	`json:"body"`
+	}
+
+	chirpID, err := parseUUIDPathValue(r, "chirpID")
+	if err != nil {
+		return err
+	}
+
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
+	}
+
+	params := parameters{}
+	err = decodeJSON(w, r, &params)
+	if err != nil {
+		return err
+	}
+
+	chirp, err := cfg.DB.GetChirpByID(r.Context(), chirpID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.NotFound("chirp not found", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if chirp.UserID.UUID != userID {
+		return apierror.Forbidden("you are not the author of this chirp")
+	}
+	if chirp.RechirpOfID.Valid {
+		return apierror.Forbidden("rechirps can't be edited")
+	}
+	editableAfter := time.Now().UTC().Add(-cfg.ChirpEditWindow)
+	if !chirp.CreatedAt.After(editableAfter) {
+		return apierror.Forbidden("chirp can no longer be edited")
+	}
+
+	moderated, err := cfg.prepareChirpBody(r.Context(), userID, params.Body)
+	if err != nil {
+		return err
+	}
+	originalBody := sql.NullString{
+		String: moderated.Original,
+		Valid: moderated.Changed(),
+	}
+	// Saving the same body again would only add a useless revision.
+	if moderated.Body == chirp.Body && originalBody == chirp.OriginalBody {
+		return cfg.respondWithChirp(w, r, 200, chirp)
+	}
+
+	// The current body is saved as a revision in the same statement that
+	// replaces it, with the row locked, so concurrent edits can't lose one.
+	edited, err := cfg.DB.EditChirp(r.Context(), database.EditChirpParams{
+		ID: chirpID,
+		UserID: userID,
+		EditableAfter: editableAfter,
+		Body: moderated.Body,
+		OriginalBody: originalBody,
+		Flagged: moderated.Flagged,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.Forbidden("chirp can no longer be edited")
+	}
+	if err != nil {
+		return err
+	}
+
+	return cfg.respondWithChirp(w, r, 200, edited)
+}
+
+func (cfg *apiConfig) handleListChirpRevisions(w http.ResponseWriter, r *http.Request) error {
+	chirpID, err := parseUUIDPathValue(r, "chirpID")
+	if err != nil {
+		return err
+	}
+
+	_, err = cfg.DB.GetChirpByID(r.Context(), chirpID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.NotFound("chirp not found", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	revisions, err := cfg.DB.ListChirpRevisions(r.Context(), chirpID)
+	if err != nil {
+		return err
+	}
+
+	res := make([]ChirpRevision, 0, len(revisions))
+	for _, revision := range revisions {
+		res = append(res, ChirpRevision{
+			ID: revision.ID,
+			Body: revision.Body,
+			WrittenAt: revision.WrittenAt,
+			ReplacedAt: revision.CreatedAt,
+		})
+	}
+	return respondWithJSON(w, 200, res)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"grysha11/httpServersGo/internal/apierror"
+	"grysha11/httpServersGo/internal/database"
+	"grysha11/httpServersGo/internal/pagination"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// Tombstone stands in for a deleted chirp in a thread, so its replies still
+// have something to hang off.
+type Tombstone struct {
+	ID			uuid.UUID	`json:"id"`
+	ParentID	*uuid.UUID	`json:"parent_id,omitempty"`
+	Deleted		bool		`json:"deleted"`
+}
+
+func tombstoneFromDB(chirp database.Chirp) Tombstone {
+	res := Tombstone{
+		ID: chirp.ID,
+		Deleted: true,
+	}
+	if chirp.ParentID.Valid {
+		res.ParentID = &chirp.ParentID.UUID
+	}
+	return res
+}
+
+// replyParent looks up the chirp being replied to and returns the parent and
+// root IDs for the reply.
+func (cfg *apiConfig) replyParent(ctx context.Context, replyToID uuid.UUID) (uuid.NullUUID, uuid.NullUUID, error) {
+	parent, err := cfg.originalChirp(ctx, replyToID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return uuid.NullUUID{}, uuid.NullUUID{}, apierror.Validation(map[string]string{
+			"reply_to_id": "chirp not found",
+		})
+	}
+	if err != nil {
+		return uuid.NullUUID{}, uuid.NullUUID{}, err
+	}
+
+	rootID := parent.RootID
+	if !rootID.Valid {
+		rootID = uuid.NullUUID{UUID: parent.ID, Valid: true}
+	}
+	return uuid.NullUUID{UUID: parent.ID, Valid: true}, rootID, nil
+}
+
+// addReplyCounts fills in ReplyCount for chirps with a single query. Deleted
+// replies aren't counted.
+func (cfg *apiConfig) addReplyCounts(ctx context.Context, chirps []*Chirp) error {
+	if len(chirps) == 0 {
+		return nil
+	}
+	ids := make([]uuid.UUID, len(chirps))
+	for i, chirp := range chirps {
+		ids[i] = chirp.ID
+	}
+
+	counts, err := cfg.DB.CountReplies(ctx, ids)
+	if err != nil {
+		return err
+	}
+	byParent := make(map[uuid.UUID]int, len(counts))
+	for _, count := range counts {
+		byParent[count.ParentID.UUID] = int(count.ReplyCount)
+	}
+	for _, chirp := range chirps {
+		chirp.ReplyCount = byParent[chirp.ID]
+	}
+	return nil
+}
+
+// handleGetThread returns a chirp with the chain of chirps it replies to,
+// root first, and a page of everything that replies to it, directly or
+// not, oldest first. Replies have a parent_id to build the tree from.
+func (cfg *apiConfig) handleGetThread(w http.ResponseWriter, r *http.Request) error {
+	type ResponseThread struct {
+		Ancestors	[]any	`json:"ancestors"`
+		Chirp		Chirp	`json:"chirp"`
+		Replies		[]any	`json:"replies"`
+		NextCursor	string	`json:"next_cursor,omitempty"`
+	}
+
+	chirpID, err := parseUUIDPathValue(r, "chirpID")
+	if err != nil {
+		return err
+	}
+
+	query := r.URL.Query()
+	limit, err := pagination.ParseLimit(query.Get("limit"))
+	if err != nil {
+		return apierror.BadRequest(err.Error(), err)
+	}
+
+	afterCreatedAt := sql.NullTime{}
+	afterID := uuid.NullUUID{}
+	if cursorString := query.Get("cursor"); cursorString != "" {
+		cursor, err := pagination.DecodeCursor(cursorString)
+		if err != nil {
+			return apierror.BadRequest("invalid cursor", err)
+		}
+		afterCreatedAt = sql.NullTime{Time: cursor.CreatedAt, Valid: true}
+		afterID = uuid.NullUUID{UUID: cursor.ID, Valid: true}
+	}
+
+	chirp, err := cfg.DB.GetChirpByID(r.Context(), chirpID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.NotFound("chirp not found", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	ancestors, err := cfg.DB.ListChirpAncestors(r.Context(), chirpID)
+	if err != nil {
+		return err
+	}
+	replies, err := cfg.DB.ListChirpDescendants(r.Context(), database.ListChirpDescendantsParams{
+		ID: chirpID,
+		AfterCreatedAt: afterCreatedAt,
+		AfterID: afterID,
+		PageLimit: int32(limit + 1),
+	})
+	if err != nil {
+		return err
+	}
+
+	nextCursor := ""
+	if len(replies) > limit {
+		replies = replies[:limit]
+		last := replies[len(replies)-1]
+		next := pagination.Cursor{CreatedAt: last.CreatedAt, ID: last.ID}
+		nextCursor = next.Encode()
+		w.Header().Set("Link", pagination.NextLink("/api/chirps/"+chirpID.String()+"/thread", query, next))
+	}
+
+	res := ResponseThread{
+		Chirp: chirpFromDB(chirp),
+		NextCursor: nextCursor,
+	}
+	counted := []*Chirp{&res.Chirp}
+	// Deleted chirps become tombstones, everything else gets expanded.
+	entries := func(chirps []database.Chirp) []any {
+		entries := make([]any, len(chirps))
+		for i, chirp := range chirps {
+			if chirp.DeletedAt.Valid {
+				entries[i] = tombstoneFromDB(chirp)
+				continue
+			}
+			c := chirpFromDB(chirp)
+			entries[i] = &c
+			counted = append(counted, &c)
+		}
+		return entries
+	}
+	res.Ancestors = entries(ancestors)
+	res.Replies = entries(replies)
+	err = cfg.expandChirps(r.Context(), counted)
+	if err != nil {
+		return err
+	}
+
+	return respondWithJSON(w, 200, res)
+}
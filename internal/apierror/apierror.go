@@ -0,0 +1,219 @@
+package apierror
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"grysha11/httpServersGo/internal/requestid"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lib/pq"
+)
+
+const (
+	CodeBadRequest    = "bad_request"
+	CodeInvalidJSON   = "invalid_json"
+	CodeUnknownField  = "unknown_field"
+	CodeValidation    = "validation_failed"
+	CodeTooLarge      = "payload_too_large"
+	CodeUnauthorized  = "unauthorized"
+	CodeInvalidToken  = "invalid_token"
+	CodeTokenExpired  = "token_expired"
+	CodeForbidden     = "forbidden"
+	CodeNotFound      = "not_found"
+	CodeConflict      = "conflict"
+	CodeTooManyTries  = "too_many_attempts"
+	CodeInternalError = "internal_error"
+)
+
+// pq error code for unique_violation.
+const uniqueViolation = "23505"
+
+// Error is an error that knows how it should be presented to API clients.
+// Err is the underlying cause and is only ever logged, never sent.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	Details map[string]string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// WithDetails returns a copy of e carrying the given details.
+func (e *Error) WithDetails(details map[string]string) *Error {
+	copied := *e
+	copied.Details = details
+	return &copied
+}
+
+func New(status int, code, message string, err error) *Error {
+	return &Error{
+		Status:  status,
+		Code:    code,
+		Message: message,
+		Err:     err,
+	}
+}
+
+func BadRequest(message string, err error) *Error {
+	return New(http.StatusBadRequest, CodeBadRequest, message, err)
+}
+
+func Unauthorized(message string, err error) *Error {
+	return New(http.StatusUnauthorized, CodeUnauthorized, message, err)
+}
+
+func Forbidden(message string) *Error {
+	return New(http.StatusForbidden, CodeForbidden, message, nil)
+}
+
+func NotFound(message string, err error) *Error {
+	return New(http.StatusNotFound, CodeNotFound, message, err)
+}
+
+func Conflict(message string, err error) *Error {
+	return New(http.StatusConflict, CodeConflict, message, err)
+}
+
+func TooManyAttempts(message string) *Error {
+	return New(http.StatusTooManyRequests, CodeTooManyTries, message, nil)
+}
+
+// Validation reports field-level problems with an otherwise well-formed
+// request. Details maps field names to what is wrong with them.
+func Validation(details map[string]string) *Error {
+	return New(http.StatusUnprocessableEntity, CodeValidation, "request validation failed", nil).WithDetails(details)
+}
+
+func Internal(err error) *Error {
+	return New(http.StatusInternalServerError, CodeInternalError, "internal server error", err)
+}
+
+// From maps any error to an *Error. Errors that aren't recognised become a
+// 500 with a generic message so internals don't leak to clients.
+func From(err error) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return NotFound("resource not found", err)
+	}
+
+	if IsUniqueViolation(err) {
+		return Conflict("resource already exists", err)
+	}
+
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return New(http.StatusUnauthorized, CodeTokenExpired, "token has expired", err)
+	}
+	if isJWTError(err) {
+		return New(http.StatusUnauthorized, CodeInvalidToken, "token is invalid", err)
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return New(http.StatusRequestEntityTooLarge, CodeTooLarge, fmt.Sprintf("request body must not be larger than %d bytes", maxBytesErr.Limit), err)
+	case errors.As(err, &syntaxErr):
+		return New(http.StatusBadRequest, CodeInvalidJSON, fmt.Sprintf("request body contains malformed JSON at position %d", syntaxErr.Offset), err)
+	case errors.As(err, &typeErr):
+		return New(http.StatusBadRequest, CodeInvalidJSON, fmt.Sprintf("request body has an invalid value for field %q", typeErr.Field), err)
+	case errors.Is(err, io.EOF):
+		return New(http.StatusBadRequest, CodeInvalidJSON, "request body must not be empty", err)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return New(http.StatusBadRequest, CodeInvalidJSON, "request body contains malformed JSON", err)
+	}
+
+	return Internal(err)
+}
+
+func IsUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == uniqueViolation
+}
+
+func isJWTError(err error) bool {
+	jwtErrors := []error{
+		jwt.ErrTokenMalformed,
+		jwt.ErrTokenUnverifiable,
+		jwt.ErrTokenSignatureInvalid,
+		jwt.ErrTokenInvalidClaims,
+		jwt.ErrTokenNotValidYet,
+		jwt.ErrTokenUsedBeforeIssued,
+		jwt.ErrTokenInvalidIssuer,
+		jwt.ErrTokenInvalidAudience,
+		jwt.ErrTokenInvalidSubject,
+		jwt.ErrTokenInvalidId,
+		jwt.ErrTokenRequiredClaimMissing,
+		jwt.ErrSignatureInvalid,
+	}
+	for _, jwtErr := range jwtErrors {
+		if errors.Is(err, jwtErr) {
+			return true
+		}
+	}
+	return false
+}
+
+type Response struct {
+	Code      string            `json:"code"`
+	Message   string            `json:"message"`
+	RequestID string            `json:"request_id,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// Write sends err to the client as a JSON error envelope.
+func Write(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr := From(err)
+	reqID := requestid.FromContext(r.Context())
+
+	if apiErr.Status >= http.StatusInternalServerError {
+		log.Printf("Error handling %s %s [%s]: %v\n", r.Method, r.URL.Path, reqID, err)
+	}
+
+	data, err := json.Marshal(Response{
+		Code:      apiErr.Code,
+		Message:   apiErr.Message,
+		RequestID: reqID,
+		Details:   apiErr.Details,
+	})
+	if err != nil {
+		log.Printf("Error marshaling error response: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	w.Write(data)
+}
+
+// HandlerFunc is an http.HandlerFunc that returns its error instead of
+// writing it. The error is rendered with Write.
+type HandlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+func (h HandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h(w, r); err != nil {
+		Write(w, r, err)
+	}
+}
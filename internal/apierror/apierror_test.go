@@ -0,0 +1,102 @@
+package apierror
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"grysha11/httpServersGo/internal/requestid"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lib/pq"
+)
+
+func TestFrom(t *testing.T) {
+	syntaxErr := &json.SyntaxError{Offset: 3}
+
+	cases := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"no rows", fmt.Errorf("get chirp: %w", sql.ErrNoRows), 404, CodeNotFound},
+		{"unique violation", &pq.Error{Code: "23505"}, 409, CodeConflict},
+		{"other pq error", &pq.Error{Code: "23503"}, 500, CodeInternalError},
+		{"expired token", fmt.Errorf("%w: %w", jwt.ErrTokenInvalidClaims, jwt.ErrTokenExpired), 401, CodeTokenExpired},
+		{"bad signature", fmt.Errorf("%w: %w", jwt.ErrTokenSignatureInvalid, jwt.ErrSignatureInvalid), 401, CodeInvalidToken},
+		{"malformed token", jwt.ErrTokenMalformed, 401, CodeInvalidToken},
+		{"syntax error", syntaxErr, 400, CodeInvalidJSON},
+		{"type error", &json.UnmarshalTypeError{Field: "email"}, 400, CodeInvalidJSON},
+		{"empty body", io.EOF, 400, CodeInvalidJSON},
+		{"truncated body", io.ErrUnexpectedEOF, 400, CodeInvalidJSON},
+		{"body too large", &http.MaxBytesError{Limit: 10}, 413, CodeTooLarge},
+		{"validation", Validation(map[string]string{"email": "is required"}), 422, CodeValidation},
+		{"api error", Forbidden("nope"), 403, CodeForbidden},
+		{"too many attempts", TooManyAttempts("slow down"), 429, CodeTooManyTries},
+		{"wrapped api error", fmt.Errorf("handler: %w", Conflict("taken", nil)), 409, CodeConflict},
+		{"unknown", errors.New("connection refused"), 500, CodeInternalError},
+	}
+
+	for _, c := range cases {
+		apiErr := From(c.err)
+		if apiErr.Status != c.status {
+			t.Errorf("%s: expected status %d, got %d", c.name, c.status, apiErr.Status)
+		}
+		if apiErr.Code != c.code {
+			t.Errorf("%s: expected code %q, got %q", c.name, c.code, apiErr.Code)
+		}
+	}
+}
+
+func TestWriteDoesNotLeakInternalErrors(t *testing.T) {
+	handler := requestid.Middleware(HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return errors.New(`pq: relation "users" does not exist`)
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(requestid.Header, "req-123")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != 500 {
+		t.Errorf("Expected status 500, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected application/json, got %q", ct)
+	}
+	if strings.Contains(rec.Body.String(), "relation") {
+		t.Errorf("Response leaked internal error: %s", rec.Body.String())
+	}
+
+	resp := Response{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if resp.Code != CodeInternalError {
+		t.Errorf("Expected code %q, got %q", CodeInternalError, resp.Code)
+	}
+	if resp.RequestID != "req-123" {
+		t.Errorf("Expected request ID req-123, got %q", resp.RequestID)
+	}
+}
+
+func TestWriteDetails(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", nil)
+	Write(rec, req, BadRequest("invalid", nil).WithDetails(map[string]string{"email": "is required"}))
+
+	resp := Response{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if rec.Code != 400 || resp.Details["email"] != "is required" {
+		t.Errorf("Unexpected response %d %+v", rec.Code, resp)
+	}
+}
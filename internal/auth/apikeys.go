@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// APIKeyPrefix starts every personal API key, which tells them apart from
+// other keys sent with the ApiKey scheme and makes leaked keys easy to scan
+// for.
+const APIKeyPrefix = "chirpy_"
+
+const (
+	ScopeChirpsRead  = "chirps:read"
+	ScopeChirpsWrite = "chirps:write"
+)
+
+// Scopes lists every scope an API key can be granted.
+var Scopes = []string{ScopeChirpsRead, ScopeChirpsWrite}
+
+func ValidScope(scope string) bool {
+	return slices.Contains(Scopes, scope)
+}
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// APIKey is an authenticated personal API key.
+type APIKey struct {
+	ID     uuid.UUID
+	UserID uuid.UUID
+	Scopes []string
+}
+
+func (k APIKey) HasScopes(scopes ...string) bool {
+	for _, scope := range scopes {
+		if !slices.Contains(k.Scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// APIKeyLookup finds the active key with the given hash. It returns
+// ErrAPIKeyNotFound if there is none.
+type APIKeyLookup func(ctx context.Context, keyHash string) (APIKey, error)
+
+// MakeAPIKey returns a new key like "chirpy_abcdefgh_<secret>" and its
+// prefix "chirpy_abcdefgh", which is stored in the clear so users can tell
+// their keys apart.
+func MakeAPIKey() (key string, prefix string) {
+	prefix = APIKeyPrefix + strings.ToLower(rand.Text()[:8])
+	return prefix + "_" + strings.ToLower(rand.Text()), prefix
+}
+
+// getPersonalAPIKey returns the personal API key in the Authorization
+// header, if there is one.
+func getPersonalAPIKey(header http.Header) (string, bool) {
+	key, err := GetAPIKey(header)
+	if err != nil || !strings.HasPrefix(key, APIKeyPrefix) {
+		return "", false
+	}
+	return key, true
+}
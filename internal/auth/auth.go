@@ -2,7 +2,9 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -13,8 +15,48 @@ import (
 	"github.com/google/uuid"
 )
 
+// UnsetPasswordHash is the hashed_password of accounts without a password:
+// ones created before passwords were stored and ones created through OpenID
+// Connect. Nothing can match it, those users log in through their identity
+// provider or set a password with a password reset.
+const UnsetPasswordHash = "unset"
+
+var ErrPasswordNotSet = errors.New("account has no password set")
+
+// PasswordParams are the argon2id cost parameters new hashes are created
+// with.
+type PasswordParams struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+var DefaultPasswordParams = PasswordParams{
+	Memory:      argon2id.DefaultParams.Memory,
+	Iterations:  argon2id.DefaultParams.Iterations,
+	Parallelism: argon2id.DefaultParams.Parallelism,
+}
+
+var passwordParams = DefaultPasswordParams
+
+// SetPasswordParams changes the parameters used by HashPassword. It is meant
+// to be called once at startup.
+func SetPasswordParams(params PasswordParams) {
+	passwordParams = params
+}
+
+func (p PasswordParams) argon2id() *argon2id.Params {
+	return &argon2id.Params{
+		Memory:      p.Memory,
+		Iterations:  p.Iterations,
+		Parallelism: p.Parallelism,
+		SaltLength:  argon2id.DefaultParams.SaltLength,
+		KeyLength:   argon2id.DefaultParams.KeyLength,
+	}
+}
+
 func HashPassword(password string) (string, error) {
-	hash, err := argon2id.CreateHash(password, argon2id.DefaultParams)
+	hash, err := argon2id.CreateHash(password, passwordParams.argon2id())
 	if err != nil {
 		return "", err
 	}
@@ -22,25 +64,34 @@ func HashPassword(password string) (string, error) {
 	return hash, nil
 }
 
-func CheckPasswordHash(password, hash string) (bool, error) {
-	isTrue, err := argon2id.ComparePasswordAndHash(password, hash)
+// CheckPasswordHash reports whether password matches hash and, if it does,
+// whether hash was created with weaker parameters than the configured ones
+// and should be replaced. Parallelism only changes how the work is spread
+// over cores, so a different value alone doesn't ask for a rehash.
+func CheckPasswordHash(password, hash string) (match bool, needsRehash bool, err error) {
+	if hash == UnsetPasswordHash {
+		return false, false, ErrPasswordNotSet
+	}
+
+	match, params, err := argon2id.CheckHash(password, hash)
 	if err != nil {
-		return false, err
+		return false, false, err
+	}
+	if !match {
+		return false, false, nil
 	}
 
-	return isTrue, nil
+	wanted := passwordParams.argon2id()
+	needsRehash = params.Memory < wanted.Memory ||
+		params.Iterations < wanted.Iterations ||
+		params.SaltLength < wanted.SaltLength ||
+		params.KeyLength < wanted.KeyLength
+	return true, needsRehash, nil
 }
 
-func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (string, error) {
-	claims := jwt.RegisteredClaims{
-		Issuer: "chirpy",
-		IssuedAt: jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
-		Subject: userID.String(),
-	}
-
-	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signedToken, err := jwtToken.SignedString([]byte(tokenSecret))
+// MakeJWT issues an access token for userID.
+func MakeJWT(userID uuid.UUID, keys *KeySet, expiresIn time.Duration) (string, error) {
+	signedToken, err := SignJWT(NewClaims(userID, TokenTypeAccess, expiresIn), keys)
 	if err != nil {
 		return "", err
 	}
@@ -48,29 +99,31 @@ func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (str
 	return signedToken, nil
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	claims := &jwt.RegisteredClaims{}
-
-	token, err := jwt.ParseWithClaims(
-		tokenString,
-		claims,
-		func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(tokenSecret), nil
-		},
-	)
+func ParseJWT(tokenString string, keys *KeySet, opts ValidateOptions) (*Claims, error) {
+	claims := &Claims{}
+
+	_, err := jwt.ParseWithClaims(tokenString, claims, keys.keyFunc, opts.parserOptions()...)
 	if err != nil {
-		return uuid.Nil, err
+		return nil, err
+	}
+
+	err = opts.checkTokenType(claims)
+	if err != nil {
+		return nil, err
 	}
 
-	userIDString, err := token.Claims.GetSubject()
+	return claims, nil
+}
+
+// ValidateJWT validates an access token with DefaultValidateOptions and
+// returns its subject.
+func ValidateJWT(tokenString string, keys *KeySet) (uuid.UUID, error) {
+	claims, err := ParseJWT(tokenString, keys, DefaultValidateOptions)
 	if err != nil {
 		return uuid.Nil, err
 	}
 
-	userID, err := uuid.Parse(userIDString)
+	userID, err := uuid.Parse(claims.Subject)
 	if err != nil {
 		return uuid.Nil, err
 	}
@@ -100,6 +153,20 @@ func MakeRefreshToken() (string, error) {
 	return token, nil
 }
 
+// HashRefreshToken returns the value refresh tokens are stored and looked up
+// by, so a leaked table doesn't hand out usable tokens.
+func HashRefreshToken(token string) string {
+	return HashToken(token)
+}
+
+// HashToken hashes a random single-use token such as a password reset
+// token. Unlike passwords these have enough entropy that a fast hash is
+// fine.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func GetAPIKey(header http.Header) (string, error) {
 	apiString := header.Get("Authorization")
 	if apiString == "" {
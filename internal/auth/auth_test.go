@@ -1,8 +1,10 @@
 package auth
 
 import (
+	"errors"
 	"testing"
 	"time"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 )
 
@@ -18,15 +20,18 @@ func TestPasswordHashing(t *testing.T) {
 		t.Errorf("Hash should not be the same as the password")
 	}
 
-	match, err := CheckPasswordHash(password, hash)
+	match, needsRehash, err := CheckPasswordHash(password, hash)
 	if err != nil {
 		t.Fatalf("Error checking password hash: %v", err)
 	}
 	if !match {
 		t.Errorf("Expected password to match hash, but it didn't")
 	}
+	if needsRehash {
+		t.Errorf("Expected fresh hash not to need a rehash")
+	}
 
-	match, err = CheckPasswordHash("wrong-password", hash)
+	match, _, err = CheckPasswordHash("wrong-password", hash)
 	if err != nil {
 		t.Fatalf("Error checking wrong password: %v", err)
 	}
@@ -35,12 +40,58 @@ func TestPasswordHashing(t *testing.T) {
 	}
 }
 
+func TestCheckPasswordHashNeedsRehash(t *testing.T) {
+	defer SetPasswordParams(DefaultPasswordParams)
+
+	weak := DefaultPasswordParams
+	weak.Memory = 16 * 1024
+	SetPasswordParams(weak)
+	hash, err := HashPassword("my-secret-password")
+	if err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+
+	SetPasswordParams(DefaultPasswordParams)
+	match, needsRehash, err := CheckPasswordHash("my-secret-password", hash)
+	if err != nil {
+		t.Fatalf("Error checking password hash: %v", err)
+	}
+	if !match || !needsRehash {
+		t.Errorf("Expected match and rehash for weaker hash, got match=%v needsRehash=%v", match, needsRehash)
+	}
+
+	// A wrong password never asks for a rehash.
+	_, needsRehash, _ = CheckPasswordHash("wrong-password", hash)
+	if needsRehash {
+		t.Errorf("Expected no rehash for a wrong password")
+	}
+
+	stronger := DefaultPasswordParams
+	stronger.Parallelism = 1
+	SetPasswordParams(stronger)
+	hash, err = HashPassword("my-secret-password")
+	if err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+	SetPasswordParams(DefaultPasswordParams)
+	if _, needsRehash, _ := CheckPasswordHash("my-secret-password", hash); needsRehash {
+		t.Errorf("Expected different parallelism alone not to need a rehash")
+	}
+}
+
+func TestCheckPasswordHashUnset(t *testing.T) {
+	_, _, err := CheckPasswordHash("anything", UnsetPasswordHash)
+	if !errors.Is(err, ErrPasswordNotSet) {
+		t.Errorf("Expected ErrPasswordNotSet, got %v", err)
+	}
+}
+
 func TestJWT(t *testing.T) {
 	userID := uuid.New()
 	secret := "test-secret-key-12345"
 	duration := time.Hour
 
-	tokenString, err := MakeJWT(userID, secret, duration)
+	tokenString, err := MakeJWT(userID, NewKeySet(secret), duration)
 	if err != nil {
 		t.Fatalf("Error making JWT: %v", err)
 	}
@@ -49,7 +100,7 @@ func TestJWT(t *testing.T) {
 		t.Error("Expected token string to be non-empty")
 	}
 
-	parsedID, err := ValidateJWT(tokenString, secret)
+	parsedID, err := ValidateJWT(tokenString, NewKeySet(secret))
 	if err != nil {
 		t.Fatalf("Error validating JWT: %v", err)
 	}
@@ -64,12 +115,12 @@ func TestExpiredJWT(t *testing.T) {
 	secret := "test-secret"
 	expiredDuration := -time.Second 
 
-	tokenString, err := MakeJWT(userID, secret, expiredDuration)
+	tokenString, err := MakeJWT(userID, NewKeySet(secret), expiredDuration)
 	if err != nil {
 		t.Fatalf("Error making expired JWT: %v", err)
 	}
 
-	_, err = ValidateJWT(tokenString, secret)
+	_, err = ValidateJWT(tokenString, NewKeySet(secret))
 	if err == nil {
 		t.Error("Expected error for expired token, but got nil")
 	}
@@ -77,13 +128,108 @@ func TestExpiredJWT(t *testing.T) {
 
 func TestWrongSecretJWT(t *testing.T) {
 	userID := uuid.New()
-	tokenString, err := MakeJWT(userID, "secret-A", time.Hour)
+	tokenString, err := MakeJWT(userID, NewKeySet("secret-A"), time.Hour)
 	if err != nil {
 		t.Fatalf("Error making JWT: %v", err)
 	}
 
-	_, err = ValidateJWT(tokenString, "secret-B")
+	_, err = ValidateJWT(tokenString, NewKeySet("secret-B"))
 	if err == nil {
 		t.Error("Expected error when validating with wrong secret, got nil")
 	}
-}
\ No newline at end of file
+}
+func TestHashRefreshToken(t *testing.T) {
+	token, err := MakeRefreshToken()
+	if err != nil {
+		t.Fatalf("Error making refresh token: %v", err)
+	}
+
+	hash := HashRefreshToken(token)
+	if hash == token {
+		t.Errorf("Hash should not be the same as the token")
+	}
+	if hash != HashRefreshToken(token) {
+		t.Errorf("Expected hashing to be deterministic")
+	}
+
+	other, err := MakeRefreshToken()
+	if err != nil {
+		t.Fatalf("Error making refresh token: %v", err)
+	}
+	if HashRefreshToken(other) == hash {
+		t.Errorf("Expected different tokens to have different hashes")
+	}
+}
+
+func TestParseJWTValidation(t *testing.T) {
+	keys := NewKeySet("test-secret")
+	userID := uuid.New()
+
+	valid := func() *Claims {
+		claims := NewClaims(userID, TokenTypeAccess, time.Hour)
+		claims.Audience = jwt.ClaimStrings{"chirpy-api"}
+		claims.SessionID = "session-1"
+		return claims
+	}
+	opts := ValidateOptions{
+		Issuer:    Issuer,
+		Audience:  "chirpy-api",
+		Leeway:    30 * time.Second,
+		TokenType: TokenTypeAccess,
+	}
+
+	cases := []struct {
+		name    string
+		modify  func(c *Claims)
+		wantErr bool
+	}{
+		{"valid", func(c *Claims) {}, false},
+		{"wrong issuer", func(c *Claims) { c.Issuer = "someone-else" }, true},
+		{"missing issuer", func(c *Claims) { c.Issuer = "" }, true},
+		{"wrong audience", func(c *Claims) { c.Audience = jwt.ClaimStrings{"other-api"} }, true},
+		{"missing audience", func(c *Claims) { c.Audience = nil }, true},
+		{"wrong token type", func(c *Claims) { c.TokenType = "refresh" }, true},
+		{"missing token type", func(c *Claims) { c.TokenType = "" }, true},
+		{"missing expiry", func(c *Claims) { c.ExpiresAt = nil }, true},
+		{"expired within leeway", func(c *Claims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-10 * time.Second)) }, false},
+		{"expired beyond leeway", func(c *Claims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) }, true},
+		{"issued in the future", func(c *Claims) { c.IssuedAt = jwt.NewNumericDate(time.Now().Add(time.Hour)) }, true},
+		{"not valid yet", func(c *Claims) { c.NotBefore = jwt.NewNumericDate(time.Now().Add(time.Hour)) }, true},
+	}
+
+	for _, c := range cases {
+		claims := valid()
+		c.modify(claims)
+		tokenString, err := SignJWT(claims, keys)
+		if err != nil {
+			t.Fatalf("%s: error signing JWT: %v", c.name, err)
+		}
+
+		parsed, err := ParseJWT(tokenString, keys, opts)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got nil", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		if parsed.Subject != userID.String() || parsed.SessionID != "session-1" {
+			t.Errorf("%s: unexpected claims %+v", c.name, parsed)
+		}
+	}
+}
+
+func TestValidateJWTRejectsOtherTokenTypes(t *testing.T) {
+	keys := NewKeySet("test-secret")
+	tokenString, err := SignJWT(NewClaims(uuid.New(), "mfa_challenge", time.Hour), keys)
+	if err != nil {
+		t.Fatalf("Error signing JWT: %v", err)
+	}
+
+	if _, err := ValidateJWT(tokenString, keys); err == nil {
+		t.Error("Expected non-access token to be rejected, got nil")
+	}
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const Issuer = "chirpy"
+
+const (
+	TokenTypeAccess            = "access"
+	TokenTypeEmailVerification = "email_verification"
+	TokenTypeMFAChallenge      = "mfa_challenge"
+)
+
+// Claims are the claims of every JWT issued by chirpy. TokenType keeps a
+// token minted for one purpose from being accepted for another.
+type Claims struct {
+	jwt.RegisteredClaims
+	TokenType string `json:"token_type"`
+	SessionID string `json:"sid,omitempty"`
+	// Email binds an email verification token to the address it was sent
+	// to, so it stops working once the user changes their email.
+	Email string `json:"email,omitempty"`
+}
+
+// ValidateOptions describes what a token must look like to be accepted.
+// Empty fields are not checked.
+type ValidateOptions struct {
+	Issuer    string
+	Audience  string
+	Leeway    time.Duration
+	TokenType string
+}
+
+// DefaultValidateOptions accepts chirpy access tokens for any audience.
+var DefaultValidateOptions = ValidateOptions{
+	Issuer:    Issuer,
+	TokenType: TokenTypeAccess,
+}
+
+func NewClaims(userID uuid.UUID, tokenType string, expiresIn time.Duration) *Claims {
+	now := time.Now().UTC()
+	return &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    Issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
+			Subject:   userID.String(),
+		},
+		TokenType: tokenType,
+	}
+}
+
+func SignJWT(claims *Claims, keys *KeySet) (string, error) {
+	return keys.sign(claims)
+}
+
+func (opts ValidateOptions) parserOptions() []jwt.ParserOption {
+	parserOpts := []jwt.ParserOption{
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(opts.Leeway),
+	}
+	if opts.Issuer != "" {
+		parserOpts = append(parserOpts, jwt.WithIssuer(opts.Issuer))
+	}
+	if opts.Audience != "" {
+		parserOpts = append(parserOpts, jwt.WithAudience(opts.Audience))
+	}
+	return parserOpts
+}
+
+func (opts ValidateOptions) checkTokenType(claims *Claims) error {
+	if opts.TokenType != "" && claims.TokenType != opts.TokenType {
+		return fmt.Errorf("%w: expected token type %q, got %q", jwt.ErrTokenInvalidClaims, opts.TokenType, claims.TokenType)
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key is an asymmetric JWT key. Private is nil for keys that are only kept
+// around to verify tokens issued before a rotation.
+type Key struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+	Public  crypto.PublicKey
+}
+
+// KeySet holds every key tokens may be signed or verified with. Tokens are
+// signed with the active key and carry its kid. Without a signing key,
+// tokens are signed and verified with the HMAC secret using HS256. Once a
+// signing key is set, HS256 tokens are only accepted until the time given
+// to AcceptHMACUntil, so access tokens issued before the switch to
+// asymmetric keys stay valid until they expire.
+type KeySet struct {
+	hmacSecret []byte
+	hmacUntil  time.Time
+	signing    *Key
+	keys       map[string]*Key
+}
+
+func NewKeySet(hmacSecret string) *KeySet {
+	return &KeySet{
+		hmacSecret: []byte(hmacSecret),
+		keys:       map[string]*Key{},
+	}
+}
+
+func (ks *KeySet) Add(key *Key) error {
+	if key.ID == "" {
+		return fmt.Errorf("key has no id")
+	}
+	if _, ok := ks.keys[key.ID]; ok {
+		return fmt.Errorf("duplicate key id %q", key.ID)
+	}
+	ks.keys[key.ID] = key
+	return nil
+}
+
+// SetSigningKey selects the key new tokens are signed with.
+func (ks *KeySet) SetSigningKey(kid string) error {
+	key, ok := ks.keys[kid]
+	if !ok {
+		return fmt.Errorf("unknown key id %q", kid)
+	}
+	if key.Private == nil {
+		return fmt.Errorf("key %q has no private key", kid)
+	}
+	ks.signing = key
+	return nil
+}
+
+// AcceptHMACUntil sets the end of the migration window in which tokens
+// signed with the HMAC secret are still accepted next to a signing key.
+func (ks *KeySet) AcceptHMACUntil(t time.Time) {
+	ks.hmacUntil = t
+}
+
+func (ks *KeySet) acceptsHMAC() bool {
+	if len(ks.hmacSecret) == 0 {
+		return false
+	}
+	return ks.signing == nil || time.Now().Before(ks.hmacUntil)
+}
+
+func (ks *KeySet) sign(claims jwt.Claims) (string, error) {
+	if ks.signing == nil {
+		if len(ks.hmacSecret) == 0 {
+			return "", fmt.Errorf("no signing key configured")
+		}
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(ks.hmacSecret)
+	}
+
+	token := jwt.NewWithClaims(ks.signing.Method, claims)
+	token.Header["kid"] = ks.signing.ID
+	return token.SignedString(ks.signing.Private)
+}
+
+// keyFunc picks the verification key for a token by its kid header.
+func (ks *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		if !ks.acceptsHMAC() {
+			return nil, fmt.Errorf("HMAC signed tokens are no longer accepted")
+		}
+		return ks.hmacSecret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.Public, nil
+}
+
+// LoadKeyDir loads every .pem file in dir. The file name without extension
+// is used as the kid. PKCS#8 private keys can sign and verify, PKIX public
+// keys can only verify.
+func LoadKeyDir(dir string) ([]*Key, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	keys := make([]*Key, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+		key, err := ParsePEMKey(kid, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func ParsePEMKey(kid string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := parsed.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", parsed)
+		}
+		key, err := newKey(kid, signer.Public())
+		if err != nil {
+			return nil, err
+		}
+		key.Private = signer
+		return key, nil
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newKey(kid, parsed)
+	}
+	return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+}
+
+func newKey(kid string, public crypto.PublicKey) (*Key, error) {
+	switch public.(type) {
+	case *rsa.PublicKey:
+		return &Key{ID: kid, Method: jwt.SigningMethodRS256, Public: public}, nil
+	case ed25519.PublicKey:
+		return &Key{ID: kid, Method: jwt.SigningMethodEdDSA, Public: public}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", public)
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public half of every asymmetric key, sorted by kid.
+// The HMAC secret is never published.
+func (ks *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range ks.keys {
+		jwk := JWK{
+			Kid: key.ID,
+			Use: "sig",
+			Alg: key.Method.Alg(),
+		}
+		switch public := key.Public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	sort.Slice(jwks.Keys, func(i, j int) bool {
+		return jwks.Keys[i].Kid < jwks.Keys[j].Kid
+	})
+	return jwks
+}
@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+func writePrivateKey(t *testing.T, dir, kid string, key crypto.Signer) {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error marshaling private key: %v", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, kid+".pem"), data, 0o600); err != nil {
+		t.Fatalf("Error writing key: %v", err)
+	}
+}
+
+func writePublicKey(t *testing.T, dir, kid string, key crypto.PublicKey) {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatalf("Error marshaling public key: %v", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, kid+".pem"), data, 0o600); err != nil {
+		t.Fatalf("Error writing key: %v", err)
+	}
+}
+
+func loadKeySet(t *testing.T, dir, hmacSecret, signingKID string) *KeySet {
+	t.Helper()
+	keys, err := LoadKeyDir(dir)
+	if err != nil {
+		t.Fatalf("Error loading keys: %v", err)
+	}
+	ks := NewKeySet(hmacSecret)
+	for _, key := range keys {
+		if err := ks.Add(key); err != nil {
+			t.Fatalf("Error adding key: %v", err)
+		}
+	}
+	if signingKID != "" {
+		if err := ks.SetSigningKey(signingKID); err != nil {
+			t.Fatalf("Error setting signing key: %v", err)
+		}
+	}
+	return ks
+}
+
+func TestAsymmetricJWT(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating RSA key: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating Ed25519 key: %v", err)
+	}
+	writePrivateKey(t, dir, "rsa-1", rsaKey)
+	writePrivateKey(t, dir, "ed-1", edKey)
+
+	for _, kid := range []string{"rsa-1", "ed-1"} {
+		ks := loadKeySet(t, dir, "", kid)
+		userID := uuid.New()
+
+		tokenString, err := MakeJWT(userID, ks, time.Hour)
+		if err != nil {
+			t.Fatalf("Error making JWT with %s: %v", kid, err)
+		}
+
+		parsedID, err := ValidateJWT(tokenString, ks)
+		if err != nil {
+			t.Fatalf("Error validating JWT with %s: %v", kid, err)
+		}
+		if parsedID != userID {
+			t.Errorf("Expected UserID %v, got %v", userID, parsedID)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	_, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, newKey, _ := ed25519.GenerateKey(rand.Reader)
+	writePrivateKey(t, dir, "2024-01", oldKey)
+
+	before := loadKeySet(t, dir, "", "2024-01")
+	tokenString, err := MakeJWT(uuid.New(), before, time.Hour)
+	if err != nil {
+		t.Fatalf("Error making JWT: %v", err)
+	}
+
+	// Rotate: the new key signs, the old one is kept for verification only.
+	writePrivateKey(t, dir, "2024-02", newKey)
+	writePublicKey(t, dir, "2024-01", oldKey.Public())
+	after := loadKeySet(t, dir, "", "2024-02")
+
+	if _, err := ValidateJWT(tokenString, after); err != nil {
+		t.Errorf("Expected token signed with old key to stay valid: %v", err)
+	}
+	if err := after.SetSigningKey("2024-01"); err == nil {
+		t.Errorf("Expected public-only key to be rejected as signing key")
+	}
+
+	// Once the old key is removed its tokens are rejected.
+	os.Remove(filepath.Join(dir, "2024-01.pem"))
+	removed := loadKeySet(t, dir, "", "2024-02")
+	if _, err := ValidateJWT(tokenString, removed); err == nil {
+		t.Errorf("Expected token with unknown kid to be rejected")
+	}
+}
+
+func TestHMACMigrationWindow(t *testing.T) {
+	dir := t.TempDir()
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	writePrivateKey(t, dir, "ed-1", edKey)
+
+	legacy, err := MakeJWT(uuid.New(), NewKeySet("old-secret"), time.Hour)
+	if err != nil {
+		t.Fatalf("Error making HS256 JWT: %v", err)
+	}
+
+	withSecret := loadKeySet(t, dir, "old-secret", "ed-1")
+	if _, err := ValidateJWT(legacy, withSecret); err == nil {
+		t.Errorf("Expected HS256 token to be rejected without a migration window")
+	}
+
+	withSecret.AcceptHMACUntil(time.Now().Add(time.Hour))
+	if _, err := ValidateJWT(legacy, withSecret); err != nil {
+		t.Errorf("Expected HS256 token to be accepted during migration: %v", err)
+	}
+
+	withSecret.AcceptHMACUntil(time.Now().Add(-time.Minute))
+	if _, err := ValidateJWT(legacy, withSecret); err == nil {
+		t.Errorf("Expected HS256 token to be rejected after the migration window")
+	}
+
+	withoutSecret := loadKeySet(t, dir, "", "ed-1")
+	if _, err := ValidateJWT(legacy, withoutSecret); err == nil {
+		t.Errorf("Expected HS256 token to be rejected once the secret is removed")
+	}
+}
+
+func TestOnlyHS256Accepted(t *testing.T) {
+	claims := NewClaims(uuid.New(), TokenTypeAccess, time.Hour)
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS512, claims).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Error making HS512 JWT: %v", err)
+	}
+
+	if _, err := ValidateJWT(tokenString, NewKeySet("secret")); err == nil {
+		t.Errorf("Expected HS512 token to be rejected")
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating RSA key: %v", err)
+	}
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	writePrivateKey(t, dir, "b-rsa", rsaKey)
+	writePublicKey(t, dir, "a-ed", edKey.Public())
+
+	jwks := loadKeySet(t, dir, "secret", "b-rsa").JWKS()
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("Expected 2 keys, got %d", len(jwks.Keys))
+	}
+
+	ed, rsaJWK := jwks.Keys[0], jwks.Keys[1]
+	if ed.Kid != "a-ed" || ed.Kty != "OKP" || ed.Crv != "Ed25519" || ed.Alg != "EdDSA" || ed.X == "" {
+		t.Errorf("Unexpected Ed25519 JWK: %+v", ed)
+	}
+	if rsaJWK.Kid != "b-rsa" || rsaJWK.Kty != "RSA" || rsaJWK.Alg != "RS256" || rsaJWK.E != "AQAB" || rsaJWK.N == "" {
+		t.Errorf("Unexpected RSA JWK: %+v", rsaJWK)
+	}
+}
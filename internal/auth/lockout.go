@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"github.com/alexedwards/argon2id"
+)
+
+// LockoutPolicy decides how long further login attempts are refused after
+// a number of consecutive failures.
+type LockoutPolicy struct {
+	// FreeAttempts failures are allowed before any delay kicks in.
+	FreeAttempts int
+	// BaseDelay is doubled for every failure past FreeAttempts, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// After LockoutThreshold failures logins are refused for LockoutDuration.
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// ResetAfter is how long without failures before the count starts over.
+	ResetAfter time.Duration
+}
+
+// LockedFor returns how long to refuse logins after the given number of
+// consecutive failures.
+func (p LockoutPolicy) LockedFor(failures int) time.Duration {
+	if p.LockoutThreshold > 0 && failures >= p.LockoutThreshold {
+		return p.LockoutDuration
+	}
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures; i++ {
+		delay *= 2
+		if delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return min(delay, p.MaxDelay)
+}
+
+var (
+	dummyHashMu sync.Mutex
+	dummyHash   string
+)
+
+// CheckDummyPasswordHash runs a password comparison that always fails. It
+// is used for unknown users so a login takes as long as it would for an
+// existing account. The dummy hash is recreated when the password
+// parameters change so it keeps costing the same as a real one.
+func CheckDummyPasswordHash(password string) {
+	dummyHashMu.Lock()
+	if dummyHash == "" || dummyHashStale() {
+		hash, err := HashPassword("chirpy-dummy-password")
+		if err != nil {
+			dummyHashMu.Unlock()
+			return
+		}
+		dummyHash = hash
+	}
+	hash := dummyHash
+	dummyHashMu.Unlock()
+
+	CheckPasswordHash(password, hash)
+}
+
+func dummyHashStale() bool {
+	params, _, _, err := argon2id.DecodeHash(dummyHash)
+	return err != nil || *params != *passwordParams.argon2id()
+}
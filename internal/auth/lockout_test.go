@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutPolicy(t *testing.T) {
+	policy := LockoutPolicy{
+		FreeAttempts:     3,
+		BaseDelay:        time.Second,
+		MaxDelay:         10 * time.Second,
+		LockoutThreshold: 10,
+		LockoutDuration:  time.Hour,
+	}
+
+	cases := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{0, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{7, 8 * time.Second},
+		{8, 10 * time.Second},
+		{9, 10 * time.Second},
+		{10, time.Hour},
+		{50, time.Hour},
+	}
+
+	for _, c := range cases {
+		if got := policy.LockedFor(c.failures); got != c.expected {
+			t.Errorf("Expected %v after %d failures, got %v", c.expected, c.failures, got)
+		}
+	}
+}
+
+func TestCheckDummyPasswordHashTakesTime(t *testing.T) {
+	CheckDummyPasswordHash("warm-up")
+
+	start := time.Now()
+	CheckDummyPasswordHash("some-password")
+	dummy := time.Since(start)
+
+	hash, err := HashPassword("real-password")
+	if err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+	start = time.Now()
+	CheckPasswordHash("some-password", hash)
+	real := time.Since(start)
+
+	if dummy < real/4 {
+		t.Errorf("Expected dummy comparison (%v) to take about as long as a real one (%v)", dummy, real)
+	}
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"grysha11/httpServersGo/internal/apierror"
+
+	"github.com/google/uuid"
+)
+
+type Mode int
+
+const (
+	// Required rejects requests without a valid access token.
+	Required Mode = iota
+	// Optional lets anonymous requests through but still rejects invalid
+	// tokens, so a client never silently loses its identity.
+	Optional
+)
+
+type contextKey int
+
+const (
+	userIDKey contextKey = iota
+	claimsKey
+	apiKeyKey
+)
+
+// UserCheck is called for every valid access token and returns an error if
+// its user must not use it anymore, for example because the account was
+// deleted after the token was issued.
+type UserCheck func(ctx context.Context, userID uuid.UUID) error
+
+// Authenticator checks the credentials of incoming requests. Access tokens
+// are always accepted if CheckUser lets them through, personal API keys only
+// if LookupAPIKey is set and the route asks for scopes the key has.
+type Authenticator struct {
+	Keys         *KeySet
+	Options      ValidateOptions
+	LookupAPIKey APIKeyLookup
+	CheckUser    UserCheck
+}
+
+// Middleware validates the bearer access token against opts and stores the
+// user ID and claims in the request context.
+func Middleware(keys *KeySet, opts ValidateOptions, mode Mode) func(http.Handler) http.Handler {
+	return (&Authenticator{Keys: keys, Options: opts}).Middleware(mode)
+}
+
+// Middleware authenticates requests and stores the user ID in the request
+// context, together with the token claims or the API key that was used.
+// Routes that pass no scopes only accept access tokens, API keys must hold
+// every scope listed.
+func (a *Authenticator) Middleware(mode Mode, scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if mode == Optional && r.Header.Get("Authorization") == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if rawKey, ok := getPersonalAPIKey(r.Header); ok {
+				a.serveAPIKey(w, r, next, rawKey, scopes)
+				return
+			}
+
+			token, err := GetBearerToken(r.Header)
+			if err != nil {
+				apierror.Write(w, r, apierror.Unauthorized("missing or malformed authorization header", err))
+				return
+			}
+
+			claims, err := ParseJWT(token, a.Keys, a.Options)
+			if err != nil {
+				apierror.Write(w, r, err)
+				return
+			}
+
+			userID, err := uuid.Parse(claims.Subject)
+			if err != nil {
+				apierror.Write(w, r, apierror.Unauthorized("token subject is invalid", err))
+				return
+			}
+			if a.CheckUser != nil {
+				if err := a.CheckUser(r.Context(), userID); err != nil {
+					apierror.Write(w, r, err)
+					return
+				}
+			}
+
+			ctx := context.WithValue(r.Context(), userIDKey, userID)
+			ctx = context.WithValue(ctx, claimsKey, claims)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func (a *Authenticator) serveAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, rawKey string, scopes []string) {
+	if a.LookupAPIKey == nil || len(scopes) == 0 {
+		apierror.Write(w, r, apierror.Unauthorized("api keys are not accepted here", nil))
+		return
+	}
+
+	key, err := a.LookupAPIKey(r.Context(), HashToken(rawKey))
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		apierror.Write(w, r, apierror.Unauthorized("api key is invalid or revoked", err))
+		return
+	}
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+	if !key.HasScopes(scopes...) {
+		apierror.Write(w, r, apierror.Forbidden("api key is missing scope "+strings.Join(scopes, ", ")))
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), userIDKey, key.UserID)
+	ctx = context.WithValue(ctx, apiKeyKey, key)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func UserIDFromContext(ctx context.Context) (uuid.UUID, bool) {
+	userID, ok := ctx.Value(userIDKey).(uuid.UUID)
+	return userID, ok
+}
+
+func APIKeyFromContext(ctx context.Context) (APIKey, bool) {
+	key, ok := ctx.Value(apiKeyKey).(APIKey)
+	return key, ok
+}
+
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*Claims)
+	return claims, ok
+}
@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func runMiddleware(t *testing.T, mode Mode, authorization string) (*httptest.ResponseRecorder, uuid.UUID, bool) {
+	t.Helper()
+
+	var gotID uuid.UUID
+	var gotOK bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotID, gotOK = UserIDFromContext(r.Context())
+		if _, ok := ClaimsFromContext(r.Context()); ok != gotOK {
+			t.Errorf("Expected claims presence to match user ID presence")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	Middleware(NewKeySet("secret"), DefaultValidateOptions, mode)(next).ServeHTTP(rec, req)
+	return rec, gotID, gotOK
+}
+
+func TestMiddlewareRequired(t *testing.T) {
+	userID := uuid.New()
+	token, err := MakeJWT(userID, NewKeySet("secret"), time.Hour)
+	if err != nil {
+		t.Fatalf("Error making JWT: %v", err)
+	}
+
+	rec, gotID, ok := runMiddleware(t, Required, "Bearer "+token)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d", rec.Code)
+	}
+	if !ok || gotID != userID {
+		t.Errorf("Expected user ID %v in context, got %v", userID, gotID)
+	}
+
+	rec, _, _ = runMiddleware(t, Required, "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without token, got %d", rec.Code)
+	}
+
+	rec, _, _ = runMiddleware(t, Required, "Basic abc")
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for wrong scheme, got %d", rec.Code)
+	}
+
+	wrongSecret, err := MakeJWT(userID, NewKeySet("other-secret"), time.Hour)
+	if err != nil {
+		t.Fatalf("Error making JWT: %v", err)
+	}
+	rec, _, _ = runMiddleware(t, Required, "Bearer "+wrongSecret)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for wrong secret, got %d", rec.Code)
+	}
+}
+
+func TestMiddlewareOptional(t *testing.T) {
+	rec, _, ok := runMiddleware(t, Optional, "")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected anonymous request to pass, got %d", rec.Code)
+	}
+	if ok {
+		t.Errorf("Expected no user ID in context for anonymous request")
+	}
+
+	expired, err := MakeJWT(uuid.New(), NewKeySet("secret"), -time.Minute)
+	if err != nil {
+		t.Fatalf("Error making JWT: %v", err)
+	}
+	rec, _, _ = runMiddleware(t, Optional, "Bearer "+expired)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for expired token, got %d", rec.Code)
+	}
+
+	userID := uuid.New()
+	token, err := MakeJWT(userID, NewKeySet("secret"), time.Hour)
+	if err != nil {
+		t.Fatalf("Error making JWT: %v", err)
+	}
+	_, gotID, ok := runMiddleware(t, Optional, "Bearer "+token)
+	if !ok || gotID != userID {
+		t.Errorf("Expected user ID %v in context, got %v", userID, gotID)
+	}
+}
+
+func TestAuthenticatorAPIKeys(t *testing.T) {
+	rawKey, prefix := MakeAPIKey()
+	if !strings.HasPrefix(rawKey, prefix+"_") || !strings.HasPrefix(prefix, APIKeyPrefix) {
+		t.Fatalf("Unexpected key %q with prefix %q", rawKey, prefix)
+	}
+
+	stored := APIKey{ID: uuid.New(), UserID: uuid.New(), Scopes: []string{ScopeChirpsWrite}}
+	a := &Authenticator{
+		Keys:    NewKeySet("secret"),
+		Options: DefaultValidateOptions,
+		LookupAPIKey: func(ctx context.Context, keyHash string) (APIKey, error) {
+			if keyHash != HashToken(rawKey) {
+				return APIKey{}, ErrAPIKeyNotFound
+			}
+			return stored, nil
+		},
+	}
+
+	cases := []struct {
+		name          string
+		authenticator *Authenticator
+		scopes        []string
+		authorization string
+		status        int
+	}{
+		{"matching scope", a, []string{ScopeChirpsWrite}, "ApiKey " + rawKey, http.StatusNoContent},
+		{"missing scope", a, []string{ScopeChirpsRead}, "ApiKey " + rawKey, http.StatusForbidden},
+		{"route without scopes", a, nil, "ApiKey " + rawKey, http.StatusUnauthorized},
+		{"unknown key", a, []string{ScopeChirpsWrite}, "ApiKey " + APIKeyPrefix + "nope", http.StatusUnauthorized},
+		{"other api key", a, []string{ScopeChirpsWrite}, "ApiKey polka-key", http.StatusUnauthorized},
+		{"keys not configured", &Authenticator{Keys: a.Keys, Options: a.Options}, []string{ScopeChirpsWrite}, "ApiKey " + rawKey, http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var gotKey APIKey
+			var gotUserID uuid.UUID
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotKey, _ = APIKeyFromContext(r.Context())
+				gotUserID, _ = UserIDFromContext(r.Context())
+				w.WriteHeader(http.StatusNoContent)
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", c.authorization)
+			rec := httptest.NewRecorder()
+			c.authenticator.Middleware(Required, c.scopes...)(next).ServeHTTP(rec, req)
+
+			if rec.Code != c.status {
+				t.Fatalf("Expected status %d, got %d", c.status, rec.Code)
+			}
+			if c.status == http.StatusNoContent && (gotKey.ID != stored.ID || gotUserID != stored.UserID) {
+				t.Errorf("Expected key %v of user %v in context, got %v of %v", stored.ID, stored.UserID, gotKey.ID, gotUserID)
+			}
+		})
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	userID := uuid.New()
+	cases := []struct {
+		name   string
+		role   Role
+		perm   Permission
+		status int
+	}{
+		{"admin", RoleAdmin, PermViewMetrics, http.StatusNoContent},
+		{"moderator moderates", RoleModerator, PermModerateChirps, http.StatusNoContent},
+		{"moderator is not admin", RoleModerator, PermManageUsers, http.StatusForbidden},
+		{"user", RoleUser, PermModerateChirps, http.StatusForbidden},
+		{"unknown role", Role("root"), PermViewMetrics, http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			lookup := func(ctx context.Context, id uuid.UUID) (Role, error) {
+				if id != userID {
+					t.Errorf("Expected lookup of %v, got %v", userID, id)
+				}
+				return c.role, nil
+			}
+			handler := RequirePermission(lookup, c.perm)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}))
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req = req.WithContext(context.WithValue(req.Context(), userIDKey, userID))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != c.status {
+				t.Errorf("Expected status %d, got %d", c.status, rec.Code)
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	RequirePermission(nil, PermViewMetrics)(nil).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without a user, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	MinPasswordLength = 10
+	// MaxPasswordLength keeps hashing cost bounded.
+	MaxPasswordLength = 128
+)
+
+// commonPasswords are rejected outright no matter how long they are.
+var commonPasswords = map[string]bool{
+	"password123":      true,
+	"password1234":     true,
+	"1234567890":       true,
+	"12345678910":      true,
+	"qwertyuiop":       true,
+	"iloveyou123":      true,
+	"letmein1234":      true,
+	"chirpychirpy":     true,
+	"passwordpassword": true,
+}
+
+// CheckPasswordStrength returns what is wrong with a new password, or an
+// empty string if it is acceptable. Length matters more than character
+// classes, so only length, a list of common passwords and the user's email
+// are checked.
+func CheckPasswordStrength(password, email string) string {
+	length := utf8.RuneCountInString(password)
+	if length < MinPasswordLength {
+		return fmt.Sprintf("must be at least %d characters", MinPasswordLength)
+	}
+	if length > MaxPasswordLength {
+		return fmt.Sprintf("must be at most %d characters", MaxPasswordLength)
+	}
+
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		return "is too common"
+	}
+	if strings.Count(lower, string([]rune(lower)[0])) == utf8.RuneCountInString(lower) {
+		return "must not repeat a single character"
+	}
+	if local, _, ok := strings.Cut(strings.ToLower(email), "@"); ok && len(local) >= 3 && strings.Contains(lower, local) {
+		return "must not contain your email address"
+	}
+	return ""
+}
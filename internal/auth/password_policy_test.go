@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckPasswordStrength(t *testing.T) {
+	cases := []struct {
+		password string
+		email    string
+		ok       bool
+	}{
+		{"correct horse battery", "a@b.c", true},
+		{"ünïcödé-pässwörd", "a@b.c", true},
+		{"short", "a@b.c", false},
+		{"123456789", "a@b.c", false},
+		{strings.Repeat("a", 129), "a@b.c", false},
+		{"Password123", "a@b.c", false},
+		{"zzzzzzzzzzzz", "a@b.c", false},
+		{"walter-white-2008", "walter-white@example.com", false},
+		{"bob-is-my-name", "bob@example.com", false},
+		{"ab-is-not-an-email-part", "ab@example.com", true},
+	}
+
+	for _, c := range cases {
+		problem := CheckPasswordStrength(c.password, c.email)
+		if (problem == "") != c.ok {
+			t.Errorf("Expected ok=%v for %q, got %q", c.ok, c.password, problem)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"slices"
+
+	"grysha11/httpServersGo/internal/apierror"
+
+	"github.com/google/uuid"
+)
+
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+// Roles lists every role, from least to most privileged.
+var Roles = []Role{RoleUser, RoleModerator, RoleAdmin}
+
+func ValidRole(role string) bool {
+	return slices.Contains(Roles, Role(role))
+}
+
+type Permission string
+
+const (
+	PermViewMetrics    Permission = "metrics:read"
+	PermResetDatabase  Permission = "database:reset"
+	PermManageUsers    Permission = "users:manage"
+	PermModerateChirps Permission = "chirps:moderate"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleUser:      nil,
+	RoleModerator: {PermModerateChirps},
+	RoleAdmin:     {PermViewMetrics, PermResetDatabase, PermManageUsers, PermModerateChirps},
+}
+
+// Can reports whether the role grants perm.
+func (r Role) Can(perm Permission) bool {
+	return slices.Contains(rolePermissions[r], perm)
+}
+
+// RoleLookup returns the current role of a user. Roles are looked up on
+// every request rather than stored in tokens, so a demotion takes effect
+// immediately.
+type RoleLookup func(ctx context.Context, userID uuid.UUID) (Role, error)
+
+// RequirePermission only lets requests through whose user has a role that
+// grants perm. It must run after an authentication middleware.
+func RequirePermission(lookup RoleLookup, perm Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := UserIDFromContext(r.Context())
+			if !ok {
+				apierror.Write(w, r, apierror.Unauthorized("authentication required", nil))
+				return
+			}
+
+			role, err := lookup(r.Context(), userID)
+			if err != nil {
+				apierror.Write(w, r, err)
+				return
+			}
+			if !role.Can(perm) {
+				apierror.Write(w, r, apierror.Forbidden("missing permission "+string(perm)))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
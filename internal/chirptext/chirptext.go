@@ -0,0 +1,84 @@
+// Package chirptext validates and normalizes chirp bodies before they are
+// stored.
+package chirptext
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Limits are the longest bodies, in grapheme clusters, that regular and
+// Chirpy Red users may post.
+type Limits struct {
+	Default   int
+	ChirpyRed int
+}
+
+var DefaultLimits = Limits{
+	Default:   140,
+	ChirpyRed: 280,
+}
+
+// Max returns the limit that applies to a user.
+func (l Limits) Max(isChirpyRed bool) int {
+	if isChirpyRed {
+		return l.ChirpyRed
+	}
+	return l.Default
+}
+
+// Normalize returns body in Unicode normalization form C, so visually equal
+// bodies are stored and compared the same way.
+func Normalize(body string) string {
+	return norm.NFC.String(body)
+}
+
+// Check normalizes body and returns it together with what is wrong with it,
+// or an empty problem if it can be posted by a user whose limit is max.
+func Check(body string, max int) (string, string) {
+	body = Normalize(body)
+	if body == "" {
+		return body, "is required"
+	}
+	if strings.TrimFunc(body, isBlank) == "" {
+		return body, "must not be blank"
+	}
+	for _, r := range body {
+		if isDisallowed(r) {
+			return body, fmt.Sprintf("must not contain control character %U", r)
+		}
+	}
+	if GraphemeCount(body) > max {
+		return body, fmt.Sprintf("must be at most %d characters", max)
+	}
+	return body, ""
+}
+
+// isBlank reports whether r is whitespace or an invisible character that
+// renders as nothing on its own.
+func isBlank(r rune) bool {
+	switch r {
+	case 0x200b, 0x2060, 0xfeff:
+		return true
+	}
+	return unicode.IsSpace(r)
+}
+
+// isDisallowed reports whether r is a control character that has no place
+// in a chirp. Newlines and tabs are allowed, and so are format characters
+// like the zero width joiner that emoji sequences need, but not the bidi
+// controls that can make text display differently from how it reads.
+func isDisallowed(r rune) bool {
+	switch {
+	case r == '\n', r == '\t':
+		return false
+	case unicode.In(r, unicode.Cc, unicode.Zl, unicode.Zp):
+		return true
+	case r >= 0x202a && r <= 0x202e, r >= 0x2066 && r <= 0x2069:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package chirptext
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGraphemeCount(t *testing.T) {
+	cases := []struct {
+		name string
+		text string
+		want int
+	}{
+		{"empty", "", 0},
+		{"ascii", "hello", 5},
+		{"precomposed", "caf\u00e9", 4},
+		{"combining mark", "cafe\u0301", 4},
+		{"several marks", "a\u0323\u0301b", 2},
+		{"crlf", "a\r\nb", 3},
+		{"emoji", "\U0001F600\U0001F600", 2},
+		{"skin tone", "\U0001F44D\U0001F3FD", 1},
+		{"variation selector", "\u2764\ufe0f", 1},
+		{"family", "\U0001F468\u200d\U0001F469\u200d\U0001F467\u200d\U0001F466", 1},
+		{"zwj between letters", "a\u200db", 2},
+		{"flag", "\U0001F1FA\U0001F1F8", 1},
+		{"two flags", "\U0001F1FA\U0001F1F8\U0001F1EC\U0001F1E7", 2},
+		{"odd regional indicators", "\U0001F1FA\U0001F1F8\U0001F1EC", 2},
+		{"tag sequence", "\U0001F3F4\U000E0067\U000E0062\U000E0073\U000E0063\U000E0074\U000E007F", 1},
+		{"hangul syllables", "\ud55c\uae00", 2},
+		{"hangul jamo", "\u1112\u1161\u11ab", 1},
+		{"spacing mark", "\u0915\u093f", 1},
+		{"prepend", "\u0600\u0661", 1},
+		{"pictographic without emoji presentation", "\u2763\u200d\u2763", 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := GraphemeCount(c.text); got != c.want {
+				t.Errorf("Expected %d graphemes in %q, got %d", c.want, c.text, got)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		name    string
+		body    string
+		max     int
+		problem string
+	}{
+		{"ok", "hello world", 140, ""},
+		{"newlines and tabs", "line one\n\tline two", 140, ""},
+		{"empty", "", 140, "is required"},
+		{"whitespace", " \n\t\u3000", 140, "must not be blank"},
+		{"zero width space", "\u200b\u200b", 140, "must not be blank"},
+		{"null byte", "hi\x00", 140, "must not contain control character U+0000"},
+		{"escape", "\x1b[31mred", 140, "must not contain control character U+001B"},
+		{"line separator", "a\u2028b", 140, "must not contain control character U+2028"},
+		{"bidi override", "abc\u202edef", 140, "must not contain control character U+202E"},
+		{"at limit", strings.Repeat("a", 140), 140, ""},
+		{"over limit", strings.Repeat("a", 141), 140, "must be at most 140 characters"},
+		{"emoji at limit", strings.Repeat("\U0001F44D\U0001F3FD", 140), 140, ""},
+		{"combining marks at limit", strings.Repeat("e\u0301", 3), 3, ""},
+		{"combining marks over limit", strings.Repeat("x\u0301", 4), 3, "must be at most 3 characters"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, problem := Check(c.body, c.max); problem != c.problem {
+				t.Errorf("Expected problem %q, got %q", c.problem, problem)
+			}
+		})
+	}
+}
+
+func TestCheckNormalizes(t *testing.T) {
+	body, problem := Check("cafe\u0301", 140)
+	if problem != "" {
+		t.Fatalf("Unexpected problem %q", problem)
+	}
+	if body != "caf\u00e9" {
+		t.Errorf("Expected NFC body, got %q", body)
+	}
+}
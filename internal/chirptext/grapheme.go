@@ -0,0 +1,10 @@
+package chirptext
+
+import "github.com/rivo/uniseg"
+
+// GraphemeCount returns the number of user perceived characters in s, the
+// extended grapheme clusters of UAX #29, so that emoji sequences, flags,
+// Hangul syllables and letters with combining marks each count as one.
+func GraphemeCount(s string) int {
+	return uniseg.GraphemeClusterCount(s)
+}
@@ -7,26 +7,46 @@ package database
 
 import (
 	"context"
+	"database/sql"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 const createChirp = `-- name: CreateChirp :one
-INSERT INTO chirps (body, user_id)
+INSERT INTO chirps (body, user_id, original_body, flagged, parent_id, root_id, quote_of_id)
 VALUES (
     $1,
-    $2
+    $2,
+    $3,
+    $4,
+    $5,
+    $6,
+    $7
 )
-RETURNING id, created_at, updated_at, body, user_id
+RETURNING id, created_at, updated_at, body, user_id, original_body, flagged, edited_at, deleted_at, parent_id, root_id, rechirp_of_id, quote_of_id
 `
 
 type CreateChirpParams struct {
-	Body   string
-	UserID uuid.UUID
+	Body         string
+	UserID       uuid.UUID
+	OriginalBody sql.NullString
+	Flagged      bool
+	ParentID     uuid.NullUUID
+	RootID       uuid.NullUUID
+	QuoteOfID    uuid.NullUUID
 }
 
 func (q *Queries) CreateChirp(ctx context.Context, arg CreateChirpParams) (Chirp, error) {
-	row := q.db.QueryRowContext(ctx, createChirp, arg.Body, arg.UserID)
+	row := q.db.QueryRowContext(ctx, createChirp,
+		arg.Body,
+		arg.UserID,
+		arg.OriginalBody,
+		arg.Flagged,
+		arg.ParentID,
+		arg.RootID,
+		arg.QuoteOfID,
+	)
 	var i Chirp
 	err := row.Scan(
 		&i.ID,
@@ -34,20 +54,18 @@ func (q *Queries) CreateChirp(ctx context.Context, arg CreateChirpParams) (Chirp
 		&i.UpdatedAt,
 		&i.Body,
 		&i.UserID,
+		&i.OriginalBody,
+		&i.Flagged,
+		&i.EditedAt,
+		&i.DeletedAt,
+		&i.ParentID,
+		&i.RootID,
+		&i.RechirpOfID,
+		&i.QuoteOfID,
 	)
 	return i, err
 }
 
-const deleteChirpByID = `-- name: DeleteChirpByID :exec
-DELETE FROM chirps
-WHERE id = $1
-`
-
-func (q *Queries) DeleteChirpByID(ctx context.Context, id uuid.UUID) error {
-	_, err := q.db.ExecContext(ctx, deleteChirpByID, id)
-	return err
-}
-
 const deleteChirps = `-- name: DeleteChirps :exec
 DELETE FROM chirps
 `
@@ -58,7 +76,8 @@ func (q *Queries) DeleteChirps(ctx context.Context) error {
 }
 
 const getAllChirps = `-- name: GetAllChirps :many
-SELECT id, created_at, updated_at, body, user_id FROM chirps
+SELECT id, created_at, updated_at, body, user_id, original_body, flagged, edited_at, deleted_at, parent_id, root_id, rechirp_of_id, quote_of_id FROM chirps
+WHERE deleted_at IS NULL
 `
 
 func (q *Queries) GetAllChirps(ctx context.Context) ([]Chirp, error) {
@@ -76,6 +95,14 @@ func (q *Queries) GetAllChirps(ctx context.Context) ([]Chirp, error) {
 			&i.UpdatedAt,
 			&i.Body,
 			&i.UserID,
+			&i.OriginalBody,
+			&i.Flagged,
+			&i.EditedAt,
+			&i.DeletedAt,
+			&i.ParentID,
+			&i.RootID,
+			&i.RechirpOfID,
+			&i.QuoteOfID,
 		); err != nil {
 			return nil, err
 		}
@@ -91,8 +118,15 @@ func (q *Queries) GetAllChirps(ctx context.Context) ([]Chirp, error) {
 }
 
 const getChirpByID = `-- name: GetChirpByID :one
-SELECT id, created_at, updated_at, body, user_id FROM chirps
-WHERE id = $1 LIMIT 1
+SELECT id, created_at, updated_at, body, user_id, original_body, flagged, edited_at, deleted_at, parent_id, root_id, rechirp_of_id, quote_of_id FROM chirps
+WHERE id = $1
+AND deleted_at IS NULL
+AND NOT EXISTS (
+    SELECT 1 FROM users
+    WHERE users.id = chirps.user_id
+    AND users.deleted_at IS NOT NULL
+)
+LIMIT 1
 `
 
 func (q *Queries) GetChirpByID(ctx context.Context, id uuid.UUID) (Chirp, error) {
@@ -104,13 +138,49 @@ func (q *Queries) GetChirpByID(ctx context.Context, id uuid.UUID) (Chirp, error)
 		&i.UpdatedAt,
 		&i.Body,
 		&i.UserID,
+		&i.OriginalBody,
+		&i.Flagged,
+		&i.EditedAt,
+		&i.DeletedAt,
+		&i.ParentID,
+		&i.RootID,
+		&i.RechirpOfID,
+		&i.QuoteOfID,
+	)
+	return i, err
+}
+
+const getChirpByIDWithDeleted = `-- name: GetChirpByIDWithDeleted :one
+SELECT id, created_at, updated_at, body, user_id, original_body, flagged, edited_at, deleted_at, parent_id, root_id, rechirp_of_id, quote_of_id FROM chirps
+WHERE id = $1
+LIMIT 1
+`
+
+func (q *Queries) GetChirpByIDWithDeleted(ctx context.Context, id uuid.UUID) (Chirp, error) {
+	row := q.db.QueryRowContext(ctx, getChirpByIDWithDeleted, id)
+	var i Chirp
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Body,
+		&i.UserID,
+		&i.OriginalBody,
+		&i.Flagged,
+		&i.EditedAt,
+		&i.DeletedAt,
+		&i.ParentID,
+		&i.RootID,
+		&i.RechirpOfID,
+		&i.QuoteOfID,
 	)
 	return i, err
 }
 
 const getChirpsByAuthor = `-- name: GetChirpsByAuthor :many
-SELECT id, created_at, updated_at, body, user_id FROM chirps
+SELECT id, created_at, updated_at, body, user_id, original_body, flagged, edited_at, deleted_at, parent_id, root_id, rechirp_of_id, quote_of_id FROM chirps
 WHERE user_id = $1
+AND deleted_at IS NULL
 ORDER BY created_at ASC
 `
 
@@ -129,6 +199,166 @@ func (q *Queries) GetChirpsByAuthor(ctx context.Context, userID uuid.UUID) ([]Ch
 			&i.UpdatedAt,
 			&i.Body,
 			&i.UserID,
+			&i.OriginalBody,
+			&i.Flagged,
+			&i.EditedAt,
+			&i.DeletedAt,
+			&i.ParentID,
+			&i.RootID,
+			&i.RechirpOfID,
+			&i.QuoteOfID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listChirpsAsc = `-- name: ListChirpsAsc :many
+SELECT id, created_at, updated_at, body, user_id, original_body, flagged, edited_at, deleted_at, parent_id, root_id, rechirp_of_id, quote_of_id FROM chirps
+WHERE ($1::uuid IS NULL OR user_id = $1::uuid)
+AND deleted_at IS NULL
+AND (
+    $2::timestamp IS NULL
+    OR (created_at, id) > ($2::timestamp, $3::uuid)
+)
+AND NOT EXISTS (
+    SELECT 1 FROM users
+    WHERE users.id = chirps.user_id
+    AND users.deleted_at IS NOT NULL
+)
+AND (
+    rechirp_of_id IS NULL
+    OR EXISTS (
+        SELECT 1 FROM chirps AS original
+        JOIN users ON users.id = original.user_id
+        WHERE original.id = chirps.rechirp_of_id
+        AND original.deleted_at IS NULL
+        AND users.deleted_at IS NULL
+    )
+)
+ORDER BY created_at ASC, id ASC
+LIMIT $4
+`
+
+type ListChirpsAscParams struct {
+	AuthorID       uuid.NullUUID
+	AfterCreatedAt sql.NullTime
+	AfterID        uuid.NullUUID
+	PageLimit      int32
+}
+
+func (q *Queries) ListChirpsAsc(ctx context.Context, arg ListChirpsAscParams) ([]Chirp, error) {
+	rows, err := q.db.QueryContext(ctx, listChirpsAsc,
+		arg.AuthorID,
+		arg.AfterCreatedAt,
+		arg.AfterID,
+		arg.PageLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Chirp
+	for rows.Next() {
+		var i Chirp
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Body,
+			&i.UserID,
+			&i.OriginalBody,
+			&i.Flagged,
+			&i.EditedAt,
+			&i.DeletedAt,
+			&i.ParentID,
+			&i.RootID,
+			&i.RechirpOfID,
+			&i.QuoteOfID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listChirpsDesc = `-- name: ListChirpsDesc :many
+SELECT id, created_at, updated_at, body, user_id, original_body, flagged, edited_at, deleted_at, parent_id, root_id, rechirp_of_id, quote_of_id FROM chirps
+WHERE ($1::uuid IS NULL OR user_id = $1::uuid)
+AND deleted_at IS NULL
+AND (
+    $2::timestamp IS NULL
+    OR (created_at, id) < ($2::timestamp, $3::uuid)
+)
+AND NOT EXISTS (
+    SELECT 1 FROM users
+    WHERE users.id = chirps.user_id
+    AND users.deleted_at IS NOT NULL
+)
+AND (
+    rechirp_of_id IS NULL
+    OR EXISTS (
+        SELECT 1 FROM chirps AS original
+        JOIN users ON users.id = original.user_id
+        WHERE original.id = chirps.rechirp_of_id
+        AND original.deleted_at IS NULL
+        AND users.deleted_at IS NULL
+    )
+)
+ORDER BY created_at DESC, id DESC
+LIMIT $4
+`
+
+type ListChirpsDescParams struct {
+	AuthorID       uuid.NullUUID
+	AfterCreatedAt sql.NullTime
+	AfterID        uuid.NullUUID
+	PageLimit      int32
+}
+
+func (q *Queries) ListChirpsDesc(ctx context.Context, arg ListChirpsDescParams) ([]Chirp, error) {
+	rows, err := q.db.QueryContext(ctx, listChirpsDesc,
+		arg.AuthorID,
+		arg.AfterCreatedAt,
+		arg.AfterID,
+		arg.PageLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Chirp
+	for rows.Next() {
+		var i Chirp
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Body,
+			&i.UserID,
+			&i.OriginalBody,
+			&i.Flagged,
+			&i.EditedAt,
+			&i.DeletedAt,
+			&i.ParentID,
+			&i.RootID,
+			&i.RechirpOfID,
+			&i.QuoteOfID,
 		); err != nil {
 			return nil, err
 		}
@@ -142,3 +372,161 @@ func (q *Queries) GetChirpsByAuthor(ctx context.Context, userID uuid.UUID) ([]Ch
 	}
 	return items, nil
 }
+
+const listDeletedChirps = `-- name: ListDeletedChirps :many
+SELECT id, created_at, updated_at, body, user_id, original_body, flagged, edited_at, deleted_at, parent_id, root_id, rechirp_of_id, quote_of_id FROM chirps
+WHERE deleted_at IS NOT NULL
+AND ($1::uuid IS NULL OR user_id = $1::uuid)
+AND (
+    $2::timestamp IS NULL
+    OR (deleted_at, id) < ($2::timestamp, $3::uuid)
+)
+ORDER BY deleted_at DESC, id DESC
+LIMIT $4
+`
+
+type ListDeletedChirpsParams struct {
+	AuthorID        uuid.NullUUID
+	BeforeDeletedAt sql.NullTime
+	BeforeID        uuid.NullUUID
+	PageLimit       int32
+}
+
+func (q *Queries) ListDeletedChirps(ctx context.Context, arg ListDeletedChirpsParams) ([]Chirp, error) {
+	rows, err := q.db.QueryContext(ctx, listDeletedChirps,
+		arg.AuthorID,
+		arg.BeforeDeletedAt,
+		arg.BeforeID,
+		arg.PageLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Chirp
+	for rows.Next() {
+		var i Chirp
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Body,
+			&i.UserID,
+			&i.OriginalBody,
+			&i.Flagged,
+			&i.EditedAt,
+			&i.DeletedAt,
+			&i.ParentID,
+			&i.RootID,
+			&i.RechirpOfID,
+			&i.QuoteOfID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const purgeDeletedChirps = `-- name: PurgeDeletedChirps :execrows
+WITH tombstoned AS (
+    UPDATE chirps
+    SET body = '',
+        original_body = NULL
+    WHERE deleted_at < $1
+    AND body <> ''
+    AND EXISTS (
+        SELECT 1 FROM chirps AS replies
+        WHERE replies.parent_id = chirps.id
+    )
+    RETURNING id
+), revisions AS (
+    DELETE FROM chirp_revisions
+    WHERE chirp_id IN (SELECT id FROM tombstoned)
+)
+DELETE FROM chirps
+WHERE deleted_at < $1
+AND NOT EXISTS (
+    SELECT 1 FROM chirps AS replies
+    WHERE replies.parent_id = chirps.id
+)
+`
+
+func (q *Queries) PurgeDeletedChirps(ctx context.Context, deletedBefore time.Time) (int64, error) {
+	result, err := q.db.ExecContext(ctx, purgeDeletedChirps, deletedBefore)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const restoreChirpByID = `-- name: RestoreChirpByID :one
+UPDATE chirps
+SET deleted_at = NULL
+WHERE id = $1
+AND user_id = $2
+AND deleted_at > $3::timestamp
+RETURNING id, created_at, updated_at, body, user_id, original_body, flagged, edited_at, deleted_at, parent_id, root_id, rechirp_of_id, quote_of_id
+`
+
+type RestoreChirpByIDParams struct {
+	ID           uuid.UUID
+	UserID       uuid.UUID
+	DeletedAfter time.Time
+}
+
+func (q *Queries) RestoreChirpByID(ctx context.Context, arg RestoreChirpByIDParams) (Chirp, error) {
+	row := q.db.QueryRowContext(ctx, restoreChirpByID, arg.ID, arg.UserID, arg.DeletedAfter)
+	var i Chirp
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Body,
+		&i.UserID,
+		&i.OriginalBody,
+		&i.Flagged,
+		&i.EditedAt,
+		&i.DeletedAt,
+		&i.ParentID,
+		&i.RootID,
+		&i.RechirpOfID,
+		&i.QuoteOfID,
+	)
+	return i, err
+}
+
+const softDeleteChirpByID = `-- name: SoftDeleteChirpByID :one
+UPDATE chirps
+SET deleted_at = NOW()
+WHERE id = $1
+AND deleted_at IS NULL
+RETURNING id, created_at, updated_at, body, user_id, original_body, flagged, edited_at, deleted_at, parent_id, root_id, rechirp_of_id, quote_of_id
+`
+
+func (q *Queries) SoftDeleteChirpByID(ctx context.Context, id uuid.UUID) (Chirp, error) {
+	row := q.db.QueryRowContext(ctx, softDeleteChirpByID, id)
+	var i Chirp
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Body,
+		&i.UserID,
+		&i.OriginalBody,
+		&i.Flagged,
+		&i.EditedAt,
+		&i.DeletedAt,
+		&i.ParentID,
+		&i.RootID,
+		&i.RechirpOfID,
+		&i.QuoteOfID,
+	)
+	return i, err
+}
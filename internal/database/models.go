@@ -6,33 +6,139 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+type ApiKey struct {
+	ID         uuid.UUID
+	CreatedAt  time.Time
+	UserID     uuid.UUID
+	Name       string
+	Prefix     string
+	KeyHash    string
+	Scopes     []string
+	LastUsedAt sql.NullTime
+	RevokedAt  sql.NullTime
+}
+
+type AuditEvent struct {
+	ID        uuid.UUID
+	CreatedAt time.Time
+	UserID    uuid.NullUUID
+	EventType string
+	Details   json.RawMessage
+}
+
+type ChirpRevision struct {
+	ID           uuid.UUID
+	CreatedAt    time.Time
+	ChirpID      uuid.UUID
+	Body         string
+	OriginalBody sql.NullString
+	Flagged      bool
+	WrittenAt    time.Time
+}
+
 type Chirp struct {
+	ID           uuid.UUID
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	Body         string
+	UserID       uuid.NullUUID
+	OriginalBody sql.NullString
+	Flagged      bool
+	EditedAt     sql.NullTime
+	DeletedAt    sql.NullTime
+	ParentID     uuid.NullUUID
+	RootID       uuid.NullUUID
+	RechirpOfID  uuid.NullUUID
+	QuoteOfID    uuid.NullUUID
+}
+
+type LoginThrottle struct {
+	ThrottleKey   string
+	Failures      int32
+	LastFailureAt time.Time
+	LockedUntil   sql.NullTime
+}
+
+type ModerationRule struct {
+	ID        uuid.UUID
+	CreatedAt time.Time
+	Word      string
+	Action    string
+}
+
+type OidcLoginState struct {
+	StateHash    string
+	CreatedAt    time.Time
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    time.Time
+}
+
+type PasswordResetToken struct {
 	ID        uuid.UUID
 	CreatedAt time.Time
-	UpdatedAt time.Time
-	Body      string
+	TokenHash string
 	UserID    uuid.UUID
+	ExpiresAt time.Time
+	UsedAt    sql.NullTime
+}
+
+type RecoveryCode struct {
+	ID        uuid.UUID
+	CreatedAt time.Time
+	UserID    uuid.UUID
+	CodeHash  string
+	UsedAt    sql.NullTime
 }
 
 type RefreshToken struct {
-	Token     string
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	UserID           uuid.UUID
+	ExpiresAt        time.Time
+	RevokedAt        sql.NullTime
+	FamilyID         uuid.UUID
+	ID               uuid.UUID
+	TokenHash        string
+	ParentID         uuid.NullUUID
+	SessionStartedAt time.Time
+	LastUsedAt       time.Time
+	UserAgent        string
+	IpAddress        string
+}
+
+type UserIdentity struct {
+	ID        uuid.UUID
 	CreatedAt time.Time
-	UpdatedAt time.Time
 	UserID    uuid.UUID
-	ExpiresAt time.Time
-	RevokedAt sql.NullTime
+	Provider  string
+	Subject   string
+	Email     string
+}
+
+type UserTotp struct {
+	UserID       uuid.UUID
+	CreatedAt    time.Time
+	Secret       string
+	ConfirmedAt  sql.NullTime
+	LastUsedStep int64
 }
 
 type User struct {
-	ID             uuid.UUID
-	CreatedAt      time.Time
-	UpdatedAt      time.Time
-	Email          string
-	HashedPassword string
-	IsChirpyRed    bool
+	ID              uuid.UUID
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	Email           string
+	HashedPassword  string
+	IsChirpyRed     bool
+	EmailVerifiedAt sql.NullTime
+	Role            string
+	DeletedAt       sql.NullTime
 }
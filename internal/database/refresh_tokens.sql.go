@@ -13,31 +13,57 @@ import (
 )
 
 const createRefreshToken = `-- name: CreateRefreshToken :one
-INSERT INTO refresh_tokens (token, user_id, expires_at)
+INSERT INTO refresh_tokens (token_hash, user_id, expires_at, family_id, parent_id, session_started_at, user_agent, ip_address)
 VALUES (
     $1,
     $2,
-    $3
+    $3,
+    $4,
+    $5,
+    $6,
+    $7,
+    $8
 )
-RETURNING token, created_at, updated_at, user_id, expires_at, revoked_at
+RETURNING created_at, updated_at, user_id, expires_at, revoked_at, family_id, id, token_hash, parent_id, session_started_at, last_used_at, user_agent, ip_address
 `
 
 type CreateRefreshTokenParams struct {
-	Token     string
-	UserID    uuid.UUID
-	ExpiresAt time.Time
+	TokenHash        string
+	UserID           uuid.UUID
+	ExpiresAt        time.Time
+	FamilyID         uuid.UUID
+	ParentID         uuid.NullUUID
+	SessionStartedAt time.Time
+	UserAgent        string
+	IpAddress        string
 }
 
 func (q *Queries) CreateRefreshToken(ctx context.Context, arg CreateRefreshTokenParams) (RefreshToken, error) {
-	row := q.db.QueryRowContext(ctx, createRefreshToken, arg.Token, arg.UserID, arg.ExpiresAt)
+	row := q.db.QueryRowContext(ctx, createRefreshToken,
+		arg.TokenHash,
+		arg.UserID,
+		arg.ExpiresAt,
+		arg.FamilyID,
+		arg.ParentID,
+		arg.SessionStartedAt,
+		arg.UserAgent,
+		arg.IpAddress,
+	)
 	var i RefreshToken
 	err := row.Scan(
-		&i.Token,
 		&i.CreatedAt,
 		&i.UpdatedAt,
 		&i.UserID,
 		&i.ExpiresAt,
 		&i.RevokedAt,
+		&i.FamilyID,
+		&i.ID,
+		&i.TokenHash,
+		&i.ParentID,
+		&i.SessionStartedAt,
+		&i.LastUsedAt,
+		&i.UserAgent,
+		&i.IpAddress,
 	)
 	return i, err
 }
@@ -51,16 +77,63 @@ func (q *Queries) DeleteRefreshTokens(ctx context.Context) error {
 	return err
 }
 
+const getRefreshTokenByHash = `-- name: GetRefreshTokenByHash :one
+SELECT created_at, updated_at, user_id, expires_at, revoked_at, family_id, id, token_hash, parent_id, session_started_at, last_used_at, user_agent, ip_address FROM refresh_tokens
+WHERE token_hash = $1
+`
+
+func (q *Queries) GetRefreshTokenByHash(ctx context.Context, tokenHash string) (RefreshToken, error) {
+	row := q.db.QueryRowContext(ctx, getRefreshTokenByHash, tokenHash)
+	var i RefreshToken
+	err := row.Scan(
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.UserID,
+		&i.ExpiresAt,
+		&i.RevokedAt,
+		&i.FamilyID,
+		&i.ID,
+		&i.TokenHash,
+		&i.ParentID,
+		&i.SessionStartedAt,
+		&i.LastUsedAt,
+		&i.UserAgent,
+		&i.IpAddress,
+	)
+	return i, err
+}
+
+const getSessionStartedAt = `-- name: GetSessionStartedAt :one
+SELECT session_started_at FROM refresh_tokens
+WHERE family_id = $1
+AND user_id = $2
+AND revoked_at IS NULL
+AND expires_at > NOW()
+LIMIT 1
+`
+
+type GetSessionStartedAtParams struct {
+	FamilyID uuid.UUID
+	UserID   uuid.UUID
+}
+
+func (q *Queries) GetSessionStartedAt(ctx context.Context, arg GetSessionStartedAtParams) (time.Time, error) {
+	row := q.db.QueryRowContext(ctx, getSessionStartedAt, arg.FamilyID, arg.UserID)
+	var session_started_at time.Time
+	err := row.Scan(&session_started_at)
+	return session_started_at, err
+}
+
 const getUserFromRefreshToken = `-- name: GetUserFromRefreshToken :one
-SELECT users.id, users.created_at, users.updated_at, users.email, users.hashed_password, users.is_chirpy_red FROM users
+SELECT users.id, users.created_at, users.updated_at, users.email, users.hashed_password, users.is_chirpy_red, users.email_verified_at, users.role, users.deleted_at FROM users
 JOIN refresh_tokens ON users.id = refresh_tokens.user_id
-WHERE refresh_tokens.token = $1
+WHERE refresh_tokens.token_hash = $1
 AND refresh_tokens.revoked_at IS NULL
 AND refresh_tokens.expires_at > NOW()
 `
 
-func (q *Queries) GetUserFromRefreshToken(ctx context.Context, token string) (User, error) {
-	row := q.db.QueryRowContext(ctx, getUserFromRefreshToken, token)
+func (q *Queries) GetUserFromRefreshToken(ctx context.Context, tokenHash string) (User, error) {
+	row := q.db.QueryRowContext(ctx, getUserFromRefreshToken, tokenHash)
 	var i User
 	err := row.Scan(
 		&i.ID,
@@ -69,18 +142,163 @@ func (q *Queries) GetUserFromRefreshToken(ctx context.Context, token string) (Us
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
+		&i.EmailVerifiedAt,
+		&i.Role,
+		&i.DeletedAt,
 	)
 	return i, err
 }
 
+const hasChildRefreshToken = `-- name: HasChildRefreshToken :one
+SELECT EXISTS (
+    SELECT 1 FROM refresh_tokens
+    WHERE parent_id = $1
+)
+`
+
+func (q *Queries) HasChildRefreshToken(ctx context.Context, parentID uuid.NullUUID) (bool, error) {
+	row := q.db.QueryRowContext(ctx, hasChildRefreshToken, parentID)
+	var exists bool
+	err := row.Scan(&exists)
+	return exists, err
+}
+
+const listActiveSessions = `-- name: ListActiveSessions :many
+SELECT created_at, updated_at, user_id, expires_at, revoked_at, family_id, id, token_hash, parent_id, session_started_at, last_used_at, user_agent, ip_address FROM refresh_tokens
+WHERE user_id = $1
+AND revoked_at IS NULL
+AND expires_at > NOW()
+ORDER BY last_used_at DESC
+`
+
+func (q *Queries) ListActiveSessions(ctx context.Context, userID uuid.UUID) ([]RefreshToken, error) {
+	rows, err := q.db.QueryContext(ctx, listActiveSessions, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []RefreshToken
+	for rows.Next() {
+		var i RefreshToken
+		if err := rows.Scan(
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.UserID,
+			&i.ExpiresAt,
+			&i.RevokedAt,
+			&i.FamilyID,
+			&i.ID,
+			&i.TokenHash,
+			&i.ParentID,
+			&i.SessionStartedAt,
+			&i.LastUsedAt,
+			&i.UserAgent,
+			&i.IpAddress,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const revokeActiveRefreshToken = `-- name: RevokeActiveRefreshToken :execrows
+UPDATE refresh_tokens
+SET revoked_at = NOW(),
+    updated_at = NOW()
+WHERE id = $1
+AND revoked_at IS NULL
+`
+
+func (q *Queries) RevokeActiveRefreshToken(ctx context.Context, id uuid.UUID) (int64, error) {
+	result, err := q.db.ExecContext(ctx, revokeActiveRefreshToken, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const revokeAllSessions = `-- name: RevokeAllSessions :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(),
+    updated_at = NOW()
+WHERE user_id = $1
+AND revoked_at IS NULL
+`
+
+func (q *Queries) RevokeAllSessions(ctx context.Context, userID uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, revokeAllSessions, userID)
+	return err
+}
+
+const revokeOtherSessions = `-- name: RevokeOtherSessions :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(),
+    updated_at = NOW()
+WHERE user_id = $1
+AND family_id <> $2
+AND revoked_at IS NULL
+`
+
+type RevokeOtherSessionsParams struct {
+	UserID   uuid.UUID
+	FamilyID uuid.UUID
+}
+
+func (q *Queries) RevokeOtherSessions(ctx context.Context, arg RevokeOtherSessionsParams) error {
+	_, err := q.db.ExecContext(ctx, revokeOtherSessions, arg.UserID, arg.FamilyID)
+	return err
+}
+
 const revokeRefreshToken = `-- name: RevokeRefreshToken :exec
 UPDATE refresh_tokens
 SET revoked_at = NOW(),
     updated_at = NOW()
-WHERE token = $1
+WHERE token_hash = $1
+`
+
+func (q *Queries) RevokeRefreshToken(ctx context.Context, tokenHash string) error {
+	_, err := q.db.ExecContext(ctx, revokeRefreshToken, tokenHash)
+	return err
+}
+
+const revokeRefreshTokenFamily = `-- name: RevokeRefreshTokenFamily :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(),
+    updated_at = NOW()
+WHERE family_id = $1
+AND revoked_at IS NULL
 `
 
-func (q *Queries) RevokeRefreshToken(ctx context.Context, token string) error {
-	_, err := q.db.ExecContext(ctx, revokeRefreshToken, token)
+func (q *Queries) RevokeRefreshTokenFamily(ctx context.Context, familyID uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, revokeRefreshTokenFamily, familyID)
 	return err
 }
+
+const revokeSession = `-- name: RevokeSession :execrows
+UPDATE refresh_tokens
+SET revoked_at = NOW(),
+    updated_at = NOW()
+WHERE family_id = $1
+AND user_id = $2
+AND revoked_at IS NULL
+`
+
+type RevokeSessionParams struct {
+	FamilyID uuid.UUID
+	UserID   uuid.UUID
+}
+
+func (q *Queries) RevokeSession(ctx context.Context, arg RevokeSessionParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, revokeSession, arg.FamilyID, arg.UserID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
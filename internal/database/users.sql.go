@@ -7,17 +7,37 @@ package database
 
 import (
 	"context"
+	"database/sql"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+const bootstrapAdmin = `-- name: BootstrapAdmin :execrows
+UPDATE users
+SET role = 'admin', updated_at = NOW()
+WHERE id = $1
+AND NOT EXISTS (
+    SELECT 1 FROM users
+    WHERE role = 'admin'
+)
+`
+
+func (q *Queries) BootstrapAdmin(ctx context.Context, id uuid.UUID) (int64, error) {
+	result, err := q.db.ExecContext(ctx, bootstrapAdmin, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 const createUser = `-- name: CreateUser :one
 INSERT INTO users (email, hashed_password)
 VALUES (
     $1,
     $2
 )
-RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red, email_verified_at, role, deleted_at
 `
 
 type CreateUserParams struct {
@@ -35,6 +55,42 @@ func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (User, e
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
+		&i.EmailVerifiedAt,
+		&i.Role,
+		&i.DeletedAt,
+	)
+	return i, err
+}
+
+const createUserWithoutPassword = `-- name: CreateUserWithoutPassword :one
+INSERT INTO users (email, hashed_password, email_verified_at)
+VALUES (
+    $1,
+    $2,
+    $3
+)
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red, email_verified_at, role, deleted_at
+`
+
+type CreateUserWithoutPasswordParams struct {
+	Email           string
+	HashedPassword  string
+	EmailVerifiedAt sql.NullTime
+}
+
+func (q *Queries) CreateUserWithoutPassword(ctx context.Context, arg CreateUserWithoutPasswordParams) (User, error) {
+	row := q.db.QueryRowContext(ctx, createUserWithoutPassword, arg.Email, arg.HashedPassword, arg.EmailVerifiedAt)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Email,
+		&i.HashedPassword,
+		&i.IsChirpyRed,
+		&i.EmailVerifiedAt,
+		&i.Role,
+		&i.DeletedAt,
 	)
 	return i, err
 }
@@ -49,7 +105,7 @@ func (q *Queries) DeleteUsers(ctx context.Context) error {
 }
 
 const getUserByEmail = `-- name: GetUserByEmail :one
-SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red FROM users
+SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red, email_verified_at, role, deleted_at FROM users
 WHERE email = $1
 `
 
@@ -63,27 +119,217 @@ func (q *Queries) GetUserByEmail(ctx context.Context, email string) (User, error
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
+		&i.EmailVerifiedAt,
+		&i.Role,
+		&i.DeletedAt,
 	)
 	return i, err
 }
 
-const updateUserByID = `-- name: UpdateUserByID :one
+const getUserByID = `-- name: GetUserByID :one
+SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red, email_verified_at, role, deleted_at FROM users
+WHERE id = $1
+`
+
+func (q *Queries) GetUserByID(ctx context.Context, id uuid.UUID) (User, error) {
+	row := q.db.QueryRowContext(ctx, getUserByID, id)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Email,
+		&i.HashedPassword,
+		&i.IsChirpyRed,
+		&i.EmailVerifiedAt,
+		&i.Role,
+		&i.DeletedAt,
+	)
+	return i, err
+}
+
+const getUserDeletedAt = `-- name: GetUserDeletedAt :one
+SELECT deleted_at FROM users
+WHERE id = $1
+`
+
+func (q *Queries) GetUserDeletedAt(ctx context.Context, id uuid.UUID) (sql.NullTime, error) {
+	row := q.db.QueryRowContext(ctx, getUserDeletedAt, id)
+	var deleted_at sql.NullTime
+	err := row.Scan(&deleted_at)
+	return deleted_at, err
+}
+
+const getUserRole = `-- name: GetUserRole :one
+SELECT role FROM users
+WHERE id = $1
+AND deleted_at IS NULL
+`
+
+func (q *Queries) GetUserRole(ctx context.Context, id uuid.UUID) (string, error) {
+	row := q.db.QueryRowContext(ctx, getUserRole, id)
+	var role string
+	err := row.Scan(&role)
+	return role, err
+}
+
+const patchUserByID = `-- name: PatchUserByID :one
 UPDATE users
-SET email = $2,
-    hashed_password = $3,
+SET email = COALESCE($1, email),
+    hashed_password = COALESCE($2, hashed_password),
+    email_verified_at = CASE
+        WHEN $1 IS NULL OR $1 = email THEN email_verified_at
+    END,
+    updated_at = NOW()
+WHERE id = $3
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red, email_verified_at, role, deleted_at
+`
+
+type PatchUserByIDParams struct {
+	Email          sql.NullString
+	HashedPassword sql.NullString
+	ID             uuid.UUID
+}
+
+func (q *Queries) PatchUserByID(ctx context.Context, arg PatchUserByIDParams) (User, error) {
+	row := q.db.QueryRowContext(ctx, patchUserByID, arg.Email, arg.HashedPassword, arg.ID)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Email,
+		&i.HashedPassword,
+		&i.IsChirpyRed,
+		&i.EmailVerifiedAt,
+		&i.Role,
+		&i.DeletedAt,
+	)
+	return i, err
+}
+
+const purgeDeletedUsers = `-- name: PurgeDeletedUsers :execrows
+WITH purged AS (
+    SELECT id FROM users
+    WHERE deleted_at < $1::timestamp
+), tombstoned AS (
+    UPDATE chirps
+    SET body = '',
+        original_body = NULL,
+        deleted_at = COALESCE(deleted_at, NOW())
+    WHERE user_id IN (SELECT id FROM purged)
+    AND EXISTS (
+        SELECT 1 FROM chirps AS replies
+        WHERE replies.parent_id = chirps.id
+    )
+    RETURNING id
+), revisions AS (
+    DELETE FROM chirp_revisions
+    WHERE chirp_id IN (SELECT id FROM tombstoned)
+), chirps_deleted AS (
+    DELETE FROM chirps
+    WHERE user_id IN (SELECT id FROM purged)
+    AND NOT EXISTS (
+        SELECT 1 FROM chirps AS replies
+        WHERE replies.parent_id = chirps.id
+    )
+)
+DELETE FROM users
+WHERE id IN (SELECT id FROM purged)
+`
+
+func (q *Queries) PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) (int64, error) {
+	result, err := q.db.ExecContext(ctx, purgeDeletedUsers, deletedBefore)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const restoreUser = `-- name: RestoreUser :execrows
+UPDATE users
+SET deleted_at = NULL, updated_at = NOW()
+WHERE id = $1
+AND deleted_at IS NOT NULL
+`
+
+func (q *Queries) RestoreUser(ctx context.Context, id uuid.UUID) (int64, error) {
+	result, err := q.db.ExecContext(ctx, restoreUser, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const setUserRole = `-- name: SetUserRole :one
+UPDATE users
+SET role = $2, updated_at = NOW()
+WHERE id = $1
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red, email_verified_at, role, deleted_at
+`
+
+type SetUserRoleParams struct {
+	ID   uuid.UUID
+	Role string
+}
+
+func (q *Queries) SetUserRole(ctx context.Context, arg SetUserRoleParams) (User, error) {
+	row := q.db.QueryRowContext(ctx, setUserRole, arg.ID, arg.Role)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Email,
+		&i.HashedPassword,
+		&i.IsChirpyRed,
+		&i.EmailVerifiedAt,
+		&i.Role,
+		&i.DeletedAt,
+	)
+	return i, err
+}
+
+const softDeleteUser = `-- name: SoftDeleteUser :one
+UPDATE users
+SET deleted_at = NOW(), updated_at = NOW()
+WHERE id = $1
+AND deleted_at IS NULL
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red, email_verified_at, role, deleted_at
+`
+
+func (q *Queries) SoftDeleteUser(ctx context.Context, id uuid.UUID) (User, error) {
+	row := q.db.QueryRowContext(ctx, softDeleteUser, id)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Email,
+		&i.HashedPassword,
+		&i.IsChirpyRed,
+		&i.EmailVerifiedAt,
+		&i.Role,
+		&i.DeletedAt,
+	)
+	return i, err
+}
+
+const updateUserPassword = `-- name: UpdateUserPassword :one
+UPDATE users
+SET hashed_password = $2,
     updated_at = NOW()
 WHERE id = $1
-RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red, email_verified_at, role, deleted_at
 `
 
-type UpdateUserByIDParams struct {
+type UpdateUserPasswordParams struct {
 	ID             uuid.UUID
-	Email          string
 	HashedPassword string
 }
 
-func (q *Queries) UpdateUserByID(ctx context.Context, arg UpdateUserByIDParams) (User, error) {
-	row := q.db.QueryRowContext(ctx, updateUserByID, arg.ID, arg.Email, arg.HashedPassword)
+func (q *Queries) UpdateUserPassword(ctx context.Context, arg UpdateUserPasswordParams) (User, error) {
+	row := q.db.QueryRowContext(ctx, updateUserPassword, arg.ID, arg.HashedPassword)
 	var i User
 	err := row.Scan(
 		&i.ID,
@@ -92,16 +338,35 @@ func (q *Queries) UpdateUserByID(ctx context.Context, arg UpdateUserByIDParams)
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
+		&i.EmailVerifiedAt,
+		&i.Role,
+		&i.DeletedAt,
 	)
 	return i, err
 }
 
+const updateUserPasswordHash = `-- name: UpdateUserPasswordHash :exec
+UPDATE users
+SET hashed_password = $2
+WHERE id = $1
+`
+
+type UpdateUserPasswordHashParams struct {
+	ID             uuid.UUID
+	HashedPassword string
+}
+
+func (q *Queries) UpdateUserPasswordHash(ctx context.Context, arg UpdateUserPasswordHashParams) error {
+	_, err := q.db.ExecContext(ctx, updateUserPasswordHash, arg.ID, arg.HashedPassword)
+	return err
+}
+
 const upgradeUserChirpyRedByID = `-- name: UpgradeUserChirpyRedByID :one
 UPDATE users
 SET is_chirpy_red = $2,
     updated_at = NOW()
 WHERE id = $1
-RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red, email_verified_at, role, deleted_at
 `
 
 type UpgradeUserChirpyRedByIDParams struct {
@@ -119,6 +384,31 @@ func (q *Queries) UpgradeUserChirpyRedByID(ctx context.Context, arg UpgradeUserC
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
+		&i.EmailVerifiedAt,
+		&i.Role,
+		&i.DeletedAt,
 	)
 	return i, err
 }
+
+const verifyUserEmail = `-- name: VerifyUserEmail :execrows
+UPDATE users
+SET email_verified_at = NOW(),
+    updated_at = NOW()
+WHERE id = $1
+AND email = $2
+AND email_verified_at IS NULL
+`
+
+type VerifyUserEmailParams struct {
+	ID    uuid.UUID
+	Email string
+}
+
+func (q *Queries) VerifyUserEmail(ctx context.Context, arg VerifyUserEmailParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, verifyUserEmail, arg.ID, arg.Email)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
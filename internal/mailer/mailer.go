@@ -0,0 +1,83 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional email such as verification links. Real
+// providers plug in behind this interface, the implementations in this
+// package are meant for local development and tests.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// LogMailer writes every message to the standard logger instead of
+// delivering it.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, msg Message) error {
+	log.Printf("Mail to %s: %s\n%s\n", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// FileMailer appends every message to a file, which makes it easy to pick
+// tokens out of sent mail during local development.
+type FileMailer struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func NewFileMailer(path string) *FileMailer {
+	return &FileMailer{Path: path}
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(m.Path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(m.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n",
+		time.Now().UTC().Format(time.RFC1123Z), msg.To, msg.Subject, strings.TrimRight(msg.Body, "\n"))
+	return err
+}
+
+// Recorder keeps sent messages in memory so tests can inspect them.
+type Recorder struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (r *Recorder) Send(ctx context.Context, msg Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, msg)
+	return nil
+}
+
+func (r *Recorder) Messages() []Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Message(nil), r.messages...)
+}
@@ -0,0 +1,47 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail", "outbox.txt")
+	m := NewFileMailer(path)
+
+	messages := []Message{
+		{To: "a@b.c", Subject: "first", Body: "token one\n"},
+		{To: "d@e.f", Subject: "second", Body: "token two"},
+	}
+	for _, msg := range messages {
+		if err := m.Send(context.Background(), msg); err != nil {
+			t.Fatalf("Error sending message: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading outbox: %v", err)
+	}
+	out := string(data)
+	for _, want := range []string{"To: a@b.c\nSubject: first\n\ntoken one\n", "To: d@e.f\nSubject: second\n\ntoken two\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected outbox to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	r := &Recorder{}
+	if err := r.Send(context.Background(), Message{To: "a@b.c"}); err != nil {
+		t.Fatalf("Error sending message: %v", err)
+	}
+
+	got := r.Messages()
+	if len(got) != 1 || got[0].To != "a@b.c" {
+		t.Errorf("Expected one message to a@b.c, got %v", got)
+	}
+}
@@ -0,0 +1,178 @@
+package moderation
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+type Action string
+
+const (
+	ActionMask   Action = "mask"
+	ActionReject Action = "reject"
+	ActionFlag   Action = "flag"
+)
+
+const maskText = "****"
+
+type Rule struct {
+	Word   string
+	Action Action
+}
+
+// DefaultRules is the word list used when no rules are configured.
+var DefaultRules = []Rule{
+	{Word: "kerfuffle", Action: ActionMask},
+	{Word: "sharbert", Action: ActionMask},
+	{Word: "fornax", Action: ActionMask},
+}
+
+// Result is the outcome of moderating a chirp body. Body is the text that
+// should be stored, Original is the text as submitted by the user.
+type Result struct {
+	Body     string
+	Original string
+	Flagged  bool
+	Matches  []string
+}
+
+func (r Result) Changed() bool {
+	return r.Body != r.Original
+}
+
+// RejectedError is returned when a body matches a rule with ActionReject.
+type RejectedError struct {
+	Word string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("body contains disallowed word %q", e.Word)
+}
+
+// Moderator is a single moderation stage in the chirp write path.
+type Moderator interface {
+	Moderate(body string) (Result, error)
+}
+
+// WordFilter matches whole words case-insensitively, ignoring the
+// punctuation around them, and applies the action of the matching rule.
+type WordFilter struct {
+	rules map[string]Action
+}
+
+func NewWordFilter(rules []Rule) (*WordFilter, error) {
+	filter := &WordFilter{rules: make(map[string]Action, len(rules))}
+	for _, rule := range rules {
+		word := strings.ToLower(strings.TrimSpace(rule.Word))
+		if word == "" {
+			return nil, fmt.Errorf("empty word in moderation rule")
+		}
+		// Bodies are split into words at every non-word rune, so a rule
+		// word containing one could never match.
+		if strings.IndexFunc(word, func(r rune) bool { return !isWordRune(r) }) >= 0 {
+			return nil, fmt.Errorf("moderation rule %q is not a single word", rule.Word)
+		}
+		if _, err := ParseAction(string(rule.Action)); err != nil {
+			return nil, err
+		}
+		filter.rules[word] = rule.Action
+	}
+	return filter, nil
+}
+
+func (f *WordFilter) Moderate(body string) (Result, error) {
+	res := Result{Original: body}
+
+	var sb strings.Builder
+	runes := []rune(body)
+	for i := 0; i < len(runes); {
+		if !isWordRune(runes[i]) {
+			sb.WriteRune(runes[i])
+			i++
+			continue
+		}
+
+		j := i
+		for j < len(runes) && isWordRune(runes[j]) {
+			j++
+		}
+		word := string(runes[i:j])
+		i = j
+
+		action, ok := f.rules[strings.ToLower(word)]
+		if !ok {
+			sb.WriteString(word)
+			continue
+		}
+
+		res.Matches = append(res.Matches, word)
+		switch action {
+		case ActionReject:
+			return Result{}, &RejectedError{Word: word}
+		case ActionFlag:
+			res.Flagged = true
+			sb.WriteString(word)
+		default:
+			sb.WriteString(maskText)
+		}
+	}
+
+	res.Body = sb.String()
+	return res, nil
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func ParseAction(s string) (Action, error) {
+	switch Action(s) {
+	case ActionMask, ActionReject, ActionFlag:
+		return Action(s), nil
+	}
+	return "", fmt.Errorf("unknown moderation action %q", s)
+}
+
+// LoadFile reads rules from a file with one "word [action]" pair per line.
+// The action defaults to mask, blank lines and lines starting with # are
+// skipped.
+func LoadFile(path string) ([]Rule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules []Rule
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"word [action]\"", path, lineNum)
+		}
+		rule := Rule{Word: fields[0], Action: ActionMask}
+		if len(fields) == 2 {
+			action, err := ParseAction(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+			}
+			rule.Action = action
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
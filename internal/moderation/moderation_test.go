@@ -0,0 +1,136 @@
+package moderation
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWordFilterMask(t *testing.T) {
+	filter, err := NewWordFilter(DefaultRules)
+	if err != nil {
+		t.Fatalf("Error creating filter: %v", err)
+	}
+
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{"I had something interesting for breakfast", "I had something interesting for breakfast"},
+		{"This is a kerfuffle opinion I need to share", "This is a **** opinion I need to share"},
+		{"Fornax!", "****!"},
+		{"What a KERFUFFLE.", "What a ****."},
+		{"(sharbert), fornax?", "(****), ****?"},
+		{"sharbert's fault", "****'s fault"},
+		{"kerfuffles are fine", "kerfuffles are fine"},
+		{"fornax\nkerfuffle", "****\n****"},
+		{"double  space fornax", "double  space ****"},
+	}
+
+	for _, c := range cases {
+		res, err := filter.Moderate(c.input)
+		if err != nil {
+			t.Fatalf("Error moderating %q: %v", c.input, err)
+		}
+		if res.Body != c.expected {
+			t.Errorf("Expected %q for %q, got %q", c.expected, c.input, res.Body)
+		}
+		if res.Original != c.input {
+			t.Errorf("Expected original %q, got %q", c.input, res.Original)
+		}
+	}
+}
+
+func TestWordFilterReject(t *testing.T) {
+	filter, err := NewWordFilter([]Rule{
+		{Word: "fornax", Action: ActionMask},
+		{Word: "Spam", Action: ActionReject},
+	})
+	if err != nil {
+		t.Fatalf("Error creating filter: %v", err)
+	}
+
+	_, err = filter.Moderate("buy cheap SPAM, fornax")
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) {
+		t.Fatalf("Expected RejectedError, got %v", err)
+	}
+	if rejected.Word != "SPAM" {
+		t.Errorf("Expected rejected word SPAM, got %q", rejected.Word)
+	}
+}
+
+func TestWordFilterFlag(t *testing.T) {
+	filter, err := NewWordFilter([]Rule{
+		{Word: "fornax", Action: ActionMask},
+		{Word: "suspicious", Action: ActionFlag},
+	})
+	if err != nil {
+		t.Fatalf("Error creating filter: %v", err)
+	}
+
+	res, err := filter.Moderate("Suspicious fornax")
+	if err != nil {
+		t.Fatalf("Error moderating: %v", err)
+	}
+	if !res.Flagged {
+		t.Errorf("Expected result to be flagged")
+	}
+	if res.Body != "Suspicious ****" {
+		t.Errorf("Expected flagged word to be kept, got %q", res.Body)
+	}
+	if !res.Changed() {
+		t.Errorf("Expected result to be changed")
+	}
+}
+
+func TestNewWordFilterUnknownAction(t *testing.T) {
+	_, err := NewWordFilter([]Rule{{Word: "fornax", Action: "delete"}})
+	if err == nil {
+		t.Error("Expected error for unknown action, got nil")
+	}
+}
+
+func TestNewWordFilterNonWordRune(t *testing.T) {
+	for _, word := range []string{"two words", "dash-word", "it's"} {
+		_, err := NewWordFilter([]Rule{{Word: word, Action: ActionMask}})
+		if err == nil {
+			t.Errorf("Expected an error for rule word %q", word)
+		}
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	content := "# comment\nkerfuffle\n\nspam reject\nsuspicious flag\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Error writing rules file: %v", err)
+	}
+
+	rules, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("Error loading rules: %v", err)
+	}
+
+	expected := []Rule{
+		{Word: "kerfuffle", Action: ActionMask},
+		{Word: "spam", Action: ActionReject},
+		{Word: "suspicious", Action: ActionFlag},
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("Expected %d rules, got %d", len(expected), len(rules))
+	}
+	for i := range expected {
+		if rules[i] != expected[i] {
+			t.Errorf("Expected rule %v, got %v", expected[i], rules[i])
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("spam nuke\n"), 0o600); err != nil {
+		t.Fatalf("Error writing rules file: %v", err)
+	}
+	if _, err := LoadFile(path); err == nil {
+		t.Error("Expected error for unknown action, got nil")
+	}
+}
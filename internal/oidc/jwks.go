@@ -0,0 +1,145 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// minKeyRefresh stops a stream of tokens with unknown key ids from making
+// us fetch the JWKS on every request.
+const minKeyRefresh = time.Minute
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// keyCache holds the provider's signing keys and refetches them when a
+// token names a key it hasn't seen, which is how providers rotate keys.
+type keyCache struct {
+	client *http.Client
+	uri    string
+
+	mu        sync.Mutex
+	keys      []jsonWebKey
+	fetchedAt time.Time
+}
+
+func (c *keyCache) get(ctx context.Context, kid, alg string) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if key, ok := findKey(c.keys, kid, alg); ok {
+		return parseKey(key)
+	}
+	if !c.fetchedAt.IsZero() && time.Since(c.fetchedAt) < minKeyRefresh {
+		return nil, fmt.Errorf("no key %q in the provider's key set", kid)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(ctx, c.client, c.uri, &set); err != nil {
+		return nil, fmt.Errorf("fetching provider keys: %w", err)
+	}
+	c.keys = set.Keys
+	c.fetchedAt = time.Now()
+
+	key, ok := findKey(c.keys, kid, alg)
+	if !ok {
+		return nil, fmt.Errorf("no key %q in the provider's key set", kid)
+	}
+	return parseKey(key)
+}
+
+// findKey picks the signing key for a token. Tokens without a kid are only
+// accepted when the set has a single candidate.
+func findKey(keys []jsonWebKey, kid, alg string) (jsonWebKey, bool) {
+	var candidates []jsonWebKey
+	for _, key := range keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if key.Alg != "" && key.Alg != alg {
+			continue
+		}
+		if kid != "" && key.Kid == kid {
+			return key, true
+		}
+		candidates = append(candidates, key)
+	}
+	if kid == "" && len(candidates) == 1 {
+		return candidates[0], true
+	}
+	return jsonWebKey{}, false
+}
+
+func parseKey(key jsonWebKey) (any, error) {
+	switch key.Kty {
+	case "RSA":
+		n, err := decodeBigInt(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(key.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("rsa key has an invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if key.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", key.Crv)
+		}
+		x, err := decodeBigInt(key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(key.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if _, err := pub.ECDH(); err != nil {
+			return nil, errors.New("ec key is not on its curve")
+		}
+		return pub, nil
+	case "OKP":
+		if key.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", key.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("ed25519 key is malformed")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", key.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(buf) == 0 {
+		return nil, errors.New("key parameter is malformed")
+	}
+	return new(big.Int).SetBytes(buf), nil
+}
@@ -0,0 +1,168 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"grysha11/httpServersGo/internal/oidc/oidctest"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const redirectURL = "http://chirpy.test/api/auth/mock/callback"
+
+func newTestProvider(t *testing.T) (*Provider, *oidctest.Server) {
+	t.Helper()
+
+	server := oidctest.NewServer("chirpy", "secret")
+	t.Cleanup(server.Close)
+
+	provider, err := Discover(context.Background(), server.Client(), Config{
+		Name:         "mock",
+		Issuer:       server.URL,
+		ClientID:     "chirpy",
+		ClientSecret: "secret",
+		RedirectURL:  redirectURL,
+	})
+	if err != nil {
+		t.Fatalf("Error discovering provider: %v", err)
+	}
+	return provider, server
+}
+
+// authorize follows the provider's authorization endpoint and returns the
+// code it sends back.
+func authorize(t *testing.T, provider *Provider, state, nonce, verifier string) string {
+	t.Helper()
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Get(provider.AuthCodeURL(state, nonce, verifier))
+	if err != nil {
+		t.Fatalf("Error calling authorization endpoint: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected a redirect from the authorization endpoint, got %d", resp.StatusCode)
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("Error parsing redirect: %v", err)
+	}
+	if got := location.Query().Get("state"); got != state {
+		t.Fatalf("Expected state %q back, got %q", state, got)
+	}
+	return location.Query().Get("code")
+}
+
+func TestDiscoverRejectsWrongIssuer(t *testing.T) {
+	server := oidctest.NewServer("chirpy", "secret")
+	defer server.Close()
+
+	_, err := Discover(context.Background(), server.Client(), Config{Issuer: server.URL + "/other"})
+	if err == nil {
+		t.Fatal("Expected discovery to fail for a different issuer")
+	}
+}
+
+func TestCodeChallenge(t *testing.T) {
+	// RFC 7636 appendix B.
+	got := CodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if got != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("Unexpected code challenge %q", got)
+	}
+}
+
+func TestLoginFlow(t *testing.T) {
+	provider, server := newTestProvider(t)
+	server.Email = "someone@example.com"
+
+	state, nonce, verifier := RandomString(), RandomString(), RandomString()
+	code := authorize(t, provider, state, nonce, verifier)
+
+	rawIDToken, err := provider.Exchange(context.Background(), code, verifier)
+	if err != nil {
+		t.Fatalf("Error exchanging code: %v", err)
+	}
+	claims, err := provider.VerifyIDToken(context.Background(), rawIDToken, nonce)
+	if err != nil {
+		t.Fatalf("Error verifying id token: %v", err)
+	}
+	if claims.Subject != server.Subject || claims.Email != "someone@example.com" || !claims.EmailVerified {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+
+	// Codes are single use.
+	if _, err := provider.Exchange(context.Background(), code, verifier); err == nil {
+		t.Error("Expected a used code to be rejected")
+	}
+}
+
+func TestExchangeRequiresVerifier(t *testing.T) {
+	provider, _ := newTestProvider(t)
+
+	code := authorize(t, provider, "state", "nonce", RandomString())
+	if _, err := provider.Exchange(context.Background(), code, RandomString()); err == nil {
+		t.Error("Expected a wrong code verifier to be rejected")
+	}
+}
+
+func TestVerifyIDTokenRejects(t *testing.T) {
+	cases := []struct {
+		name  string
+		nonce string
+		hook  func(jwt.MapClaims)
+	}{
+		{"wrong nonce", "other", nil},
+		{"empty nonce", "", nil},
+		{"wrong audience", "nonce", func(c jwt.MapClaims) { c["aud"] = "someone-else" }},
+		{"wrong issuer", "nonce", func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }},
+		{"expired", "nonce", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"missing subject", "nonce", func(c jwt.MapClaims) { delete(c, "sub") }},
+		{"foreign authorized party", "nonce", func(c jwt.MapClaims) {
+			c["aud"] = []string{"chirpy", "someone-else"}
+			c["azp"] = "someone-else"
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			provider, server := newTestProvider(t)
+			server.IDTokenHook = c.hook
+
+			rawIDToken, err := server.IDToken("nonce")
+			if err != nil {
+				t.Fatalf("Error signing id token: %v", err)
+			}
+			_, err = provider.VerifyIDToken(context.Background(), rawIDToken, c.nonce)
+			if !errors.Is(err, ErrInvalidIDToken) {
+				t.Errorf("Expected ErrInvalidIDToken, got %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenRejectsForeignSignature(t *testing.T) {
+	provider, _ := newTestProvider(t)
+
+	// Another provider's keys use the same key id, so only the signature
+	// tells the tokens apart.
+	other := oidctest.NewServer("chirpy", "secret")
+	defer other.Close()
+	other.URL = provider.Metadata.Issuer
+
+	rawIDToken, err := other.IDToken("nonce")
+	if err != nil {
+		t.Fatalf("Error signing id token: %v", err)
+	}
+	_, err = provider.VerifyIDToken(context.Background(), rawIDToken, "nonce")
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("Expected ErrInvalidIDToken, got %v", err)
+	}
+}
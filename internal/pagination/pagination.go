@@ -0,0 +1,76 @@
+package pagination
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultLimit = 50
+	MaxLimit     = 100
+)
+
+// Cursor points at the last row of a page in (created_at, id) keyset order.
+type Cursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+func (c Cursor) Encode() string {
+	raw := c.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + c.ID.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodeCursor(s string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("malformed cursor")
+	}
+
+	createdAtString, idString, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return Cursor{}, fmt.Errorf("malformed cursor")
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, createdAtString)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("malformed cursor")
+	}
+	id, err := uuid.Parse(idString)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("malformed cursor")
+	}
+
+	return Cursor{CreatedAt: createdAt, ID: id}, nil
+}
+
+// ParseLimit returns DefaultLimit for an empty string and rejects values
+// outside of 1..MaxLimit.
+func ParseLimit(s string) (int, error) {
+	if s == "" {
+		return DefaultLimit, nil
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("limit must be an integer")
+	}
+	if limit < 1 || limit > MaxLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d", MaxLimit)
+	}
+	return limit, nil
+}
+
+// NextLink builds an RFC 8288 Link header value pointing at the next page.
+func NextLink(path string, query url.Values, next Cursor) string {
+	values := url.Values{}
+	for key, vals := range query {
+		values[key] = vals
+	}
+	values.Set("cursor", next.Encode())
+	return fmt.Sprintf("<%s?%s>; rel=\"next\"", path, values.Encode())
+}
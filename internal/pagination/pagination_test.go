@@ -0,0 +1,84 @@
+package pagination
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	cursor := Cursor{
+		CreatedAt: time.Date(2024, 3, 1, 12, 30, 45, 123456000, time.UTC),
+		ID:        uuid.New(),
+	}
+
+	decoded, err := DecodeCursor(cursor.Encode())
+	if err != nil {
+		t.Fatalf("Error decoding cursor: %v", err)
+	}
+	if !decoded.CreatedAt.Equal(cursor.CreatedAt) {
+		t.Errorf("Expected created_at %v, got %v", cursor.CreatedAt, decoded.CreatedAt)
+	}
+	if decoded.ID != cursor.ID {
+		t.Errorf("Expected id %v, got %v", cursor.ID, decoded.ID)
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	for _, s := range []string{"", "not base64!", "bm8tc2VwYXJhdG9y", "eHx5"} {
+		if _, err := DecodeCursor(s); err == nil {
+			t.Errorf("Expected error for cursor %q, got nil", s)
+		}
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected int
+		wantErr  bool
+	}{
+		{"", DefaultLimit, false},
+		{"1", 1, false},
+		{"100", 100, false},
+		{"0", 0, true},
+		{"101", 0, true},
+		{"-5", 0, true},
+		{"ten", 0, true},
+	}
+
+	for _, c := range cases {
+		limit, err := ParseLimit(c.input)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("Expected error for limit %q, got nil", c.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for limit %q: %v", c.input, err)
+		}
+		if limit != c.expected {
+			t.Errorf("Expected limit %d for %q, got %d", c.expected, c.input, limit)
+		}
+	}
+}
+
+func TestNextLink(t *testing.T) {
+	cursor := Cursor{CreatedAt: time.Now(), ID: uuid.New()}
+	query := url.Values{"sort": {"desc"}, "cursor": {"old"}}
+
+	link := NextLink("/api/chirps", query, cursor)
+	if !strings.HasPrefix(link, "</api/chirps?") || !strings.HasSuffix(link, `>; rel="next"`) {
+		t.Errorf("Unexpected link format: %s", link)
+	}
+	if !strings.Contains(link, "cursor="+cursor.Encode()) {
+		t.Errorf("Expected link to contain new cursor: %s", link)
+	}
+	if query.Get("cursor") != "old" {
+		t.Errorf("Expected original query to be left untouched")
+	}
+}
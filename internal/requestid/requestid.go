@@ -0,0 +1,47 @@
+package requestid
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const Header = "X-Request-ID"
+
+const maxLength = 128
+
+type contextKey struct{}
+
+// Middleware attaches a request ID to the request context and the response
+// headers. A well-formed ID sent by the client is reused so logs can be
+// correlated across services.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !isValid(id) {
+			id = uuid.NewString()
+		}
+
+		w.Header().Set(Header, id)
+		ctx := context.WithValue(r.Context(), contextKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+func isValid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,158 @@
+// Package totp implements time-based one-time passwords as described in
+// RFC 6238, compatible with common authenticator apps.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type Algorithm string
+
+const (
+	SHA1   Algorithm = "SHA1"
+	SHA256 Algorithm = "SHA256"
+	SHA512 Algorithm = "SHA512"
+)
+
+func (a Algorithm) hash() (func() hash.Hash, error) {
+	switch a {
+	case SHA1:
+		return sha1.New, nil
+	case SHA256:
+		return sha256.New, nil
+	case SHA512:
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported TOTP algorithm %q", a)
+}
+
+type Options struct {
+	Digits    int
+	Period    time.Duration
+	Algorithm Algorithm
+	// Skew is how many periods before and after the current one are still
+	// accepted, to allow for clock drift on the user's device.
+	Skew int
+}
+
+// DefaultOptions are what authenticator apps assume when the otpauth URI
+// doesn't say otherwise.
+var DefaultOptions = Options{
+	Digits:    6,
+	Period:    30 * time.Second,
+	Algorithm: SHA1,
+	Skew:      1,
+}
+
+// secretEncoding is the base32 form secrets are exchanged in.
+var secretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a random 160 bit secret, base32 encoded.
+func GenerateSecret() (string, error) {
+	key := make([]byte, 20)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return secretEncoding.EncodeToString(key), nil
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	return secretEncoding.DecodeString(strings.TrimRight(secret, "="))
+}
+
+// Step returns the time step t falls into.
+func Step(t time.Time, opts Options) int64 {
+	return t.Unix() / int64(opts.Period/time.Second)
+}
+
+// Code returns the code for secret at time t.
+func Code(secret string, t time.Time, opts Options) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return codeAt(key, Step(t, opts), opts)
+}
+
+func codeAt(key []byte, step int64, opts Options) (string, error) {
+	newHash, err := opts.Algorithm.hash()
+	if err != nil {
+		return "", err
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(newHash, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, RFC 4226 section 5.3.
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < opts.Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", opts.Digits, value%mod), nil
+}
+
+// Validate checks code against secret at time t, allowing opts.Skew steps of
+// drift. It returns the step the code belongs to so callers can refuse to
+// accept the same step twice.
+func Validate(code, secret string, t time.Time, opts Options) (int64, bool, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return 0, false, err
+	}
+
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != opts.Digits {
+		return 0, false, nil
+	}
+
+	current := Step(t, opts)
+	for i := -opts.Skew; i <= opts.Skew; i++ {
+		step := current + int64(i)
+		expected, err := codeAt(key, step, opts)
+		if err != nil {
+			return 0, false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(expected)) == 1 {
+			return step, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// URI returns the otpauth:// URI authenticator apps read from QR codes.
+func URI(issuer, account, secret string, opts Options) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", string(opts.Algorithm))
+	query.Set("digits", fmt.Sprint(opts.Digits))
+	query.Set("period", fmt.Sprint(int(opts.Period/time.Second)))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
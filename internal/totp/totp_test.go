@@ -0,0 +1,126 @@
+package totp
+
+import (
+	"encoding/base32"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test vectors from RFC 6238 appendix B. Each algorithm uses its own seed,
+// the ASCII string "12345678901234567890" repeated to the hash size.
+func TestRFC6238Vectors(t *testing.T) {
+	seeds := map[Algorithm]string{
+		SHA1:   "12345678901234567890",
+		SHA256: "12345678901234567890123456789012",
+		SHA512: "1234567890123456789012345678901234567890123456789012345678901234",
+	}
+
+	cases := []struct {
+		unix      int64
+		algorithm Algorithm
+		code      string
+	}{
+		{59, SHA1, "94287082"},
+		{59, SHA256, "46119246"},
+		{59, SHA512, "90693936"},
+		{1111111109, SHA1, "07081804"},
+		{1111111109, SHA256, "68084774"},
+		{1111111109, SHA512, "25091201"},
+		{1111111111, SHA1, "14050471"},
+		{1111111111, SHA256, "67062674"},
+		{1111111111, SHA512, "99943326"},
+		{1234567890, SHA1, "89005924"},
+		{1234567890, SHA256, "91819424"},
+		{1234567890, SHA512, "93441116"},
+		{2000000000, SHA1, "69279037"},
+		{2000000000, SHA256, "90698825"},
+		{2000000000, SHA512, "38618901"},
+		{20000000000, SHA1, "65353130"},
+		{20000000000, SHA256, "77737706"},
+		{20000000000, SHA512, "47863826"},
+	}
+
+	for _, c := range cases {
+		secret := secretEncoding.EncodeToString([]byte(seeds[c.algorithm]))
+		opts := Options{Digits: 8, Period: 30 * time.Second, Algorithm: c.algorithm}
+
+		code, err := Code(secret, time.Unix(c.unix, 0), opts)
+		if err != nil {
+			t.Fatalf("Error generating code: %v", err)
+		}
+		if code != c.code {
+			t.Errorf("%s at %d: expected %s, got %s", c.algorithm, c.unix, c.code, code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("Error generating secret: %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+
+	code, err := Code(secret, now.Add(-30*time.Second), DefaultOptions)
+	if err != nil {
+		t.Fatalf("Error generating code: %v", err)
+	}
+	step, ok, err := Validate(code, secret, now, DefaultOptions)
+	if err != nil || !ok {
+		t.Fatalf("Expected previous step to be accepted, got ok=%v err=%v", ok, err)
+	}
+	if step != Step(now, DefaultOptions)-1 {
+		t.Errorf("Expected step %d, got %d", Step(now, DefaultOptions)-1, step)
+	}
+
+	if _, ok, _ := Validate(code, secret, now.Add(time.Minute), DefaultOptions); ok {
+		t.Error("Expected code from three steps ago to be rejected")
+	}
+	if _, ok, _ := Validate("12345", secret, now, DefaultOptions); ok {
+		t.Error("Expected code with wrong length to be rejected")
+	}
+	if _, _, err := Validate("123456", "not base32!", now, DefaultOptions); err == nil {
+		t.Error("Expected error for invalid secret, got nil")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("Error generating secret: %v", err)
+	}
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatalf("Expected base32 secret, got %q: %v", secret, err)
+	}
+	if len(key) != 20 {
+		t.Errorf("Expected 20 byte secret, got %d", len(key))
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Chirpy", "a@b.c", "JBSWY3DPEHPK3PXP", DefaultOptions)
+	if !strings.HasPrefix(uri, "otpauth://totp/Chirpy:a@b.c?") {
+		t.Fatalf("Unexpected URI %q", uri)
+	}
+
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		t.Fatalf("Error parsing URI: %v", err)
+	}
+	query := parsed.Query()
+	expected := map[string]string{
+		"secret":    "JBSWY3DPEHPK3PXP",
+		"issuer":    "Chirpy",
+		"algorithm": "SHA1",
+		"digits":    "6",
+		"period":    "30",
+	}
+	for key, value := range expected {
+		if got := query.Get(key); got != value {
+			t.Errorf("Expected %s=%s, got %q", key, value, got)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"grysha11/httpServersGo/internal/apierror"
+	"grysha11/httpServersGo/internal/auth"
+	"grysha11/httpServersGo/internal/database"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultAccountLockout slows down guessing the password of a single
+// account, no matter how many addresses the attempts come from.
+var defaultAccountLockout = auth.LockoutPolicy{
+	FreeAttempts: 3,
+	BaseDelay: time.Second,
+	MaxDelay: time.Minute,
+	LockoutThreshold: 10,
+	LockoutDuration: 15 * time.Minute,
+	ResetAfter: time.Hour,
+}
+
+// defaultIPLockout is looser than the account policy because many users can
+// share an address, but still stops one client from spraying passwords
+// across accounts.
+var defaultIPLockout = auth.LockoutPolicy{
+	FreeAttempts: 20,
+	BaseDelay: time.Second,
+	MaxDelay: time.Minute,
+	LockoutThreshold: 100,
+	LockoutDuration: time.Hour,
+	ResetAfter: time.Hour,
+}
+
+// throttle limits attempts of one kind by one key, such as logins to an
+// account or reset requests from an address. Every kind of attempt uses
+// its own key prefix, so one never counts against another.
+type throttle struct {
+	key		string
+	policy	auth.LockoutPolicy
+}
+
+func accountThrottleKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func (cfg *apiConfig) loginThrottles(r *http.Request, email string) []throttle {
+	return []throttle{
+		{key: accountThrottleKey(email), policy: cfg.AccountLockout},
+		{key: "ip:" + clientIP(r), policy: cfg.IPLockout},
+	}
+}
+
+// throttleRetryAfter returns how long until none of the throttles is
+// locked anymore, zero if none is.
+func (cfg *apiConfig) throttleRetryAfter(ctx context.Context, throttles []throttle) (time.Duration, error) {
+	now := time.Now().UTC()
+	var retryAfter time.Duration
+	for _, t := range throttles {
+		stored, err := cfg.DB.GetLoginThrottle(ctx, t.key)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if stored.LockedUntil.Valid && stored.LockedUntil.Time.After(now) {
+			retryAfter = max(retryAfter, stored.LockedUntil.Time.Sub(now))
+		}
+	}
+	return retryAfter, nil
+}
+
+// checkThrottles refuses the attempt with a 429, the given message and a
+// Retry-After header while any of the throttles is locked.
+func (cfg *apiConfig) checkThrottles(w http.ResponseWriter, r *http.Request, throttles []throttle, message string) error {
+	retryAfter, err := cfg.throttleRetryAfter(r.Context(), throttles)
+	if err != nil {
+		return err
+	}
+
+	if retryAfter > 0 {
+		seconds := int((retryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		return apierror.TooManyAttempts(message)
+	}
+	return nil
+}
+
+// countAttempt counts an attempt against a throttle and locks it if its
+// policy asks for a delay. It returns how many attempts were made in a row
+// and how long the throttle is now locked for.
+func (cfg *apiConfig) countAttempt(ctx context.Context, t throttle) (int, time.Duration, error) {
+	now := time.Now().UTC()
+	stored, err := cfg.DB.RecordLoginFailure(ctx, database.RecordLoginFailureParams{
+		ThrottleKey: t.key,
+		ResetBefore: now.Add(-t.policy.ResetAfter),
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	attempts := int(stored.Failures)
+	lockFor := t.policy.LockedFor(attempts)
+	if lockFor <= 0 {
+		return attempts, 0, nil
+	}
+	err = cfg.DB.LockLoginThrottle(ctx, database.LockLoginThrottleParams{
+		ThrottleKey: t.key,
+		LockedUntil: sql.NullTime{Time: now.Add(lockFor), Valid: true},
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return attempts, lockFor, nil
+}
+
+// countAttempts counts an attempt against every throttle.
+func (cfg *apiConfig) countAttempts(ctx context.Context, throttles []throttle) error {
+	for _, t := range throttles {
+		_, _, err := cfg.countAttempt(ctx, t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordLoginFailure counts a failed login against every throttle and
+// audits the account getting locked.
+func (cfg *apiConfig) recordLoginFailure(ctx context.Context, throttles []throttle, user *database.User) error {
+	for i, t := range throttles {
+		failures, lockFor, err := cfg.countAttempt(ctx, t)
+		if err != nil {
+			return err
+		}
+
+		if i == 0 && user != nil && lockFor > 0 && failures == t.policy.LockoutThreshold {
+			log.Printf("Locking account %v after %d failed login attempts\n", user.ID, failures)
+			cfg.recordAuditEvent(ctx, user.ID, auditAccountLocked, map[string]any{
+				"failures": failures,
+				"locked_until": time.Now().UTC().Add(lockFor),
+			})
+		}
+	}
+	return nil
+}
+
+func (cfg *apiConfig) handleUnlockUser(w http.ResponseWriter, r *http.Request) error {
+	userID, err := parseUUIDPathValue(r, "userID")
+	if err != nil {
+		return err
+	}
+
+	user, err := cfg.DB.GetUserByID(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.NotFound("user not found", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = cfg.DB.DeleteLoginThrottle(r.Context(), accountThrottleKey(user.Email))
+	if err != nil {
+		return err
+	}
+	cfg.recordAuditEvent(r.Context(), user.ID, auditAccountUnlocked, nil)
+
+	w.WriteHeader(204)
+	return nil
+}
@@ -1,18 +1,30 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"grysha11/httpServersGo/internal/apierror"
 	"grysha11/httpServersGo/internal/database"
 	"grysha11/httpServersGo/internal/auth"
+	"grysha11/httpServersGo/internal/chirptext"
+	"grysha11/httpServersGo/internal/mailer"
+	"grysha11/httpServersGo/internal/moderation"
+	"grysha11/httpServersGo/internal/oidc"
+	"grysha11/httpServersGo/internal/pagination"
+	"grysha11/httpServersGo/internal/requestid"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"database/sql"
 	"time"
-	"slices"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
@@ -20,11 +32,77 @@ import (
 )
 
 type Chirp struct {
-	ID        uuid.UUID	`json:"id"`
-	CreatedAt time.Time	`json:"created_at"`
-	UpdatedAt time.Time	`json:"updated_at"`
-	Body      string	`json:"body"`
-	UserID    uuid.UUID	`json:"user_id"`
+	ID           uuid.UUID	`json:"id"`
+	CreatedAt    time.Time	`json:"created_at"`
+	UpdatedAt    time.Time	`json:"updated_at"`
+	Body         string	`json:"body"`
+	UserID       uuid.UUID	`json:"user_id"`
+	Edited       bool		`json:"edited"`
+	DeletedAt    *time.Time	`json:"deleted_at,omitempty"`
+	ParentID     *uuid.UUID	`json:"parent_id,omitempty"`
+	RootID       *uuid.UUID	`json:"root_id,omitempty"`
+	RechirpOfID  *uuid.UUID	`json:"rechirp_of_id,omitempty"`
+	RechirpOf    *Chirp		`json:"rechirp_of,omitempty"`
+	QuoteOfID    *uuid.UUID	`json:"quote_of_id,omitempty"`
+	QuoteOf      *Chirp		`json:"quote_of,omitempty"`
+	ReplyCount   int		`json:"reply_count"`
+	RechirpCount int		`json:"rechirp_count"`
+	QuoteCount   int		`json:"quote_count"`
+}
+
+func chirpFromDB(chirp database.Chirp) Chirp {
+	res := Chirp{
+		ID: chirp.ID,
+		CreatedAt: chirp.CreatedAt,
+		UpdatedAt: chirp.UpdatedAt,
+		Body: chirp.Body,
+		UserID: chirp.UserID.UUID,
+		Edited: chirp.EditedAt.Valid,
+	}
+	// Only moderators get to see deleted chirps.
+	if chirp.DeletedAt.Valid {
+		res.DeletedAt = &chirp.DeletedAt.Time
+	}
+	if chirp.ParentID.Valid {
+		res.ParentID = &chirp.ParentID.UUID
+	}
+	if chirp.RootID.Valid {
+		res.RootID = &chirp.RootID.UUID
+	}
+	if chirp.RechirpOfID.Valid {
+		res.RechirpOfID = &chirp.RechirpOfID.UUID
+	}
+	if chirp.QuoteOfID.Valid {
+		res.QuoteOfID = &chirp.QuoteOfID.UUID
+	}
+	return res
+}
+
+// expandChirps fills in what chirpFromDB can't: the chirps that rechirps and
+// quotes refer to, and reply, rechirp and quote counts.
+func (cfg *apiConfig) expandChirps(ctx context.Context, chirps []*Chirp) error {
+	inlined, err := cfg.inlineSharedChirps(ctx, chirps)
+	if err != nil {
+		return err
+	}
+
+	all := append(chirps[:len(chirps):len(chirps)], inlined...)
+	err = cfg.addReplyCounts(ctx, all)
+	if err != nil {
+		return err
+	}
+	return cfg.addShareCounts(ctx, all)
+}
+
+// respondWithChirp writes a single chirp the way every other chirp endpoint
+// returns it, expanded.
+func (cfg *apiConfig) respondWithChirp(w http.ResponseWriter, r *http.Request, status int, chirp database.Chirp) error {
+	res := chirpFromDB(chirp)
+	err := cfg.expandChirps(r.Context(), []*Chirp{&res})
+	if err != nil {
+		return err
+	}
+	return respondWithJSON(w, status, res)
 }
 
 type User struct {
@@ -34,15 +112,36 @@ type User struct {
 		Email			string		`json:"email"`
 		Token			string		`json:"token"`
 		RefreshToken	string		`json:"refresh_token"`
+		ExpiresAt		*time.Time	`json:"expires_at,omitempty"`
 		IsChirpyRed		bool		`json:"is_chirpy_red"`
+		IsEmailVerified	bool		`json:"is_email_verified"`
+		Role			string		`json:"role"`
 }
 
 type apiConfig struct {
 	FileserverHits	atomic.Int32
 	DB				*database.Queries
+	// DBConn is the connection pool behind DB, for work that needs a
+	// transaction.
+	DBConn			*sql.DB
 	Platform		string
-	JWTSecret		string
+	JWTKeys			*auth.KeySet
+	JWTAudience		string
+	TokenTTLs		tokenTTLs
 	APIKey			string
+	BootstrapKey	string
+	Moderator		moderation.Moderator
+	Mailer			mailer.Mailer
+	RequireVerifiedEmail	bool
+	AccountLockout	auth.LockoutPolicy
+	IPLockout		auth.LockoutPolicy
+	OIDCProviders	map[string]*oidc.Provider
+	DeletionGracePeriod	time.Duration
+	ChirpLimits		chirptext.Limits
+	ChirpEditWindow	time.Duration
+	ChirpDeletionGracePeriod	time.Duration
+	// background tracks work that outlives the request it was started by.
+	background		sync.WaitGroup
 }
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
@@ -74,589 +173,861 @@ func (cfg *apiConfig) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(bodyHtml))
 }
 
-func (cfg *apiConfig) handleReset(w http.ResponseWriter, r *http.Request) {
+func respondWithJSON(w http.ResponseWriter, code int, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshaling response: %w", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+	return nil
+}
+
+// maxBodyBytes caps the size of JSON request bodies.
+const maxBodyBytes = 1 << 20
+
+// decodeJSON decodes a single JSON object from the request body into dst,
+// rejecting unknown fields and bodies larger than maxBodyBytes.
+// shutdownTimeout bounds how long shutdown waits for in-flight requests and
+// background work such as password reset emails.
+const shutdownTimeout = 10 * time.Second
+
+// waitForBackground waits until the work started in the background has
+// finished or ctx is done, and reports whether it finished.
+func (cfg *apiConfig) waitForBackground(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		cfg.background.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// inBackground runs fn after the request has been answered. fn keeps the
+// values of the request context but not its cancellation, and shutdown
+// waits for it through waitForBackground.
+func (cfg *apiConfig) inBackground(r *http.Request, fn func(ctx context.Context)) {
+	ctx := context.WithoutCancel(r.Context())
+	cfg.background.Add(1)
+	go func() {
+		defer cfg.background.Done()
+		fn(ctx)
+	}()
+}
+
+// inTx runs fn with queries bound to a single transaction, which is
+// committed if fn returns nil and rolled back otherwise.
+func (cfg *apiConfig) inTx(ctx context.Context, fn func(q *database.Queries) error) error {
+	tx, err := cfg.DBConn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(cfg.DB.WithTx(tx))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(dst)
+	if err != nil {
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			field = strings.Trim(field, `"`)
+			return apierror.New(400, apierror.CodeUnknownField, fmt.Sprintf("request body contains unknown field %q", field), err).WithDetails(map[string]string{
+				field: "unknown field",
+			})
+		}
+		return err
+	}
+
+	if decoder.More() {
+		return apierror.New(400, apierror.CodeInvalidJSON, "request body must contain a single JSON object", nil)
+	}
+	return nil
+}
+
+func parseUUIDPathValue(r *http.Request, name string) (uuid.UUID, error) {
+	id, err := uuid.Parse(r.PathValue(name))
+	if err != nil {
+		return uuid.Nil, apierror.BadRequest(fmt.Sprintf("invalid %s", name), err).WithDetails(map[string]string{
+			name: "must be a valid UUID",
+		})
+	}
+	return id, nil
+}
+
+func (cfg *apiConfig) handleReset(w http.ResponseWriter, r *http.Request) error {
 	bodyText := "RESET"
-	bodyFail := "FAIL"
 	if strings.Compare(cfg.Platform, "dev") != 0 {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(403)
-		w.Write([]byte(bodyFail))
-		return
+		return apierror.Forbidden("reset is only allowed in dev environment")
 	}
 	
 	cfg.FileserverHits.Store(0)
 	err := cfg.DB.DeleteUsers(r.Context())
 	if err != nil {
-		log.Printf("Couldn't execute db query: %v", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(500)
-		w.Write([]byte(bodyFail))
-		return
+		return err
 	}
 	err = cfg.DB.DeleteChirps(r.Context())
 	if err != nil {
-		log.Printf("Couldn't execute db query: %v", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(500)
-		w.Write([]byte(bodyFail))
-		return
+		return err
 	}
 	err = cfg.DB.DeleteRefreshTokens(r.Context())
 	if err != nil {
-		log.Printf("Couldn't execute db query: %v", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(500)
-		w.Write([]byte(bodyFail))
-		return
+		return err
+	}
+	err = cfg.DB.DeleteLoginThrottles(r.Context())
+	if err != nil {
+		return err
 	}
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(200)
 	w.Write([]byte(bodyText))
+	return nil
 }
 
-func formatBody(bodyStr string) string {
-	words := strings.Split(bodyStr, " ")
+func loadModerationRules(ctx context.Context, db *database.Queries, rulesFile string) ([]moderation.Rule, error) {
+	if rulesFile != "" {
+		return moderation.LoadFile(rulesFile)
+	}
 
-	for i, word := range words {
-		word = strings.ToLower(word)
-		if word == "kerfuffle" || word == "sharbert" || word == "fornax" {
-			words[i] = "****"
-		}
+	dbRules, err := db.GetModerationRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(dbRules) == 0 {
+		return moderation.DefaultRules, nil
 	}
 
-	res := strings.Join(words, " ")
+	rules := make([]moderation.Rule, len(dbRules))
+	for i, dbRule := range dbRules {
+		action, err := moderation.ParseAction(dbRule.Action)
+		if err != nil {
+			return nil, err
+		}
+		rules[i] = moderation.Rule{
+			Word: dbRule.Word,
+			Action: action,
+		}
+	}
+	return rules, nil
+}
 
-	return res
+// loadChirpLimits reads CHIRP_MAX_LENGTH and CHIRP_MAX_LENGTH_CHIRPY_RED,
+// falling back to chirptext.DefaultLimits.
+func loadChirpLimits() (chirptext.Limits, error) {
+	limits := chirptext.DefaultLimits
+	envs := []struct {
+		name	string
+		dst		*int
+	}{
+		{"CHIRP_MAX_LENGTH", &limits.Default},
+		{"CHIRP_MAX_LENGTH_CHIRPY_RED", &limits.ChirpyRed},
+	}
+	for _, env := range envs {
+		value := os.Getenv(env.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return chirptext.Limits{}, fmt.Errorf("%s: %w", env.name, err)
+		}
+		if n < 1 {
+			return chirptext.Limits{}, fmt.Errorf("%s must be positive", env.name)
+		}
+		*env.dst = n
+	}
+	if limits.ChirpyRed < limits.Default {
+		return chirptext.Limits{}, fmt.Errorf("CHIRP_MAX_LENGTH_CHIRPY_RED must not be lower than CHIRP_MAX_LENGTH")
+	}
+	return limits, nil
 }
 
-func (cfg *apiConfig) handleUsers(w http.ResponseWriter, r *http.Request) {
+func (cfg *apiConfig) handleUsers(w http.ResponseWriter, r *http.Request) error {
 	type parameters struct {
 		Email			string	`json:"email"`
 		Password		string	`json:"password"`
 	}
 
-	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	err := decoder.Decode(&params)
+	err := decodeJSON(w, r, &params)
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while decoding request: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(500)
-		w.Write([]byte(errorStr))
-		return
+		return err
+	}
+
+	problems := map[string]string{}
+	if problem := validateEmail(params.Email); problem != "" {
+		problems["email"] = problem
+	}
+	if params.Password == "" {
+		problems["password"] = "is required"
+	} else if problem := auth.CheckPasswordStrength(params.Password, params.Email); problem != "" {
+		problems["password"] = problem
+	}
+	if len(problems) > 0 {
+		return apierror.Validation(problems)
 	}
 
 	passwordHash, err := auth.HashPassword(params.Password)
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while hashing password: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(500)
-		w.Write([]byte(errorStr))
-		return
+		return err
 	}
 
 	user, err := cfg.DB.CreateUser(r.Context(), database.CreateUserParams{
 		Email: params.Email,
 		HashedPassword: passwordHash,
 	})
+	if apierror.IsUniqueViolation(err) {
+		return apierror.Conflict("email is already registered", err).WithDetails(map[string]string{
+			"email": "is already registered",
+		})
+	}
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while making db call: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(500)
-		w.Write([]byte(errorStr))
-		return
+		return err
 	}
 
-	respSuccess := User{
+	cfg.sendVerificationEmail(r.Context(), user)
+
+	return respondWithJSON(w, 201, User{
 		ID: user.ID,
 		CreatedAt: user.CreatedAt,
 		UpdatedAt: user.UpdatedAt,
 		Email: user.Email,
 		IsChirpyRed: user.IsChirpyRed,
-	}
-	data, err := json.Marshal(respSuccess)
-	if err != nil {
-		log.Printf("Error marshaling data: %v", err)
-		w.WriteHeader(500)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(201)
-	w.Write(data)
+		IsEmailVerified: user.EmailVerifiedAt.Valid,
+		Role: user.Role,
+	})
 }
 
-func (cfg *apiConfig) handleCreateChirps(w http.ResponseWriter, r *http.Request) {
+func (cfg *apiConfig) handleCreateChirps(w http.ResponseWriter, r *http.Request) error {
 	type parameters struct {
-		Body	string		`json:"body"`
+		Body		string		`json:"body"`
+		ReplyToID	*uuid.UUID	`json:"reply_to_id"`
+		QuoteOfID	*uuid.UUID	`json:"quote_of_id"`
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while validating authentication: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(401)
-		w.Write([]byte(errorStr))
-		return
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.JWTSecret)
+	params := parameters{}
+	err := decodeJSON(w, r, &params)
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while validating authentication: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(401)
-		w.Write([]byte(errorStr))
-		return
+		return err
 	}
 
-	decoder := json.NewDecoder(r.Body)
-	params := parameters{}
-	err = decoder.Decode(&params)
+	moderated, err := cfg.prepareChirpBody(r.Context(), userID, params.Body)
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while decoding request: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(500)
-		w.Write([]byte(errorStr))
-		return
+		return err
 	}
 
-	if len(params.Body) == 0 {
-		errorStr := "Error body is null"
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(400)
-		w.Write([]byte(errorStr))
-		return
+	var parentID, rootID uuid.NullUUID
+	if params.ReplyToID != nil {
+		parentID, rootID, err = cfg.replyParent(r.Context(), *params.ReplyToID)
+		if err != nil {
+			return err
+		}
+	}
+
+	var quoteOfID uuid.NullUUID
+	if params.QuoteOfID != nil {
+		quoted, err := cfg.originalChirp(r.Context(), *params.QuoteOfID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return apierror.Validation(map[string]string{
+				"quote_of_id": "chirp not found",
+			})
+		}
+		if err != nil {
+			return err
+		}
+		quoteOfID = uuid.NullUUID{UUID: quoted.ID, Valid: true}
 	}
 
 	chirp, err := cfg.DB.CreateChirp(r.Context(), database.CreateChirpParams{
-		Body: params.Body,
+		Body: moderated.Body,
 		UserID: userID,
+		OriginalBody: sql.NullString{
+			String: moderated.Original,
+			Valid: moderated.Changed(),
+		},
+		Flagged: moderated.Flagged,
+		ParentID: parentID,
+		RootID: rootID,
+		QuoteOfID: quoteOfID,
 	})
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while making db call: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(500)
-		w.Write([]byte(errorStr))
-		return
+		return err
 	}
 
-	respSuccess := Chirp{
-		ID: chirp.ID,
-		CreatedAt: chirp.CreatedAt,
-		UpdatedAt: chirp.UpdatedAt,
-		Body: chirp.Body,
-		UserID: chirp.UserID,
+	return cfg.respondWithChirp(w, r, 201, chirp)
+}
+
+// prepareChirpBody checks a body the user wants to post and runs it through
+// moderation. The length limit depends on the user's plan, so it can only be
+// checked once we know who is posting.
+func (cfg *apiConfig) prepareChirpBody(ctx context.Context, userID uuid.UUID, body string) (moderation.Result, error) {
+	user, err := cfg.DB.GetUserByID(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return moderation.Result{}, apierror.Unauthorized("user no longer exists", err)
 	}
-	data, err := json.Marshal(respSuccess)
 	if err != nil {
-		log.Printf("Error marshaling data: %v\n", err)
-		w.WriteHeader(500)
-		return
+		return moderation.Result{}, err
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(201)
-	w.Write(data)
+	if user.DeletedAt.Valid {
+		return moderation.Result{}, apierror.Unauthorized("account has been deleted", nil)
+	}
+	err = cfg.requireVerifiedEmail(user)
+	if err != nil {
+		return moderation.Result{}, err
+	}
+
+	body, problem := chirptext.Check(body, cfg.ChirpLimits.Max(user.IsChirpyRed))
+	if problem != "" {
+		return moderation.Result{}, apierror.Validation(map[string]string{
+			"body": problem,
+		})
+	}
+
+	moderated, err := cfg.Moderator.Moderate(body)
+	var rejected *moderation.RejectedError
+	if errors.As(err, &rejected) {
+		return moderation.Result{}, apierror.BadRequest("chirp was rejected by moderation", err)
+	}
+	return moderated, err
 }
 
-func (cfg *apiConfig) handleGetChirps(w http.ResponseWriter, r *http.Request) {
-	authorIDString := r.URL.Query().Get("author_id")
-	sort := r.URL.Query().Get("sort")
+func (cfg *apiConfig) handleGetChirps(w http.ResponseWriter, r *http.Request) error {
+	type ResponsePage struct {
+		Chirps		[]Chirp	`json:"chirps"`
+		NextCursor	string	`json:"next_cursor,omitempty"`
+	}
 
-	var chirps []database.Chirp
-	var err error
+	query := r.URL.Query()
+	authorIDString := query.Get("author_id")
+	sort := query.Get("sort")
+	cursorString := query.Get("cursor")
+	limitString := query.Get("limit")
 
-	if authorIDString != "" {
-		authorID, err := uuid.Parse(authorIDString)
-		if err != nil {
-			w.WriteHeader(400)
-			w.Write([]byte("Invalid author ID"))
-			return
-		}
+	limit, err := pagination.ParseLimit(limitString)
+	if err != nil {
+		return apierror.BadRequest(err.Error(), err)
+	}
 
-		chirps, err = cfg.DB.GetChirpsByAuthor(r.Context(), authorID)
-		if err != nil {
-			errorStr := fmt.Sprintf("Error occured while making db call: %v\n", err)
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			w.WriteHeader(500)
-			w.Write([]byte(errorStr))
-			return
-		}
-	} else {
-		chirps, err = cfg.DB.GetAllChirps(r.Context())
+	if sort != "" && sort != "asc" && sort != "desc" {
+		return apierror.BadRequest("sort must be asc or desc", nil)
+	}
+
+	authorID := uuid.NullUUID{}
+	if authorIDString != "" {
+		authorID.UUID, err = uuid.Parse(authorIDString)
 		if err != nil {
-			errorStr := fmt.Sprintf("Error occured while making db call: %v\n", err)
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			w.WriteHeader(500)
-			w.Write([]byte(errorStr))
-			return
+			return apierror.BadRequest("invalid author ID", err)
 		}
+		authorID.Valid = true
 	}
 
-	respSuccess := make([]Chirp, len(chirps))
-	for i, chirp := range chirps {
-		respSuccess[i] = Chirp{
-			ID: chirp.ID,
-			CreatedAt: chirp.CreatedAt,
-			UpdatedAt: chirp.UpdatedAt,
-			Body: chirp.Body,
-			UserID: chirp.UserID,
+	afterCreatedAt := sql.NullTime{}
+	afterID := uuid.NullUUID{}
+	if cursorString != "" {
+		cursor, err := pagination.DecodeCursor(cursorString)
+		if err != nil {
+			return apierror.BadRequest("invalid cursor", err)
 		}
+		afterCreatedAt = sql.NullTime{Time: cursor.CreatedAt, Valid: true}
+		afterID = uuid.NullUUID{UUID: cursor.ID, Valid: true}
 	}
 
+	// One extra row tells us whether there is a next page.
+	var chirps []database.Chirp
 	if sort == "desc" {
-		slices.SortFunc(respSuccess, func(a, b Chirp) int {
-			return b.CreatedAt.Compare(a.CreatedAt)
+		chirps, err = cfg.DB.ListChirpsDesc(r.Context(), database.ListChirpsDescParams{
+			AuthorID: authorID,
+			AfterCreatedAt: afterCreatedAt,
+			AfterID: afterID,
+			PageLimit: int32(limit + 1),
+		})
+	} else {
+		chirps, err = cfg.DB.ListChirpsAsc(r.Context(), database.ListChirpsAscParams{
+			AuthorID: authorID,
+			AfterCreatedAt: afterCreatedAt,
+			AfterID: afterID,
+			PageLimit: int32(limit + 1),
 		})
 	}
-
-	data, err := json.Marshal(respSuccess)
 	if err != nil {
-		log.Printf("Error marshaling data: %v\n", err)
-		w.WriteHeader(500)
-		return
+		return err
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(200)
-	w.Write(data)
-}
 
-func (cfg *apiConfig) handleGetChirpByID(w http.ResponseWriter, r *http.Request) {
-	chirpIDString := r.PathValue("chirpID")
+	nextCursor := ""
+	if len(chirps) > limit {
+		chirps = chirps[:limit]
+		last := chirps[len(chirps)-1]
+		next := pagination.Cursor{CreatedAt: last.CreatedAt, ID: last.ID}
+		nextCursor = next.Encode()
+		w.Header().Set("Link", pagination.NextLink("/api/chirps", query, next))
+	}
 
-	chirpID, err := uuid.Parse(chirpIDString)
+	respChirps := make([]Chirp, len(chirps))
+	counted := make([]*Chirp, len(chirps))
+	for i, chirp := range chirps {
+		respChirps[i] = chirpFromDB(chirp)
+		counted[i] = &respChirps[i]
+	}
+	err = cfg.expandChirps(r.Context(), counted)
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while parsing uuid: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(500)
-		w.Write([]byte(errorStr))
-		return
+		return err
 	}
 
-	chirp, err := cfg.DB.GetChirpByID(r.Context(), chirpID)
+	// Clients that don't ask for pagination keep getting a bare array.
+	if cursorString == "" && limitString == "" {
+		return respondWithJSON(w, 200, respChirps)
+	}
+	return respondWithJSON(w, 200, ResponsePage{
+		Chirps: respChirps,
+		NextCursor: nextCursor,
+	})
+}
+
+func (cfg *apiConfig) handleGetChirpByID(w http.ResponseWriter, r *http.Request) error {
+	chirpID, err := parseUUIDPathValue(r, "chirpID")
 	if err != nil {
-		errorStr := fmt.Sprintf("Error: Couldn't find chirp with id: %v", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(404)
-		w.Write([]byte(errorStr))
-		return
+		return err
 	}
 
-	respSuccess := Chirp{
-		ID: chirp.ID,
-		CreatedAt: chirp.CreatedAt,
-		UpdatedAt: chirp.UpdatedAt,
-		Body: chirp.Body,
-		UserID: chirp.UserID,
+	chirp, err := cfg.DB.GetChirpByID(r.Context(), chirpID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.NotFound("chirp not found", err)
 	}
-	data, err := json.Marshal(respSuccess)
 	if err != nil {
-		log.Printf("Error marshaling data: %v\n", err)
-		w.WriteHeader(500)
-		return
+		return err
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(200)
-	w.Write(data)
+
+	return cfg.respondWithChirp(w, r, 200, chirp)
 }
 
-func (cfg *apiConfig) handleLogin(w http.ResponseWriter, r *http.Request) {
+func (cfg *apiConfig) handleLogin(w http.ResponseWriter, r *http.Request) error {
 	type parameters struct {
 		Email				string	`json:"email"`
 		Password			string	`json:"password"`
 		ExpiresInSeconds	int		`json:"expires_in_seconds"`
 	}
 
-	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	err := decoder.Decode(&params)
+	err := decodeJSON(w, r, &params)
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while decoding request: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(500)
-		w.Write([]byte(errorStr))
-		return
+		return err
 	}
 
-	if params.ExpiresInSeconds == 0 {
-		params.ExpiresInSeconds = 60 * 60
+	problems := map[string]string{}
+	if params.Email == "" {
+		problems["email"] = "is required"
+	}
+	if params.Password == "" {
+		problems["password"] = "is required"
+	}
+	if params.ExpiresInSeconds < 0 {
+		problems["expires_in_seconds"] = "must not be negative"
+	}
+	if len(problems) > 0 {
+		return apierror.Validation(problems)
 	}
 
+	throttles := cfg.loginThrottles(r, params.Email)
+	err = cfg.checkThrottles(w, r, throttles, "too many failed login attempts, try again later")
+	if err != nil {
+		return err
+	}
+
+	// Unknown emails and wrong passwords get the same response and take
+	// about as long, so the endpoint can't be used to find accounts.
+	invalidCredentials := apierror.Unauthorized("invalid email or password", nil)
+
 	user, err := cfg.DB.GetUserByEmail(r.Context(), params.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		auth.CheckDummyPasswordHash(params.Password)
+		if err := cfg.recordLoginFailure(r.Context(), throttles, nil); err != nil {
+			return err
+		}
+		return invalidCredentials
+	}
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while making db call: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(404)
-		w.Write([]byte(errorStr))
-		return
+		return err
 	}
 
-	isCorrect, err := auth.CheckPasswordHash(params.Password, user.HashedPassword)
+	isCorrect, err := cfg.verifyPassword(r.Context(), user, params.Password)
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while making dehashing password: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(500)
-		w.Write([]byte(errorStr))
-		return
+		return err
 	}
 
 	if isCorrect == false {
-		errorStr := "Password is incorrect"
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(401)
-		w.Write([]byte(errorStr))
-		return
+		if err := cfg.recordLoginFailure(r.Context(), throttles, &user); err != nil {
+			return err
+		}
+		if user.HashedPassword == auth.UnsetPasswordHash {
+			cfg.offerPasswordReset(r, user.Email)
+		}
+		return invalidCredentials
 	}
 
-	token, err := auth.MakeJWT(user.ID, cfg.JWTSecret, time.Second * time.Duration(params.ExpiresInSeconds))
+	// Only the account is cleared, an address that guessed its way in is
+	// still counted for the attempts it made against other accounts.
+	err = cfg.DB.DeleteLoginThrottle(r.Context(), throttles[0].key)
 	if err != nil {
-		log.Printf("Error creating JWT token: %v\n", err)
-		w.WriteHeader(500)
-		return
+		return err
 	}
 
-	refreshToken, err := auth.MakeRefreshToken()
+	return cfg.respondWithLoginOrChallenge(w, r, user, params.ExpiresInSeconds)
+}
+
+// respondWithLoginOrChallenge logs user in, or asks for a second factor
+// first if they have two-factor authentication enabled.
+func (cfg *apiConfig) respondWithLoginOrChallenge(w http.ResponseWriter, r *http.Request, user database.User, expiresInSeconds int) error {
+	totp, err := cfg.DB.GetUserTOTP(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err == nil && totp.ConfirmedAt.Valid {
+		return cfg.respondWithMFAChallenge(w, user.ID)
+	}
+
+	return cfg.respondWithLogin(w, r, user, expiresInSeconds)
+}
+
+// respondWithLogin starts a new session for user and sends its tokens. It is
+// the last step of every way to log in.
+func (cfg *apiConfig) respondWithLogin(w http.ResponseWriter, r *http.Request, user database.User, expiresInSeconds int) error {
+	if user.DeletedAt.Valid {
+		err := cfg.restoreDeletedAccount(r.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	refreshToken, sessionID, err := cfg.startSession(r, user.ID)
 	if err != nil {
-		log.Printf("Error creating refresh token: %v\n", err)
-		w.WriteHeader(500)
-		return
+		return err
 	}
 
-	_, err = cfg.DB.CreateRefreshToken(r.Context(), database.CreateRefreshTokenParams{
-		Token: refreshToken,
-		UserID: user.ID,
-		ExpiresAt: time.Now().Add(time.Hour * 24 * 60),
-	})
+	ttl := cfg.TokenTTLs.accessTTL(time.Second * time.Duration(expiresInSeconds))
+	token, expiresAt, err := cfg.makeAccessToken(user.ID, sessionID, ttl)
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while making db call: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(500)
-		w.Write([]byte(errorStr))
-		return
+		return err
 	}
 
-	respSuccess := User{
+	return respondWithJSON(w, 200, User{
 		ID: user.ID,
 		CreatedAt: user.CreatedAt,
 		UpdatedAt: user.UpdatedAt,
 		Email: user.Email,
 		Token: token,
 		RefreshToken: refreshToken,
+		ExpiresAt: &expiresAt,
 		IsChirpyRed: user.IsChirpyRed,
-	}
-	data, err := json.Marshal(respSuccess)
-	if err != nil {
-		log.Printf("Error marshaling data: %v\n", err)
-		w.WriteHeader(500)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(200)
-	w.Write(data)
+		IsEmailVerified: user.EmailVerifiedAt.Valid,
+		Role: user.Role,
+	})
 }
 
-func (cfg *apiConfig) handleRefresh(w http.ResponseWriter, r *http.Request) {
+func (cfg *apiConfig) handleRefresh(w http.ResponseWriter, r *http.Request) error {
 	type ResponseSuccess struct {
-		Token	string	`json:"token"`
+		Token			string		`json:"token"`
+		RefreshToken	string		`json:"refresh_token"`
+		ExpiresAt		time.Time	`json:"expires_at"`
 	}
 
 	refreshToken, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while getting token: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(401)
-		w.Write([]byte(errorStr))
-		return
+		return apierror.Unauthorized("missing or malformed authorization header", err)
 	}
 
-	user, err := cfg.DB.GetUserFromRefreshToken(r.Context(), refreshToken)
+	stored, err := cfg.DB.GetRefreshTokenByHash(r.Context(), auth.HashRefreshToken(refreshToken))
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.Unauthorized("refresh token is invalid", err)
+	}
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while db call: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(401)
-		w.Write([]byte(errorStr))
-		return
+		return err
+	}
+
+	if stored.RevokedAt.Valid {
+		return cfg.handleRevokedRefreshToken(r.Context(), stored)
 	}
 
-	accessToken, err := auth.MakeJWT(user.ID, cfg.JWTSecret, time.Hour)
+	if !stored.ExpiresAt.After(time.Now()) {
+		return apierror.Unauthorized("refresh token has expired", nil)
+	}
+
+	// Revoking only succeeds for the first caller, so of two concurrent
+	// refreshes with the same token only one gets new tokens.
+	revoked, err := cfg.DB.RevokeActiveRefreshToken(r.Context(), stored.ID)
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while creating access token: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(500)
-		w.Write([]byte(errorStr))
-		return
+		return err
+	}
+	if revoked == 0 {
+		return cfg.handleRevokedRefreshToken(r.Context(), stored)
+	}
+
+	accessToken, expiresAt, err := cfg.makeAccessToken(stored.UserID, stored.FamilyID, cfg.TokenTTLs.AccessDefault)
+	if err != nil {
+		return err
+	}
+
+	newRefreshToken, err := cfg.rotateSession(r, stored)
+	if err != nil {
+		return err
 	}
 
-	respSuccess := ResponseSuccess{
+	return respondWithJSON(w, 200, ResponseSuccess{
 		Token: accessToken,
+		RefreshToken: newRefreshToken,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// handleRevokedRefreshToken is called when a revoked refresh token is
+// presented. If it was revoked by rotation, it has a child, and either the
+// client or an attacker holds a stolen copy, so every session derived from
+// the same login is revoked. Tokens revoked by logging out, revoking the
+// session or resetting the password are only rejected.
+func (cfg *apiConfig) handleRevokedRefreshToken(ctx context.Context, stored database.RefreshToken) error {
+	rotated, err := cfg.DB.HasChildRefreshToken(ctx, uuid.NullUUID{UUID: stored.ID, Valid: true})
+	if err != nil {
+		return err
 	}
-	data, err := json.Marshal(respSuccess)
+	if !rotated {
+		return apierror.Unauthorized("refresh token has been revoked", nil)
+	}
+
+	err = cfg.DB.RevokeRefreshTokenFamily(ctx, stored.FamilyID)
 	if err != nil {
-		log.Printf("Error marshaling data: %v\n", err)
-		w.WriteHeader(500)
-		return
+		return err
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(200)
-	w.Write(data)
+
+	log.Printf("Refresh token reuse detected for user %v, revoked family %v\n", stored.UserID, stored.FamilyID)
+	cfg.recordAuditEvent(ctx, stored.UserID, auditRefreshTokenReuse, map[string]any{
+		"family_id": stored.FamilyID,
+		"token_created_at": stored.CreatedAt,
+		"token_revoked_at": stored.RevokedAt.Time,
+	})
+
+	return apierror.Unauthorized("refresh token has been revoked", nil)
 }
 
-func (cfg *apiConfig) handleRevoke(w http.ResponseWriter, r *http.Request) {
+func (cfg *apiConfig) handleRevoke(w http.ResponseWriter, r *http.Request) error {
 	refreshToken, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while getting token: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(401)
-		w.Write([]byte(errorStr))
-		return
+		return apierror.Unauthorized("missing or malformed authorization header", err)
 	}
 
-	err = cfg.DB.RevokeRefreshToken(r.Context(), refreshToken)
+	err = cfg.DB.RevokeRefreshToken(r.Context(), auth.HashRefreshToken(refreshToken))
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while db call: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(401)
-		w.Write([]byte(errorStr))
-		return
+		return err
 	}
 
 	w.WriteHeader(204)
+	return nil
 }
 
-func (cfg *apiConfig) handlePutUsers(w http.ResponseWriter, r *http.Request) {
+// handlePutUsers replaces both the email and the password. It is kept for
+// older clients and goes through the same checks as handlePatchUser.
+func (cfg *apiConfig) handlePutUsers(w http.ResponseWriter, r *http.Request) error {
 	type parameters struct {
-		Email		string	`json:"email"`
-		Password	string	`json:"password"`
+		Email			string	`json:"email"`
+		Password		string	`json:"password"`
+		CurrentPassword	string	`json:"current_password"`
+	}
+
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
 	}
 
-	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	err := decoder.Decode(&params)
+	err := decodeJSON(w, r, &params)
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while decoding request: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(500)
-		w.Write([]byte(errorStr))
-		return
+		return err
 	}
 
-	accessToken, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while getting token: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(401)
-		w.Write([]byte(errorStr))
-		return
+	problems := map[string]string{}
+	if params.Email == "" {
+		problems["email"] = "is required"
+	}
+	if params.Password == "" {
+		problems["password"] = "is required"
+	}
+	if len(problems) > 0 {
+		return apierror.Validation(problems)
 	}
 
-	userID, err := auth.ValidateJWT(accessToken, cfg.JWTSecret)
-	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while validating token: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(401)
-		w.Write([]byte(errorStr))
-		return
+	return cfg.updateUser(w, r, userID, &params.Email, &params.Password, params.CurrentPassword)
+}
+
+// handlePatchUser updates only the fields present in the request. Changing
+// the email or password needs the current password, so a stolen access
+// token alone can't take over the account.
+func (cfg *apiConfig) handlePatchUser(w http.ResponseWriter, r *http.Request) error {
+	type parameters struct {
+		Email			*string	`json:"email"`
+		Password		*string	`json:"password"`
+		CurrentPassword	string	`json:"current_password"`
 	}
 
-	passwordHash, err := auth.HashPassword(params.Password)
-	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while hashing password: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(500)
-		w.Write([]byte(errorStr))
-		return
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
 	}
 
-	user, err := cfg.DB.UpdateUserByID(r.Context(), database.UpdateUserByIDParams{
-		ID: userID,
-		Email: params.Email,
-		HashedPassword: passwordHash,
-	})
+	params := parameters{}
+	err := decodeJSON(w, r, &params)
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while making db call: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(404)
-		w.Write([]byte(errorStr))
-		return
+		return err
 	}
 
-	respSuccess := User{
-		ID: userID,
-		CreatedAt: user.CreatedAt,
-		UpdatedAt: user.UpdatedAt,
-		Email: user.Email,
-		IsChirpyRed: user.IsChirpyRed,
+	return cfg.updateUser(w, r, userID, params.Email, params.Password, params.CurrentPassword)
+}
+
+// updateUser changes the email and password of userID to the ones that
+// aren't nil.
+func (cfg *apiConfig) updateUser(w http.ResponseWriter, r *http.Request, userID uuid.UUID, email, password *string, currentPassword string) error {
+	user, err := cfg.DB.GetUserByID(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.NotFound("user not found", err)
 	}
-	data, err := json.Marshal(respSuccess)
 	if err != nil {
-		log.Printf("Error marshaling data: %v", err)
-		w.WriteHeader(500)
-		return
+		return err
 	}
-	w.Header().Set("Content-type", "application/json")
-	w.WriteHeader(200)
-	w.Write(data)
-}
 
-func (cfg *apiConfig) handleDeleteChirpByID(w http.ResponseWriter, r *http.Request) {
-	chirpIDString := r.PathValue("chirpID")
+	problems := map[string]string{}
+	if email != nil {
+		if problem := validateEmail(*email); problem != "" {
+			problems["email"] = problem
+		}
+	}
+	if password != nil {
+		newEmail := user.Email
+		if email != nil {
+			newEmail = *email
+		}
+		if problem := auth.CheckPasswordStrength(*password, newEmail); problem != "" {
+			problems["password"] = problem
+		}
+	}
+	if (email != nil || password != nil) && currentPassword == "" {
+		problems["current_password"] = "is required to change email or password"
+	}
+	if len(problems) > 0 {
+		return apierror.Validation(problems)
+	}
 
-	chirpID, err := uuid.Parse(chirpIDString)
-	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while parsing uuid: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(500)
-		w.Write([]byte(errorStr))
-		return
+	if currentPassword != "" {
+		isCorrect, err := cfg.verifyPassword(r.Context(), user, currentPassword)
+		if err != nil {
+			return err
+		}
+		if !isCorrect {
+			return apierror.Forbidden("current password is incorrect")
+		}
 	}
 
-	accessToken, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while getting token: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(401)
-		w.Write([]byte(errorStr))
-		return
+	update := database.PatchUserByIDParams{ID: userID}
+	if email != nil && *email != user.Email {
+		update.Email = sql.NullString{String: *email, Valid: true}
+	}
+	if password != nil {
+		passwordHash, err := auth.HashPassword(*password)
+		if err != nil {
+			return err
+		}
+		update.HashedPassword = sql.NullString{String: passwordHash, Valid: true}
 	}
 
-	userID, err := auth.ValidateJWT(accessToken, cfg.JWTSecret)
+	if update.Email.Valid || update.HashedPassword.Valid {
+		user, err = cfg.DB.PatchUserByID(r.Context(), update)
+		if apierror.IsUniqueViolation(err) {
+			return apierror.Conflict("email is already registered", err).WithDetails(map[string]string{
+				"email": "is already registered",
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if update.Email.Valid {
+		cfg.recordAuditEvent(r.Context(), userID, auditEmailChanged, nil)
+		cfg.sendVerificationEmail(r.Context(), user)
+	}
+	if update.HashedPassword.Valid {
+		err = cfg.revokeOtherSessions(r, userID)
+		if err != nil {
+			return err
+		}
+		cfg.recordAuditEvent(r.Context(), userID, auditPasswordChanged, nil)
+	}
+
+	return respondWithJSON(w, 200, User{
+		ID: user.ID,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+		Email: user.Email,
+		IsChirpyRed: user.IsChirpyRed,
+		IsEmailVerified: user.EmailVerifiedAt.Valid,
+		Role: user.Role,
+	})
+}
+
+func (cfg *apiConfig) handleDeleteChirpByID(w http.ResponseWriter, r *http.Request) error {
+	chirpID, err := parseUUIDPathValue(r, "chirpID")
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while validating token: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(401)
-		w.Write([]byte(errorStr))
-		return
+		return err
+	}
+
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
 	}
 
 	chirp, err := cfg.DB.GetChirpByID(r.Context(), chirpID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.NotFound("chirp not found", err)
+	}
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while making db call: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(404)
-		w.Write([]byte(errorStr))
-		return
+		return err
 	}
 
-	if chirp.UserID != userID {
-		errorStr := "Error, you are not a creator of a chirp."
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(403)
-		w.Write([]byte(errorStr))
-		return
+	if chirp.UserID.UUID != userID {
+		return apierror.Forbidden("you are not the author of this chirp")
 	}
 
-	err = cfg.DB.DeleteChirpByID(r.Context(), chirpID)
+	// The chirp is only hidden for now, so the author can still restore it
+	// until purgeDeletedChirps removes it.
+	_, err = cfg.DB.SoftDeleteChirpByID(r.Context(), chirpID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.NotFound("chirp not found", err)
+	}
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while making db call: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(500)
-		w.Write([]byte(errorStr))
-		return
+		return err
 	}
-	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(204)
+	return nil
 }
 
-func (cfg *apiConfig) handlePolkaWebhook(w http.ResponseWriter, r *http.Request) {
+func (cfg *apiConfig) handlePolkaWebhook(w http.ResponseWriter, r *http.Request) error {
 	type parameters struct {
 		Event	string	`json:"event"`
 		Data	struct {
@@ -666,49 +1037,172 @@ func (cfg *apiConfig) handlePolkaWebhook(w http.ResponseWriter, r *http.Request)
 
 	apiKey, err := auth.GetAPIKey(r.Header)
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while getting api key: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(401)
-		w.Write([]byte(errorStr))
-		return
+		return apierror.Unauthorized("missing or malformed authorization header", err)
 	}
 
 	if apiKey != cfg.APIKey {
-		errorStr := "api key is incorrect"
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(401)
-		w.Write([]byte(errorStr))
-		return
+		return apierror.Unauthorized("api key is incorrect", nil)
 	}
 
-	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	err = decoder.Decode(&params)
+	err = decodeJSON(w, r, &params)
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while decoding request: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(500)
-		w.Write([]byte(errorStr))
-		return
+		return err
+	}
+
+	if params.Event == "" {
+		return apierror.Validation(map[string]string{
+			"event": "is required",
+		})
 	}
 
 	if params.Event != "user.upgraded" {
 		w.WriteHeader(204)
-		return
+		return nil
+	}
+
+	if params.Data.UserID == uuid.Nil {
+		return apierror.Validation(map[string]string{
+			"data.user_id": "is required",
+		})
 	}
 
 	_, err = cfg.DB.UpgradeUserChirpyRedByID(r.Context(), database.UpgradeUserChirpyRedByIDParams{
 		ID: params.Data.UserID,
 		IsChirpyRed: true,
 	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.NotFound("user not found", err)
+	}
 	if err != nil {
-		errorStr := fmt.Sprintf("Error occured while making db call: %v\n", err)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(404)
-		w.Write([]byte(errorStr))
-		return
+		return err
 	}
 	w.WriteHeader(204)
+	return nil
+}
+
+// loadJWTKeys builds the key set from JWT_SECRET, JWT_KEYS_DIR and
+// JWT_SIGNING_KEY_ID. Once a signing key is set, tokens signed with
+// JWT_SECRET are only accepted until JWT_SECRET_ACCEPTED_UNTIL, an RFC 3339
+// time.
+func loadJWTKeys(hmacSecret, keysDir, signingKeyID, hmacAcceptedUntil string) (*auth.KeySet, error) {
+	keys := auth.NewKeySet(hmacSecret)
+	if hmacAcceptedUntil != "" {
+		until, err := time.Parse(time.RFC3339, hmacAcceptedUntil)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_SECRET_ACCEPTED_UNTIL: %w", err)
+		}
+		keys.AcceptHMACUntil(until)
+	}
+	if keysDir == "" {
+		return keys, nil
+	}
+	if signingKeyID == "" {
+		log.Printf("Warning: JWT_KEYS_DIR is set without JWT_SIGNING_KEY_ID, tokens are still signed with JWT_SECRET\n")
+	}
+
+	loaded, err := auth.LoadKeyDir(keysDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range loaded {
+		err = keys.Add(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if signingKeyID != "" {
+		err = keys.SetSigningKey(signingKeyID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func (cfg *apiConfig) handleJWKS(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	return respondWithJSON(w, 200, cfg.JWTKeys.JWKS())
+}
+
+func (cfg *apiConfig) routes() http.Handler {
+	authenticator := &auth.Authenticator{
+		Keys: cfg.JWTKeys,
+		Options: cfg.accessTokenOptions(),
+		LookupAPIKey: cfg.lookupAPIKey,
+		CheckUser: cfg.checkUserActive,
+	}
+	// requireUser only accepts access tokens. Routes that personal API keys
+	// may call list the scopes a key needs.
+	requireUser := authenticator.Middleware(auth.Required)
+	requireChirpsWrite := authenticator.Middleware(auth.Required, auth.ScopeChirpsWrite)
+	allowChirpsRead := authenticator.Middleware(auth.Optional, auth.ScopeChirpsRead)
+	// requirePermission authenticates like requireUser and then checks the
+	// user's current role.
+	requirePermission := func(perm auth.Permission) func(http.Handler) http.Handler {
+		authorize := auth.RequirePermission(cfg.lookupRole, perm)
+		return func(next http.Handler) http.Handler {
+			return requireUser(authorize(next))
+		}
+	}
+
+	apiRouter := http.NewServeMux()
+	apiRouter.HandleFunc("GET /healthz", handleHealthz)
+	apiRouter.Handle("POST /users", apierror.HandlerFunc(cfg.handleUsers))
+	apiRouter.Handle("POST /chirps", requireChirpsWrite(apierror.HandlerFunc(cfg.handleCreateChirps)))
+	apiRouter.Handle("GET /chirps", allowChirpsRead(apierror.HandlerFunc(cfg.handleGetChirps)))
+	apiRouter.Handle("GET /chirps/{chirpID}", allowChirpsRead(apierror.HandlerFunc(cfg.handleGetChirpByID)))
+	apiRouter.Handle("PATCH /chirps/{chirpID}", requireChirpsWrite(apierror.HandlerFunc(cfg.handleEditChirp)))
+	apiRouter.Handle("GET /chirps/{chirpID}/revisions", allowChirpsRead(apierror.HandlerFunc(cfg.handleListChirpRevisions)))
+	apiRouter.Handle("GET /chirps/{chirpID}/thread", allowChirpsRead(apierror.HandlerFunc(cfg.handleGetThread)))
+	apiRouter.Handle("POST /chirps/{chirpID}/rechirp", requireChirpsWrite(apierror.HandlerFunc(cfg.handleRechirp)))
+	apiRouter.Handle("DELETE /chirps/{chirpID}/rechirp", requireChirpsWrite(apierror.HandlerFunc(cfg.handleUndoRechirp)))
+	apiRouter.Handle("POST /login", apierror.HandlerFunc(cfg.handleLogin))
+	apiRouter.Handle("POST /login/mfa", apierror.HandlerFunc(cfg.handleLoginMFA))
+	apiRouter.Handle("GET /auth/{provider}/login", apierror.HandlerFunc(cfg.handleOIDCLogin))
+	apiRouter.Handle("GET /auth/{provider}/callback", apierror.HandlerFunc(cfg.handleOIDCCallback))
+	apiRouter.Handle("POST /refresh", apierror.HandlerFunc(cfg.handleRefresh))
+	apiRouter.Handle("POST /revoke", apierror.HandlerFunc(cfg.handleRevoke))
+	apiRouter.Handle("POST /users/verify", apierror.HandlerFunc(cfg.handleVerifyEmail))
+	apiRouter.Handle("POST /users/verify/resend", requireUser(apierror.HandlerFunc(cfg.handleResendVerification)))
+	apiRouter.Handle("POST /password-reset/request", apierror.HandlerFunc(cfg.handleRequestPasswordReset))
+	apiRouter.Handle("POST /password-reset/confirm", apierror.HandlerFunc(cfg.handleConfirmPasswordReset))
+	apiRouter.Handle("PUT /users", requireUser(apierror.HandlerFunc(cfg.handlePutUsers)))
+	apiRouter.Handle("PATCH /users/me", requireUser(apierror.HandlerFunc(cfg.handlePatchUser)))
+	apiRouter.Handle("DELETE /users/me", requireUser(apierror.HandlerFunc(cfg.handleDeleteAccount)))
+	apiRouter.Handle("GET /users/me/export", requireUser(apierror.HandlerFunc(cfg.handleExportAccount)))
+	apiRouter.Handle("POST /users/me/2fa/enroll", requireUser(apierror.HandlerFunc(cfg.handleEnrollTOTP)))
+	apiRouter.Handle("POST /users/me/2fa/confirm", requireUser(apierror.HandlerFunc(cfg.handleConfirmTOTP)))
+	apiRouter.Handle("DELETE /users/me/2fa", requireUser(apierror.HandlerFunc(cfg.handleDisableTOTP)))
+	apiRouter.Handle("DELETE /chirps/{chirpID}", requireChirpsWrite(apierror.HandlerFunc(cfg.handleDeleteChirpByID)))
+	apiRouter.Handle("POST /chirps/{chirpID}/restore", requireChirpsWrite(apierror.HandlerFunc(cfg.handleRestoreChirp)))
+	apiRouter.Handle("GET /sessions", requireUser(apierror.HandlerFunc(cfg.handleListSessions)))
+	apiRouter.Handle("DELETE /sessions/{sessionID}", requireUser(apierror.HandlerFunc(cfg.handleRevokeSession)))
+	apiRouter.Handle("POST /sessions/revoke-all", requireUser(apierror.HandlerFunc(cfg.handleRevokeAllSessions)))
+	apiRouter.Handle("POST /api-keys", requireUser(apierror.HandlerFunc(cfg.handleCreateAPIKey)))
+	apiRouter.Handle("GET /api-keys", requireUser(apierror.HandlerFunc(cfg.handleListAPIKeys)))
+	apiRouter.Handle("DELETE /api-keys/{keyID}", requireUser(apierror.HandlerFunc(cfg.handleRevokeAPIKey)))
+	apiRouter.Handle("POST /admin/bootstrap", requireUser(apierror.HandlerFunc(cfg.handleBootstrapAdmin)))
+	apiRouter.Handle("POST /polka/webhooks", apierror.HandlerFunc(cfg.handlePolkaWebhook))
+
+	// Every admin route needs a permission, most of them one only admins
+	// have.
+	adminRouter := http.NewServeMux()
+	adminRouter.Handle("GET /metrics", requirePermission(auth.PermViewMetrics)(http.HandlerFunc(cfg.handleMetrics)))
+	adminRouter.Handle("POST /reset", requirePermission(auth.PermResetDatabase)(apierror.HandlerFunc(cfg.handleReset)))
+	adminRouter.Handle("POST /users/{userID}/unlock", requirePermission(auth.PermManageUsers)(apierror.HandlerFunc(cfg.handleUnlockUser)))
+	adminRouter.Handle("PUT /users/{userID}/role", requirePermission(auth.PermManageUsers)(apierror.HandlerFunc(cfg.handleSetUserRole)))
+	adminRouter.Handle("GET /chirps/deleted", requirePermission(auth.PermModerateChirps)(apierror.HandlerFunc(cfg.handleListDeletedChirps)))
+	adminRouter.Handle("GET /chirps/{chirpID}", requirePermission(auth.PermModerateChirps)(apierror.HandlerFunc(cfg.handleGetChirpForModeration)))
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /.well-known/jwks.json", apierror.HandlerFunc(cfg.handleJWKS))
+	mux.Handle("GET /app/", http.StripPrefix("/app", cfg.middlewareMetricsInc(http.FileServer(http.Dir(".")))))
+	mux.Handle("/api/", http.StripPrefix("/api", apiRouter))
+	mux.Handle("/admin/", http.StripPrefix("/admin", adminRouter))
+
+	return requestid.Middleware(mux)
 }
 
 func main() {
@@ -721,44 +1215,122 @@ func main() {
 	}
 	dbQueries := database.New(db)
 
-	mux := http.NewServeMux()
-	server := &http.Server{
-		Addr: ":8080",
-		Handler: mux,
-	}
-
 	platform := os.Getenv("PLATFORM")
 	jwtSecret := os.Getenv("JWT_SECRET")
 	apiKey := os.Getenv("POLKA_KEY")
+
+	rules, err := loadModerationRules(context.Background(), dbQueries, os.Getenv("MODERATION_RULES_FILE"))
+	if err != nil {
+		log.Printf("Error loading moderation rules: %v\n", err)
+		return
+	}
+	moderator, err := moderation.NewWordFilter(rules)
+	if err != nil {
+		log.Printf("Error creating moderation filter: %v\n", err)
+		return
+	}
+
+	jwtKeys, err := loadJWTKeys(jwtSecret, os.Getenv("JWT_KEYS_DIR"), os.Getenv("JWT_SIGNING_KEY_ID"), os.Getenv("JWT_SECRET_ACCEPTED_UNTIL"))
+	if err != nil {
+		log.Printf("Error loading JWT keys: %v\n", err)
+		return
+	}
+
+	passwordParams, err := loadPasswordParams()
+	if err != nil {
+		log.Printf("Error loading password hashing parameters: %v\n", err)
+		return
+	}
+	auth.SetPasswordParams(passwordParams)
+
+	ttls, err := loadTokenTTLs()
+	if err != nil {
+		log.Printf("Error loading token lifetimes: %v\n", err)
+		return
+	}
+
+	var mail mailer.Mailer = mailer.LogMailer{}
+	if path := os.Getenv("MAIL_FILE"); path != "" {
+		mail = mailer.NewFileMailer(path)
+	}
+
+	chirpLimits, err := loadChirpLimits()
+	if err != nil {
+		log.Printf("Error loading chirp length limits: %v\n", err)
+		return
+	}
+
+	editWindow, err := loadChirpEditWindow()
+	if err != nil {
+		log.Printf("Error loading chirp edit window: %v\n", err)
+		return
+	}
+
+	gracePeriod, err := loadDeletionGracePeriod()
+	if err != nil {
+		log.Printf("Error loading account deletion grace period: %v\n", err)
+		return
+	}
+
+	chirpGracePeriod, err := loadChirpDeletionGracePeriod()
+	if err != nil {
+		log.Printf("Error loading chirp deletion grace period: %v\n", err)
+		return
+	}
+
+	oidcProviders, err := loadOIDCProviders(context.Background())
+	if err != nil {
+		log.Printf("Error loading OIDC provider: %v\n", err)
+		return
+	}
+
 	cfg := &apiConfig{
 		DB: dbQueries,
+		DBConn: db,
 		Platform: platform,
-		JWTSecret: jwtSecret,
+		JWTKeys: jwtKeys,
+		JWTAudience: os.Getenv("JWT_AUDIENCE"),
+		TokenTTLs: ttls,
 		APIKey: apiKey,
-	}
-
-	apiRouter := http.NewServeMux()
-	apiRouter.HandleFunc("GET /healthz", handleHealthz)
-	apiRouter.HandleFunc("POST /users", cfg.handleUsers)
-	apiRouter.HandleFunc("POST /chirps", cfg.handleCreateChirps)
-	apiRouter.HandleFunc("GET /chirps", cfg.handleGetChirps)
-	apiRouter.HandleFunc("GET /chirps/{chirpID}", cfg.handleGetChirpByID)
-	apiRouter.HandleFunc("POST /login", cfg.handleLogin)
-	apiRouter.HandleFunc("POST /refresh", cfg.handleRefresh)
-	apiRouter.HandleFunc("POST /revoke", cfg.handleRevoke)
-	apiRouter.HandleFunc("PUT /users", cfg.handlePutUsers)
-	apiRouter.HandleFunc("DELETE /chirps/{chirpID}", cfg.handleDeleteChirpByID)
-	apiRouter.HandleFunc("POST /polka/webhooks", cfg.handlePolkaWebhook)
+		BootstrapKey: os.Getenv("ADMIN_BOOTSTRAP_KEY"),
+		Moderator: moderator,
+		Mailer: mail,
+		RequireVerifiedEmail: os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true",
+		AccountLockout: defaultAccountLockout,
+		IPLockout: defaultIPLockout,
+		OIDCProviders: oidcProviders,
+		DeletionGracePeriod: gracePeriod,
+		ChirpLimits: chirpLimits,
+		ChirpEditWindow: editWindow,
+		ChirpDeletionGracePeriod: chirpGracePeriod,
+	}
+	go cfg.runPurgeJobs(context.Background(), defaultPurgeInterval)
 
-	adminRouter := http.NewServeMux()
-	adminRouter.HandleFunc("GET /metrics", cfg.handleMetrics)
-	adminRouter.HandleFunc("POST /reset", cfg.handleReset)
+	server := &http.Server{
+		Addr: ":8080",
+		Handler: cfg.routes(),
+	}
 
-	mux.Handle("GET /app/", http.StripPrefix("/app", cfg.middlewareMetricsInc(http.FileServer(http.Dir(".")))))
-	mux.Handle("/api/", http.StripPrefix("/api", apiRouter))
-	mux.Handle("/admin/", http.StripPrefix("/admin", adminRouter))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		log.Printf("Listening on port: %v\n", server.Addr)
+		err := server.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Error during listen and serve: %v\n", err)
+			stop()
+		}
+	}()
+	<-ctx.Done()
 
-	log.Printf("Listening on port: %v\n", server.Addr)
-	err = server.ListenAndServe()
-	log.Printf("Error during listen and serve: %v\n", err)
+	log.Printf("Shutting down\n")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("Error shutting down server: %v\n", err)
+	}
+	if !cfg.waitForBackground(shutdownCtx) {
+		log.Printf("Background work such as password reset emails did not finish before shutdown\n")
+	}
 }
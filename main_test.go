@@ -0,0 +1,2120 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"grysha11/httpServersGo/internal/apierror"
+	"grysha11/httpServersGo/internal/auth"
+	"grysha11/httpServersGo/internal/chirptext"
+	"grysha11/httpServersGo/internal/database"
+	"grysha11/httpServersGo/internal/mailer"
+	"grysha11/httpServersGo/internal/moderation"
+	"grysha11/httpServersGo/internal/oidc"
+	"grysha11/httpServersGo/internal/oidc/oidctest"
+	"grysha11/httpServersGo/internal/totp"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// stubDriver is a database/sql driver whose queries either return no rows
+// or fail with a fixed error, selected by the DSN. It lets handler tests
+// exercise database error paths without a running Postgres. DSNs registered
+// with stubDSN return canned rows for the queries they name instead, and
+// report one affected row for named exec queries. The arguments of every
+// query are recorded per DSN, see stubArgs.
+type stubDriver struct{}
+
+type stubConn struct {
+	err  error
+	dsn  string
+	rows map[string][]driver.Value
+}
+
+type stubRows struct {
+	row  []driver.Value
+	done bool
+}
+
+var (
+	stubRowsMu   sync.Mutex
+	stubRowsDSN  = map[string]map[string][]driver.Value{}
+	stubCalls    = map[string]map[string][]driver.Value{}
+	stubDSNCount int
+)
+
+func init() {
+	sql.Register("chirpystub", stubDriver{})
+}
+
+// stubDSN returns a DSN whose connections answer the named sqlc queries
+// with a single row each. Every other query returns no rows.
+func stubDSN(t *testing.T, rows map[string][]driver.Value) string {
+	t.Helper()
+
+	stubRowsMu.Lock()
+	stubDSNCount++
+	dsn := fmt.Sprintf("rows:%s:%d", t.Name(), stubDSNCount)
+	stubRowsDSN[dsn] = rows
+	stubRowsMu.Unlock()
+	t.Cleanup(func() {
+		stubRowsMu.Lock()
+		delete(stubRowsDSN, dsn)
+		delete(stubCalls, dsn)
+		stubRowsMu.Unlock()
+	})
+	return dsn
+}
+
+func (stubDriver) Open(dsn string) (driver.Conn, error) {
+	switch dsn {
+	case "unique_violation":
+		return &stubConn{err: &pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint"}}, nil
+	case "broken":
+		return &stubConn{err: errors.New(`pq: relation "users" does not exist`)}, nil
+	}
+
+	stubRowsMu.Lock()
+	defer stubRowsMu.Unlock()
+	return &stubConn{dsn: dsn, rows: stubRowsDSN[dsn]}, nil
+}
+
+// stubArgs returns the arguments of the last call of the named query on a
+// DSN registered with stubDSN.
+func stubArgs(dsn, name string) []driver.Value {
+	stubRowsMu.Lock()
+	defer stubRowsMu.Unlock()
+	return stubCalls[dsn][name]
+}
+
+// record remembers the arguments of a call for stubArgs.
+func (c *stubConn) record(name string, args []driver.NamedValue) {
+	if c.rows == nil {
+		return
+	}
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	stubRowsMu.Lock()
+	if stubCalls[c.dsn] == nil {
+		stubCalls[c.dsn] = map[string][]driver.Value{}
+	}
+	stubCalls[c.dsn][name] = values
+	stubRowsMu.Unlock()
+}
+
+func (c *stubConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("stub driver does not support prepared statements")
+}
+
+func (c *stubConn) Close() error {
+	return nil
+}
+
+func (c *stubConn) Begin() (driver.Tx, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return stubTx{conn: c}, nil
+}
+
+// stubTx records how a transaction ended as a call of COMMIT or ROLLBACK,
+// so tests can check it with stubArgs.
+type stubTx struct {
+	conn *stubConn
+}
+
+func (tx stubTx) Commit() error {
+	tx.conn.record("COMMIT", nil)
+	return nil
+}
+
+func (tx stubTx) Rollback() error {
+	tx.conn.record("ROLLBACK", nil)
+	return nil
+}
+
+func (c *stubConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	name := stubQueryName(query)
+	c.record(name, args)
+	if err := stubRowError(c.rows[name]); err != nil {
+		return nil, err
+	}
+	return &stubRows{row: c.rows[name]}, nil
+}
+
+func (c *stubConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	name := stubQueryName(query)
+	c.record(name, args)
+	if err := stubRowError(c.rows[name]); err != nil {
+		return nil, err
+	}
+	if _, ok := c.rows[name]; ok {
+		return driver.RowsAffected(1), nil
+	}
+	return driver.RowsAffected(0), nil
+}
+
+// stubRowError returns the error a test registered in place of a row, so
+// one query can fail while the others answer.
+func stubRowError(row []driver.Value) error {
+	if len(row) != 1 {
+		return nil
+	}
+	err, _ := row[0].(error)
+	return err
+}
+
+// stubQueryName extracts X from the "-- name: X :one" header sqlc puts in
+// front of every query.
+func stubQueryName(query string) string {
+	fields := strings.Fields(strings.TrimPrefix(query, "-- name:"))
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+func (r *stubRows) Columns() []string {
+	return make([]string, len(r.row))
+}
+
+func (r *stubRows) Close() error {
+	return nil
+}
+
+func (r *stubRows) Next(dest []driver.Value) error {
+	if r.row == nil || r.done {
+		return io.EOF
+	}
+	copy(dest, r.row)
+	r.done = true
+	return nil
+}
+
+const testSecret = "test-secret"
+
+func newTestConfig(t *testing.T, dsn string) *apiConfig {
+	t.Helper()
+
+	db, err := sql.Open("chirpystub", dsn)
+	if err != nil {
+		t.Fatalf("Error opening stub db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	moderator, err := moderation.NewWordFilter(moderation.DefaultRules)
+	if err != nil {
+		t.Fatalf("Error creating moderator: %v", err)
+	}
+
+	return &apiConfig{
+		DB: database.New(db),
+		DBConn: db,
+		Platform: "dev",
+		JWTKeys: auth.NewKeySet(testSecret),
+		APIKey: "polka-key",
+		BootstrapKey: "bootstrap-key",
+		Moderator: moderator,
+		Mailer: &mailer.Recorder{},
+		TokenTTLs: defaultTokenTTLs,
+		AccountLockout: defaultAccountLockout,
+		IPLockout: defaultIPLockout,
+		DeletionGracePeriod: defaultDeletionGracePeriod,
+		ChirpLimits: chirptext.DefaultLimits,
+		ChirpEditWindow: defaultChirpEditWindow,
+		ChirpDeletionGracePeriod: defaultChirpDeletionGracePeriod,
+	}
+}
+
+func testAccessToken(t *testing.T) string {
+	t.Helper()
+
+	token, err := auth.MakeJWT(uuid.New(), auth.NewKeySet(testSecret), time.Hour)
+	if err != nil {
+		t.Fatalf("Error making JWT: %v", err)
+	}
+	return token
+}
+
+func TestHandlerStatusCodes(t *testing.T) {
+	token := testAccessToken(t)
+	chirpID := uuid.NewString()
+	oversized := `{"email": "` + strings.Repeat("a", maxBodyBytes) + `", "password": "x"}`
+	userRole := stubDSN(t, map[string][]driver.Value{"GetUserRole": {"user"}})
+	moderatorRole := stubDSN(t, map[string][]driver.Value{"GetUserRole": {"moderator"}})
+	adminRole := stubDSN(t, map[string][]driver.Value{"GetUserRole": {"admin"}})
+	now := time.Now().UTC()
+	chirpAuthor := stubDSN(t, map[string][]driver.Value{
+		"GetUserByID": {uuid.NewString(), now, now, "a@b.c", "hash", false, now, "user", nil},
+	})
+	currentPassword, err := auth.HashPassword("current password")
+	if err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+	emailTaken := stubDSN(t, map[string][]driver.Value{
+		"GetUserByID": {uuid.NewString(), now, now, "a@b.c", currentPassword, false, now, "user", nil},
+		"PatchUserByID": {&pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint"}},
+	})
+	someoneElsesChirp := stubDSN(t, map[string][]driver.Value{
+		"GetChirpByID": {chirpID, now, now, "hi", uuid.NewString(), nil, false, nil, nil, nil, nil, nil, nil},
+		"GetChirpByIDWithDeleted": {chirpID, now, now, "hi", uuid.NewString(), nil, false, nil, nil, nil, nil, nil, nil},
+	})
+	someoneElsesDeletedChirp := stubDSN(t, map[string][]driver.Value{
+		"GetChirpByIDWithDeleted": {chirpID, now, now, "hi", uuid.NewString(), nil, false, nil, now, nil, nil, nil, nil},
+	})
+
+	cases := []struct {
+		name          string
+		dsn           string
+		method        string
+		path          string
+		body          string
+		authorization string
+		status        int
+		code          string
+		detailField   string
+	}{
+		{"create user malformed json", "", "POST", "/api/users", `{"email": `, "", 400, apierror.CodeInvalidJSON, ""},
+		{"create user wrong type", "", "POST", "/api/users", `{"email": 5, "password": "x"}`, "", 400, apierror.CodeInvalidJSON, ""},
+		{"create user empty body", "", "POST", "/api/users", ``, "", 400, apierror.CodeInvalidJSON, ""},
+		{"create user trailing data", "", "POST", "/api/users", `{"email": "a@b.c", "password": "x"} {}`, "", 400, apierror.CodeInvalidJSON, ""},
+		{"create user unknown field", "", "POST", "/api/users", `{"email": "a@b.c", "password": "x", "admin": true}`, "", 400, apierror.CodeUnknownField, "admin"},
+		{"create user missing email", "", "POST", "/api/users", `{"password": "x"}`, "", 422, apierror.CodeValidation, "email"},
+		{"create user invalid email", "", "POST", "/api/users", `{"email": "not-an-email", "password": "x"}`, "", 422, apierror.CodeValidation, "email"},
+		{"create user email with name", "", "POST", "/api/users", `{"email": "Bob <a@b.c>", "password": "x"}`, "", 422, apierror.CodeValidation, "email"},
+		{"create user missing password", "", "POST", "/api/users", `{"email": "a@b.c"}`, "", 422, apierror.CodeValidation, "password"},
+		{"create user oversized body", "", "POST", "/api/users", oversized, "", 413, apierror.CodeTooLarge, ""},
+		{"create user weak password", "", "POST", "/api/users", `{"email": "a@b.c", "password": "x"}`, "", 422, apierror.CodeValidation, "password"},
+		{"create user common password", "", "POST", "/api/users", `{"email": "a@b.c", "password": "password123"}`, "", 422, apierror.CodeValidation, "password"},
+		{"create user duplicate email", "unique_violation", "POST", "/api/users", `{"email": "a@b.c", "password": "a much better password"}`, "", 409, apierror.CodeConflict, "email"},
+		{"create user db failure", "broken", "POST", "/api/users", `{"email": "a@b.c", "password": "a much better password"}`, "", 500, apierror.CodeInternalError, ""},
+
+		{"login malformed json", "", "POST", "/api/login", `{`, "", 400, apierror.CodeInvalidJSON, ""},
+		{"login missing password", "", "POST", "/api/login", `{"email": "a@b.c"}`, "", 422, apierror.CodeValidation, "password"},
+		{"login negative expiry", "", "POST", "/api/login", `{"email": "a@b.c", "password": "x", "expires_in_seconds": -1}`, "", 422, apierror.CodeValidation, "expires_in_seconds"},
+		{"login db failure", "broken", "POST", "/api/login", `{"email": "a@b.c", "password": "x"}`, "", 500, apierror.CodeInternalError, ""},
+
+		{"verify email missing token", "", "POST", "/api/users/verify", `{}`, "", 422, apierror.CodeValidation, "token"},
+		{"verify email bad token", "", "POST", "/api/users/verify", `{"token": "nope"}`, "", 401, apierror.CodeInvalidToken, ""},
+		{"verify email access token", "", "POST", "/api/users/verify", `{"token": "` + token + `"}`, "", 401, apierror.CodeInvalidToken, ""},
+		{"resend verification no token", "", "POST", "/api/users/verify/resend", ``, "", 401, apierror.CodeUnauthorized, ""},
+
+		{"password reset request invalid email", "", "POST", "/api/password-reset/request", `{"email": "nope"}`, "", 422, apierror.CodeValidation, "email"},
+		{"password reset request db failure", "broken", "POST", "/api/password-reset/request", `{"email": "a@b.c"}`, "", 500, apierror.CodeInternalError, ""},
+		{"password reset confirm missing token", "", "POST", "/api/password-reset/confirm", `{"password": "x"}`, "", 422, apierror.CodeValidation, "token"},
+		{"password reset confirm weak password", "", "POST", "/api/password-reset/confirm", `{"token": "abc", "password": "x"}`, "", 422, apierror.CodeValidation, "password"},
+		{"password reset confirm unknown token", "", "POST", "/api/password-reset/confirm", `{"token": "abc", "password": "a much better password"}`, "", 401, apierror.CodeInvalidToken, ""},
+
+		{"login mfa missing token", "", "POST", "/api/login/mfa", `{"code": "123456"}`, "", 422, apierror.CodeValidation, "mfa_token"},
+		{"login mfa code and recovery code", "", "POST", "/api/login/mfa", `{"mfa_token": "x", "code": "123456", "recovery_code": "abcde-fghjk"}`, "", 422, apierror.CodeValidation, "code"},
+		{"login mfa bad token", "", "POST", "/api/login/mfa", `{"mfa_token": "x", "code": "123456"}`, "", 401, apierror.CodeInvalidToken, ""},
+		{"login mfa access token", "", "POST", "/api/login/mfa", `{"mfa_token": "` + token + `", "code": "123456"}`, "", 401, apierror.CodeInvalidToken, ""},
+		{"enroll totp no token", "", "POST", "/api/users/me/2fa/enroll", ``, "", 401, apierror.CodeUnauthorized, ""},
+		{"enroll totp missing password", chirpAuthor, "POST", "/api/users/me/2fa/enroll", `{}`, "Bearer " + token, 422, apierror.CodeValidation, "current_password"},
+		{"confirm totp missing code", "", "POST", "/api/users/me/2fa/confirm", `{}`, "Bearer " + token, 422, apierror.CodeValidation, "code"},
+		{"confirm totp not enrolled", "", "POST", "/api/users/me/2fa/confirm", `{"code": "123456"}`, "Bearer " + token, 404, apierror.CodeNotFound, ""},
+		{"disable totp missing password", chirpAuthor, "DELETE", "/api/users/me/2fa", `{}`, "Bearer " + token, 422, apierror.CodeValidation, "current_password"},
+
+		{"refresh no token", "", "POST", "/api/refresh", ``, "", 401, apierror.CodeUnauthorized, ""},
+		{"refresh unknown token", "", "POST", "/api/refresh", ``, "Bearer abc123", 401, apierror.CodeUnauthorized, ""},
+
+		{"update user malformed json", "", "PUT", "/api/users", `[]`, "Bearer " + token, 400, apierror.CodeInvalidJSON, ""},
+		{"update user no token", "", "PUT", "/api/users", `{"email": "a@b.c", "password": "x"}`, "", 401, apierror.CodeUnauthorized, ""},
+		{"update user invalid email", chirpAuthor, "PUT", "/api/users", `{"email": "a@", "password": "x"}`, "Bearer " + token, 422, apierror.CodeValidation, "email"},
+		{"update user missing fields", "", "PUT", "/api/users", `{}`, "Bearer " + token, 422, apierror.CodeValidation, "email"},
+		{"update user duplicate email", emailTaken, "PUT", "/api/users", `{"email": "taken@b.c", "password": "a much better password", "current_password": "current password"}`, "Bearer " + token, 409, apierror.CodeConflict, "email"},
+		{"update user not found", "", "PUT", "/api/users", `{"email": "a@b.c", "password": "a much better password"}`, "Bearer " + token, 404, apierror.CodeNotFound, ""},
+
+		{"patch user no token", "", "PATCH", "/api/users/me", `{}`, "", 401, apierror.CodeUnauthorized, ""},
+		{"patch user unknown field", "", "PATCH", "/api/users/me", `{"is_chirpy_red": true}`, "Bearer " + token, 400, apierror.CodeUnknownField, "is_chirpy_red"},
+		{"patch user not found", "", "PATCH", "/api/users/me", `{}`, "Bearer " + token, 404, apierror.CodeNotFound, ""},
+
+		{"create chirp no token", "", "POST", "/api/chirps", `{"body": "hi"}`, "", 401, apierror.CodeUnauthorized, ""},
+		{"create chirp bad token", "", "POST", "/api/chirps", `{"body": "hi"}`, "Bearer nope", 401, apierror.CodeInvalidToken, ""},
+		{"create chirp malformed json", "", "POST", "/api/chirps", `{"body": hi}`, "Bearer " + token, 400, apierror.CodeInvalidJSON, ""},
+		{"create chirp unknown field", "", "POST", "/api/chirps", `{"body": "hi", "user_id": "x"}`, "Bearer " + token, 400, apierror.CodeUnknownField, "user_id"},
+		{"create chirp empty body", chirpAuthor, "POST", "/api/chirps", `{"body": ""}`, "Bearer " + token, 422, apierror.CodeValidation, "body"},
+		{"create chirp blank body", chirpAuthor, "POST", "/api/chirps", `{"body": " \n\t "}`, "Bearer " + token, 422, apierror.CodeValidation, "body"},
+		{"create chirp control character", chirpAuthor, "POST", "/api/chirps", `{"body": "hi\u0007"}`, "Bearer " + token, 422, apierror.CodeValidation, "body"},
+		{"create chirp reply to missing chirp", chirpAuthor, "POST", "/api/chirps", `{"body": "hi", "reply_to_id": "` + chirpID + `"}`, "Bearer " + token, 422, apierror.CodeValidation, "reply_to_id"},
+		{"create chirp quote of missing chirp", chirpAuthor, "POST", "/api/chirps", `{"body": "hi", "quote_of_id": "` + chirpID + `"}`, "Bearer " + token, 422, apierror.CodeValidation, "quote_of_id"},
+		{"create chirp too long", chirpAuthor, "POST", "/api/chirps", `{"body": "` + strings.Repeat("a", 141) + `"}`, "Bearer " + token, 422, apierror.CodeValidation, "body"},
+
+		{"get chirps bad limit", "", "GET", "/api/chirps?limit=0", ``, "", 400, apierror.CodeBadRequest, ""},
+		{"get chirps bad sort", "", "GET", "/api/chirps?sort=sideways", ``, "", 400, apierror.CodeBadRequest, ""},
+		{"get chirps bad cursor", "", "GET", "/api/chirps?cursor=nope", ``, "", 400, apierror.CodeBadRequest, ""},
+		{"get chirps bad author", "", "GET", "/api/chirps?author_id=nope", ``, "", 400, apierror.CodeBadRequest, ""},
+		{"get chirp invalid uuid", "", "GET", "/api/chirps/not-a-uuid", ``, "", 400, apierror.CodeBadRequest, "chirpID"},
+		{"get chirp not found", "", "GET", "/api/chirps/" + chirpID, ``, "", 404, apierror.CodeNotFound, ""},
+
+		{"delete chirp invalid uuid", "", "DELETE", "/api/chirps/not-a-uuid", ``, "Bearer " + token, 400, apierror.CodeBadRequest, "chirpID"},
+		{"delete chirp no token", "", "DELETE", "/api/chirps/" + chirpID, ``, "", 401, apierror.CodeUnauthorized, ""},
+		{"delete chirp not found", "", "DELETE", "/api/chirps/" + chirpID, ``, "Bearer " + token, 404, apierror.CodeNotFound, ""},
+
+		{"edit chirp no token", "", "PATCH", "/api/chirps/" + chirpID, `{"body": "hi"}`, "", 401, apierror.CodeUnauthorized, ""},
+		{"edit chirp unknown field", "", "PATCH", "/api/chirps/" + chirpID, `{"body": "hi", "user_id": "x"}`, "Bearer " + token, 400, apierror.CodeUnknownField, "user_id"},
+		{"edit chirp not found", "", "PATCH", "/api/chirps/" + chirpID, `{"body": "hi"}`, "Bearer " + token, 404, apierror.CodeNotFound, ""},
+		{"edit chirp not author", someoneElsesChirp, "PATCH", "/api/chirps/" + chirpID, `{"body": "hi"}`, "Bearer " + token, 403, apierror.CodeForbidden, ""},
+		{"list revisions invalid uuid", "", "GET", "/api/chirps/nope/revisions", ``, "", 400, apierror.CodeBadRequest, "chirpID"},
+		{"restore chirp no token", "", "POST", "/api/chirps/" + chirpID + "/restore", ``, "", 401, apierror.CodeUnauthorized, ""},
+		{"restore chirp not found", "", "POST", "/api/chirps/" + chirpID + "/restore", ``, "Bearer " + token, 404, apierror.CodeNotFound, ""},
+		{"restore chirp not author", someoneElsesChirp, "POST", "/api/chirps/" + chirpID + "/restore", ``, "Bearer " + token, 403, apierror.CodeForbidden, ""},
+		{"restore deleted chirp not author", someoneElsesDeletedChirp, "POST", "/api/chirps/" + chirpID + "/restore", ``, "Bearer " + token, 404, apierror.CodeNotFound, ""},
+		{"rechirp no token", "", "POST", "/api/chirps/" + chirpID + "/rechirp", ``, "", 401, apierror.CodeUnauthorized, ""},
+		{"rechirp invalid uuid", "", "POST", "/api/chirps/nope/rechirp", ``, "Bearer " + token, 400, apierror.CodeBadRequest, "chirpID"},
+		{"rechirp not found", chirpAuthor, "POST", "/api/chirps/" + chirpID + "/rechirp", ``, "Bearer " + token, 404, apierror.CodeNotFound, ""},
+		{"undo rechirp not found", "", "DELETE", "/api/chirps/" + chirpID + "/rechirp", ``, "Bearer " + token, 404, apierror.CodeNotFound, ""},
+		{"get thread invalid uuid", "", "GET", "/api/chirps/nope/thread", ``, "", 400, apierror.CodeBadRequest, "chirpID"},
+		{"get thread bad cursor", "", "GET", "/api/chirps/" + chirpID + "/thread?cursor=nope", ``, "", 400, apierror.CodeBadRequest, ""},
+		{"get thread not found", "", "GET", "/api/chirps/" + chirpID + "/thread", ``, "", 404, apierror.CodeNotFound, ""},
+		{"list revisions not found", "", "GET", "/api/chirps/" + chirpID + "/revisions", ``, "", 404, apierror.CodeNotFound, ""},
+
+		{"list sessions no token", "", "GET", "/api/sessions", ``, "", 401, apierror.CodeUnauthorized, ""},
+		{"revoke session invalid uuid", "", "DELETE", "/api/sessions/nope", ``, "Bearer " + token, 400, apierror.CodeBadRequest, "sessionID"},
+		{"revoke session not found", "", "DELETE", "/api/sessions/" + chirpID, ``, "Bearer " + token, 404, apierror.CodeNotFound, ""},
+		{"revoke all sessions no token", "", "POST", "/api/sessions/revoke-all", ``, "", 401, apierror.CodeUnauthorized, ""},
+
+		{"create api key no token", "", "POST", "/api/api-keys", `{"name": "bot", "scopes": ["chirps:write"]}`, "", 401, apierror.CodeUnauthorized, ""},
+		{"create api key missing name", "", "POST", "/api/api-keys", `{"scopes": ["chirps:write"]}`, "Bearer " + token, 422, apierror.CodeValidation, "name"},
+		{"create api key unknown scope", "", "POST", "/api/api-keys", `{"name": "bot", "scopes": ["users:delete"]}`, "Bearer " + token, 422, apierror.CodeValidation, "scopes"},
+		{"create api key with api key", "", "POST", "/api/api-keys", `{"name": "bot", "scopes": ["chirps:write"]}`, "ApiKey chirpy_abc_def", 401, apierror.CodeUnauthorized, ""},
+		{"revoke api key not found", "", "DELETE", "/api/api-keys/" + chirpID, ``, "Bearer " + token, 404, apierror.CodeNotFound, ""},
+		{"create chirp unknown api key", "", "POST", "/api/chirps", `{"body": "hi"}`, "ApiKey chirpy_abc_def", 401, apierror.CodeUnauthorized, ""},
+
+		{"webhook wrong key", "", "POST", "/api/polka/webhooks", `{"event": "user.upgraded"}`, "ApiKey wrong", 401, apierror.CodeUnauthorized, ""},
+		{"webhook malformed json", "", "POST", "/api/polka/webhooks", `{"event"`, "ApiKey polka-key", 400, apierror.CodeInvalidJSON, ""},
+		{"webhook missing event", "", "POST", "/api/polka/webhooks", `{"data": {}}`, "ApiKey polka-key", 422, apierror.CodeValidation, "event"},
+		{"webhook missing user", "", "POST", "/api/polka/webhooks", `{"event": "user.upgraded", "data": {}}`, "ApiKey polka-key", 422, apierror.CodeValidation, "data.user_id"},
+		{"webhook unknown user", "", "POST", "/api/polka/webhooks", `{"event": "user.upgraded", "data": {"user_id": "` + chirpID + `"}}`, "ApiKey polka-key", 404, apierror.CodeNotFound, ""},
+
+		{"metrics no token", "", "GET", "/admin/metrics", ``, "", 401, apierror.CodeUnauthorized, ""},
+		{"metrics as user", userRole, "GET", "/admin/metrics", ``, "Bearer " + token, 403, apierror.CodeForbidden, ""},
+		{"metrics deleted user", "", "GET", "/admin/metrics", ``, "Bearer " + token, 401, apierror.CodeUnauthorized, ""},
+		{"reset no token", "", "POST", "/admin/reset", ``, "", 401, apierror.CodeUnauthorized, ""},
+		{"reset as moderator", moderatorRole, "POST", "/admin/reset", ``, "Bearer " + token, 403, apierror.CodeForbidden, ""},
+		{"unlock user no token", "", "POST", "/admin/users/" + chirpID + "/unlock", ``, "", 401, apierror.CodeUnauthorized, ""},
+		{"unlock user old admin key", "", "POST", "/admin/users/" + chirpID + "/unlock", ``, "ApiKey admin-key", 401, apierror.CodeUnauthorized, ""},
+		{"unlock user invalid uuid", adminRole, "POST", "/admin/users/nope/unlock", ``, "Bearer " + token, 400, apierror.CodeBadRequest, "userID"},
+		{"unlock user not found", adminRole, "POST", "/admin/users/" + chirpID + "/unlock", ``, "Bearer " + token, 404, apierror.CodeNotFound, ""},
+		{"set role invalid", adminRole, "PUT", "/admin/users/" + chirpID + "/role", `{"role": "root"}`, "Bearer " + token, 422, apierror.CodeValidation, "role"},
+		{"set role not found", adminRole, "PUT", "/admin/users/" + chirpID + "/role", `{"role": "moderator"}`, "Bearer " + token, 404, apierror.CodeNotFound, ""},
+		{"deleted chirps as user", userRole, "GET", "/admin/chirps/deleted", ``, "Bearer " + token, 403, apierror.CodeForbidden, ""},
+		{"deleted chirps bad cursor", moderatorRole, "GET", "/admin/chirps/deleted?cursor=nope", ``, "Bearer " + token, 400, apierror.CodeBadRequest, ""},
+		{"moderate chirp not found", moderatorRole, "GET", "/admin/chirps/" + chirpID, ``, "Bearer " + token, 404, apierror.CodeNotFound, ""},
+		{"set role as moderator", moderatorRole, "PUT", "/admin/users/" + chirpID + "/role", `{"role": "admin"}`, "Bearer " + token, 403, apierror.CodeForbidden, ""},
+		{"delete account no token", "", "DELETE", "/api/users/me", `{"current_password": "x"}`, "", 401, apierror.CodeUnauthorized, ""},
+		{"delete account missing password", chirpAuthor, "DELETE", "/api/users/me", `{}`, "Bearer " + token, 422, apierror.CodeValidation, "current_password"},
+		{"export account no token", "", "GET", "/api/users/me/export", ``, "", 401, apierror.CodeUnauthorized, ""},
+		{"export account unknown format", "", "GET", "/api/users/me/export?format=xml", ``, "Bearer " + token, 422, apierror.CodeValidation, "format"},
+
+		{"bootstrap admin no token", "", "POST", "/api/admin/bootstrap", `{"bootstrap_key": "bootstrap-key"}`, "", 401, apierror.CodeUnauthorized, ""},
+		{"bootstrap admin missing key", "", "POST", "/api/admin/bootstrap", `{}`, "Bearer " + token, 422, apierror.CodeValidation, "bootstrap_key"},
+		{"bootstrap admin wrong key", "", "POST", "/api/admin/bootstrap", `{"bootstrap_key": "wrong"}`, "Bearer " + token, 401, apierror.CodeUnauthorized, ""},
+		{"bootstrap admin already exists", "", "POST", "/api/admin/bootstrap", `{"bootstrap_key": "bootstrap-key"}`, "Bearer " + token, 409, apierror.CodeConflict, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := newTestConfig(t, c.dsn)
+
+			req := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+			if c.authorization != "" {
+				req.Header.Set("Authorization", c.authorization)
+			}
+			rec := httptest.NewRecorder()
+			cfg.routes().ServeHTTP(rec, req)
+
+			if rec.Code != c.status {
+				t.Fatalf("Expected status %d, got %d: %s", c.status, rec.Code, rec.Body.String())
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Expected application/json error, got %q", ct)
+			}
+
+			resp := apierror.Response{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Error decoding error response: %v", err)
+			}
+			if resp.Code != c.code {
+				t.Errorf("Expected code %q, got %q", c.code, resp.Code)
+			}
+			if resp.RequestID == "" {
+				t.Errorf("Expected request_id to be set")
+			}
+			if c.detailField != "" {
+				if _, ok := resp.Details[c.detailField]; !ok {
+					t.Errorf("Expected details for %q, got %v", c.detailField, resp.Details)
+				}
+			}
+		})
+	}
+}
+
+func TestGetChirpsEmptyPage(t *testing.T) {
+	cfg := newTestConfig(t, "")
+
+	cases := []struct {
+		path     string
+		expected string
+	}{
+		{"/api/chirps", "[]"},
+		{"/api/chirps?limit=10", `{"chirps":[]}`},
+	}
+
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		cfg.routes().ServeHTTP(rec, httptest.NewRequest("GET", c.path, nil))
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s, got %d: %s", c.path, rec.Code, rec.Body.String())
+		}
+		if rec.Body.String() != c.expected {
+			t.Errorf("Expected %s for %s, got %s", c.expected, c.path, rec.Body.String())
+		}
+	}
+}
+
+func TestAccessTTL(t *testing.T) {
+	ttls := tokenTTLs{
+		AccessMin: time.Minute,
+		AccessMax: time.Hour,
+		AccessDefault: 15 * time.Minute,
+	}
+
+	cases := []struct {
+		requested	time.Duration
+		expected	time.Duration
+	}{
+		{0, 15 * time.Minute},
+		{-time.Hour, 15 * time.Minute},
+		{time.Second, time.Minute},
+		{30 * time.Minute, 30 * time.Minute},
+		{365 * 24 * time.Hour, time.Hour},
+	}
+
+	for _, c := range cases {
+		if got := ttls.accessTTL(c.requested); got != c.expected {
+			t.Errorf("Expected %v for requested %v, got %v", c.expected, c.requested, got)
+		}
+	}
+}
+
+func TestLoadTokenTTLs(t *testing.T) {
+	t.Setenv("ACCESS_TOKEN_MAX_TTL", "30m")
+	t.Setenv("ACCESS_TOKEN_DEFAULT_TTL", "10m")
+	t.Setenv("REFRESH_TOKEN_TTL", "168h")
+
+	ttls, err := loadTokenTTLs()
+	if err != nil {
+		t.Fatalf("Error loading TTLs: %v", err)
+	}
+	if ttls.AccessMax != 30*time.Minute || ttls.AccessDefault != 10*time.Minute || ttls.Refresh != 7*24*time.Hour {
+		t.Errorf("Unexpected TTLs: %+v", ttls)
+	}
+	if ttls.AccessMin != defaultTokenTTLs.AccessMin {
+		t.Errorf("Expected default min TTL, got %v", ttls.AccessMin)
+	}
+
+	t.Setenv("ACCESS_TOKEN_DEFAULT_TTL", "2h")
+	if _, err := loadTokenTTLs(); err == nil {
+		t.Error("Expected error for default TTL above max, got nil")
+	}
+
+	t.Setenv("ACCESS_TOKEN_DEFAULT_TTL", "-5m")
+	if _, err := loadTokenTTLs(); err == nil {
+		t.Error("Expected error for negative TTL, got nil")
+	}
+}
+
+func postLogin(t *testing.T, cfg *apiConfig, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest("POST", "/api/login", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestLoginFailuresAreUniform(t *testing.T) {
+	hash, err := auth.HashPassword("correct-password")
+	if err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+	now := time.Now().UTC()
+	failure := []driver.Value{"account:a@b.c", int64(1), now, nil}
+
+	unknown := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"RecordLoginFailure": failure,
+	}))
+	known := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"GetUserByEmail": {uuid.NewString(), now, now, "a@b.c", hash, false, nil, "user", nil},
+		"RecordLoginFailure": failure,
+	}))
+
+	var messages []string
+	for _, cfg := range []*apiConfig{unknown, known} {
+		rec := postLogin(t, cfg, `{"email": "a@b.c", "password": "wrong-password"}`)
+		if rec.Code != 401 {
+			t.Fatalf("Expected status 401, got %d: %s", rec.Code, rec.Body.String())
+		}
+		resp := apierror.Response{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Error decoding error response: %v", err)
+		}
+		messages = append(messages, resp.Code+": "+resp.Message)
+	}
+	if messages[0] != messages[1] {
+		t.Errorf("Expected the same error for unknown user and wrong password, got %q and %q", messages[0], messages[1])
+	}
+}
+
+func TestLoginLockedOut(t *testing.T) {
+	now := time.Now().UTC()
+	cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"GetLoginThrottle": {"account:a@b.c", int64(10), now, now.Add(90 * time.Second)},
+	}))
+
+	rec := postLogin(t, cfg, `{"email": "a@b.c", "password": "x"}`)
+	if rec.Code != 429 {
+		t.Fatalf("Expected status 429, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if retry := rec.Header().Get("Retry-After"); retry != "90" {
+		t.Errorf("Expected Retry-After 90, got %q", retry)
+	}
+
+	resp := apierror.Response{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Error decoding error response: %v", err)
+	}
+	if resp.Code != apierror.CodeTooManyTries {
+		t.Errorf("Expected code %q, got %q", apierror.CodeTooManyTries, resp.Code)
+	}
+}
+
+func TestUnlockUser(t *testing.T) {
+	userID := uuid.NewString()
+	now := time.Now().UTC()
+	cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"GetUserByID": {userID, now, now, "a@b.c", "hash", false, nil, "user", nil},
+		"GetUserRole": {"admin"},
+	}))
+
+	req := httptest.NewRequest("POST", "/admin/users/"+userID+"/unlock", nil)
+	req.Header.Set("Authorization", "Bearer "+testAccessToken(t))
+	rec := httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 204 {
+		t.Fatalf("Expected status 204, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"GetUserRole": {"admin"},
+	}))
+	token := testAccessToken(t)
+
+	cfg.FileserverHits.Store(7)
+	req := httptest.NewRequest("GET", "/admin/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), "7 times") {
+		t.Errorf("Expected metrics for an admin, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Admins still can't wipe a production database.
+	cfg.Platform = "prod"
+	req = httptest.NewRequest("POST", "/admin/reset", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 403 {
+		t.Errorf("Expected status 403 for reset outside dev, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestSetUserRole(t *testing.T) {
+	adminID := uuid.New()
+	userID := uuid.NewString()
+	now := time.Now().UTC()
+	cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"GetUserRole": {"admin"},
+		"SetUserRole": {userID, now, now, "a@b.c", "hash", false, nil, "moderator", nil},
+	}))
+	token, err := auth.MakeJWT(adminID, cfg.JWTKeys, time.Hour)
+	if err != nil {
+		t.Fatalf("Error making JWT: %v", err)
+	}
+
+	req := httptest.NewRequest("PUT", "/admin/users/"+userID+"/role", strings.NewReader(`{"role": "moderator"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	user := User{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if user.Role != "moderator" {
+		t.Errorf("Expected role moderator, got %q", user.Role)
+	}
+
+	req = httptest.NewRequest("PUT", "/admin/users/"+adminID.String()+"/role", strings.NewReader(`{"role": "user"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 403 {
+		t.Errorf("Expected status 403 for an admin demoting themselves, got %d", rec.Code)
+	}
+}
+
+func TestBootstrapAdmin(t *testing.T) {
+	cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"BootstrapAdmin": {},
+	}))
+	token := testAccessToken(t)
+	body := `{"bootstrap_key": "bootstrap-key"}`
+
+	req := httptest.NewRequest("POST", "/api/admin/bootstrap", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 204 {
+		t.Fatalf("Expected status 204, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	cfg.BootstrapKey = ""
+	req = httptest.NewRequest("POST", "/api/admin/bootstrap", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 403 {
+		t.Errorf("Expected status 403 without a bootstrap key configured, got %d", rec.Code)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	userID := uuid.New()
+	now := time.Now().UTC()
+	cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"CreateUser": {userID.String(), now, now, "a@b.c", "hash", false, nil, "user", nil},
+	}))
+
+	req := httptest.NewRequest("POST", "/api/users", strings.NewReader(`{"email": "a@b.c", "password": "a much better password"}`))
+	rec := httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 201 {
+		t.Fatalf("Expected status 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	sent := cfg.Mailer.(*mailer.Recorder).Messages()
+	if len(sent) != 1 || sent[0].To != "a@b.c" {
+		t.Fatalf("Expected one verification email to a@b.c, got %v", sent)
+	}
+	lines := strings.Split(strings.TrimSpace(sent[0].Body), "\n")
+	verifyToken := lines[len(lines)-1]
+
+	claims, err := auth.ParseJWT(verifyToken, cfg.JWTKeys, cfg.emailVerificationOptions())
+	if err != nil {
+		t.Fatalf("Error parsing verification token: %v", err)
+	}
+	if claims.Subject != userID.String() || claims.Email != "a@b.c" {
+		t.Errorf("Unexpected verification claims: %+v", claims)
+	}
+	if _, err := auth.ParseJWT(verifyToken, cfg.JWTKeys, cfg.accessTokenOptions()); err == nil {
+		t.Error("Expected verification token to be rejected as an access token")
+	}
+
+	body := `{"token": "` + verifyToken + `"}`
+	verified := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"VerifyUserEmail": {},
+	}))
+	for _, c := range []struct {
+		cfg    *apiConfig
+		status int
+	}{
+		{verified, 204},
+		// Nothing matches once the token has been used.
+		{cfg, 401},
+	} {
+		req := httptest.NewRequest("POST", "/api/users/verify", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		c.cfg.routes().ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("Expected status %d, got %d: %s", c.status, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestCreateChirpRequiresVerifiedEmail(t *testing.T) {
+	userID := uuid.New()
+	now := time.Now().UTC()
+	cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"GetUserByID": {userID.String(), now, now, "a@b.c", "hash", false, nil, "user", nil},
+	}))
+	cfg.RequireVerifiedEmail = true
+
+	token, err := auth.MakeJWT(userID, cfg.JWTKeys, time.Hour)
+	if err != nil {
+		t.Fatalf("Error making JWT: %v", err)
+	}
+	req := httptest.NewRequest("POST", "/api/chirps", strings.NewReader(`{"body": "hi"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 403 {
+		t.Fatalf("Expected status 403, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestValidateEmail(t *testing.T) {
+	cases := []struct {
+		email string
+		valid bool
+	}{
+		{"a@b.c", true},
+		{"first.last+tag@example.com", true},
+		{"", false},
+		{"plainaddress", false},
+		{"@example.com", false},
+		{"a@", false},
+		{"Bob <bob@example.com>", false},
+		{" bob@example.com", false},
+		{strings.Repeat("a", 251) + "@b.c", false},
+	}
+
+	for _, c := range cases {
+		if got := validateEmail(c.email) == ""; got != c.valid {
+			t.Errorf("Expected valid=%v for %q, got %v", c.valid, c.email, got)
+		}
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	userID := uuid.New()
+	now := time.Now().UTC()
+	user := []driver.Value{userID.String(), now, now, "a@b.c", "hash", false, nil, "user", nil}
+	attempt := []driver.Value{"password-reset:account:a@b.c", int32(1), now, nil}
+
+	// Unknown emails get the same answer and no mail is sent.
+	unknown := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"RecordLoginFailure": attempt,
+	}))
+	req := httptest.NewRequest("POST", "/api/password-reset/request", strings.NewReader(`{"email": "a@b.c"}`))
+	rec := httptest.NewRecorder()
+	unknown.routes().ServeHTTP(rec, req)
+	if rec.Code != 202 {
+		t.Fatalf("Expected status 202 for unknown email, got %d: %s", rec.Code, rec.Body.String())
+	}
+	unknown.background.Wait()
+	if sent := unknown.Mailer.(*mailer.Recorder).Messages(); len(sent) != 0 {
+		t.Errorf("Expected no mail for unknown email, got %v", sent)
+	}
+
+	dsn := stubDSN(t, map[string][]driver.Value{
+		"RecordLoginFailure": attempt,
+		"GetUserByEmail": user,
+		"ConsumePasswordResetToken": {uuid.NewString(), now, "hash", userID.String(), now.Add(time.Hour), now},
+		"UpdateUserPassword": user,
+	})
+	cfg := newTestConfig(t, dsn)
+	req = httptest.NewRequest("POST", "/api/password-reset/request", strings.NewReader(`{"email": "a@b.c"}`))
+	rec = httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 202 {
+		t.Fatalf("Expected status 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	cfg.background.Wait()
+
+	// The stub keeps the last call, which counts the request against the
+	// client after the address.
+	args := stubArgs(dsn, "RecordLoginFailure")
+	if len(args) != 2 || args[0] != "password-reset:ip:192.0.2.1" {
+		t.Errorf("Expected the request to count against the client, got %v", args)
+	}
+
+	sent := cfg.Mailer.(*mailer.Recorder).Messages()
+	if len(sent) != 1 || sent[0].To != "a@b.c" {
+		t.Fatalf("Expected one reset email to a@b.c, got %v", sent)
+	}
+	lines := strings.Split(strings.TrimSpace(sent[0].Body), "\n")
+	resetToken := lines[len(lines)-1]
+
+	req = httptest.NewRequest("POST", "/api/password-reset/confirm", strings.NewReader(`{"token": "`+resetToken+`", "password": "a much better password"}`))
+	rec = httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 204 {
+		t.Fatalf("Expected status 204, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPasswordResetRateLimited(t *testing.T) {
+	now := time.Now().UTC()
+	cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"GetLoginThrottle": {"password-reset:account:a@b.c", int64(5), now, now.Add(time.Minute)},
+	}))
+
+	req := httptest.NewRequest("POST", "/api/password-reset/request", strings.NewReader(`{"email": "a@b.c"}`))
+	rec := httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 429 {
+		t.Fatalf("Expected status 429, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+}
+
+func TestWaitForBackground(t *testing.T) {
+	cfg := newTestConfig(t, "")
+	release := make(chan struct{})
+	cfg.background.Add(1)
+	go func() {
+		defer cfg.background.Done()
+		<-release
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if cfg.waitForBackground(ctx) {
+		t.Error("Expected waiting to time out while work is running")
+	}
+
+	close(release)
+	if !cfg.waitForBackground(context.Background()) {
+		t.Error("Expected waiting to finish once the work is done")
+	}
+}
+
+func TestPasswordResetThrottlesAreSeparate(t *testing.T) {
+	cfg := newTestConfig(t, "")
+	req := httptest.NewRequest("POST", "/api/password-reset/request", nil)
+
+	loginKeys := map[string]bool{}
+	for _, throttle := range cfg.loginThrottles(req, "a@b.c") {
+		loginKeys[throttle.key] = true
+	}
+	for _, throttle := range passwordResetThrottles(req, "a@b.c") {
+		if loginKeys[throttle.key] {
+			t.Errorf("Expected reset requests not to count against login throttle %q", throttle.key)
+		}
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	userID := uuid.New()
+	now := time.Now().UTC()
+	hash, err := auth.HashPassword("current password")
+	if err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+	user := []driver.Value{userID.String(), now, now, "a@b.c", hash, false, now, "user", nil}
+	updated := []driver.Value{userID.String(), now, now, "new@b.c", hash, false, nil, "user", nil}
+
+	dsn := stubDSN(t, map[string][]driver.Value{
+		"GetUserByID": user,
+		"PatchUserByID": updated,
+		"RevokeAllSessions": {},
+	})
+	cfg := newTestConfig(t, dsn)
+	token, err := auth.MakeJWT(userID, cfg.JWTKeys, time.Hour)
+	if err != nil {
+		t.Fatalf("Error making JWT: %v", err)
+	}
+
+	cases := []struct {
+		name        string
+		method      string
+		path        string
+		body        string
+		status      int
+		detailField string
+	}{
+		{"no changes", "PATCH", "/api/users/me", `{}`, 200, ""},
+		{"email without current password", "PATCH", "/api/users/me", `{"email": "new@b.c"}`, 422, "current_password"},
+		{"weak password", "PATCH", "/api/users/me", `{"password": "short", "current_password": "current password"}`, 422, "password"},
+		{"password containing email", "PATCH", "/api/users/me", `{"email": "walter@b.c", "password": "walter-rocks-2024", "current_password": "current password"}`, 422, "password"},
+		{"wrong current password", "PATCH", "/api/users/me", `{"email": "new@b.c", "current_password": "guess"}`, 403, ""},
+		{"change email", "PATCH", "/api/users/me", `{"email": "new@b.c", "current_password": "current password"}`, 200, ""},
+		{"change password", "PATCH", "/api/users/me", `{"password": "a much better password", "current_password": "current password"}`, 200, ""},
+		{"put without current password", "PUT", "/api/users", `{"email": "new@b.c", "password": "a much better password"}`, 422, "current_password"},
+		{"put weak password", "PUT", "/api/users", `{"email": "new@b.c", "password": "short", "current_password": "current password"}`, 422, "password"},
+		{"put wrong current password", "PUT", "/api/users", `{"email": "new@b.c", "password": "a much better password", "current_password": "guess"}`, 403, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			cfg.routes().ServeHTTP(rec, req)
+
+			if rec.Code != c.status {
+				t.Fatalf("Expected status %d, got %d: %s", c.status, rec.Code, rec.Body.String())
+			}
+			if c.detailField != "" {
+				resp := apierror.Response{}
+				if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("Error decoding error response: %v", err)
+				}
+				if _, ok := resp.Details[c.detailField]; !ok {
+					t.Errorf("Expected details for %q, got %v", c.detailField, resp.Details)
+				}
+			}
+		})
+	}
+
+	sent := cfg.Mailer.(*mailer.Recorder).Messages()
+	if len(sent) != 1 || sent[0].To != "new@b.c" {
+		t.Errorf("Expected one verification email to the new address, got %v", sent)
+	}
+	// The token has no session ID, so every session is revoked.
+	if args := stubArgs(dsn, "RevokeAllSessions"); len(args) == 0 || args[0] != userID.String() {
+		t.Errorf("Expected sessions to be revoked after the password change, got %v", args)
+	}
+}
+
+func TestLoginUnsetPasswordLooksLikeWrongPassword(t *testing.T) {
+	now := time.Now().UTC()
+	cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"GetUserByEmail": {uuid.NewString(), now, now, "a@b.c", auth.UnsetPasswordHash, false, nil, "user", nil},
+		"RecordLoginFailure": {"account:a@b.c", int32(1), now, nil},
+	}))
+
+	rec := postLogin(t, cfg, `{"email": "a@b.c", "password": "anything"}`)
+	if rec.Code != 401 {
+		t.Fatalf("Expected status 401, got %d: %s", rec.Code, rec.Body.String())
+	}
+	resp := apierror.Response{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Error decoding error response: %v", err)
+	}
+	if resp.Code != apierror.CodeUnauthorized || resp.Message != "invalid email or password" {
+		t.Errorf("Expected the same error as for a wrong password, got %+v", resp)
+	}
+
+	// Setting a password takes a reset, so one is mailed on the side.
+	cfg.background.Wait()
+	sent := cfg.Mailer.(*mailer.Recorder).Messages()
+	if len(sent) != 1 || sent[0].To != "a@b.c" || sent[0].Subject != "Reset your Chirpy password" {
+		t.Errorf("Expected a password reset email to a@b.c, got %v", sent)
+	}
+}
+
+func TestLoadPasswordParams(t *testing.T) {
+	params, err := loadPasswordParams()
+	if err != nil {
+		t.Fatalf("Error loading params: %v", err)
+	}
+	if params != auth.DefaultPasswordParams {
+		t.Errorf("Expected default params, got %+v", params)
+	}
+
+	t.Setenv("ARGON2_MEMORY_KIB", "131072")
+	t.Setenv("ARGON2_ITERATIONS", "3")
+	t.Setenv("ARGON2_PARALLELISM", "4")
+	params, err = loadPasswordParams()
+	if err != nil {
+		t.Fatalf("Error loading params: %v", err)
+	}
+	expected := auth.PasswordParams{Memory: 131072, Iterations: 3, Parallelism: 4}
+	if params != expected {
+		t.Errorf("Expected %+v, got %+v", expected, params)
+	}
+
+	for name, value := range map[string]string{
+		"ARGON2_ITERATIONS": "0",
+		"ARGON2_PARALLELISM": "300",
+		"ARGON2_MEMORY_KIB": "16",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := loadPasswordParams(); err == nil {
+				t.Errorf("Expected error for %s=%s, got nil", name, value)
+			}
+		})
+	}
+}
+
+func stubRefreshTokenRow(userID uuid.UUID) []driver.Value {
+	now := time.Now().UTC()
+	return []driver.Value{now, now, userID.String(), now.Add(time.Hour), nil, uuid.NewString(), uuid.NewString(), "hash", nil, now, now, "", ""}
+}
+
+func postRefresh(t *testing.T, cfg *apiConfig, refreshToken string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest("POST", "/api/refresh", nil)
+	req.Header.Set("Authorization", "Bearer "+refreshToken)
+	rec := httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRefreshRotatesToken(t *testing.T) {
+	userID := uuid.New()
+	stored := stubRefreshTokenRow(userID)
+	storedID, familyID := stored[6], stored[5]
+	dsn := stubDSN(t, map[string][]driver.Value{
+		"GetRefreshTokenByHash": stored,
+		"RevokeActiveRefreshToken": {},
+		"CreateRefreshToken": stubRefreshTokenRow(userID),
+	})
+	cfg := newTestConfig(t, dsn)
+
+	rec := postRefresh(t, cfg, "old-token")
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	resp := struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if resp.Token == "" || resp.RefreshToken == "" || resp.RefreshToken == "old-token" {
+		t.Errorf("Expected a new access and refresh token, got %+v", resp)
+	}
+
+	if args := stubArgs(dsn, "GetRefreshTokenByHash"); len(args) != 1 || args[0] != auth.HashRefreshToken("old-token") {
+		t.Errorf("Expected the token to be looked up by its hash, got %v", args)
+	}
+	if args := stubArgs(dsn, "RevokeActiveRefreshToken"); len(args) != 1 || args[0] != storedID {
+		t.Errorf("Expected the old token to be revoked, got %v", args)
+	}
+	// CreateRefreshToken takes token_hash, user_id, expires_at, family_id,
+	// parent_id, ...
+	args := stubArgs(dsn, "CreateRefreshToken")
+	if len(args) != 8 || args[0] != auth.HashRefreshToken(resp.RefreshToken) || args[3] != familyID || args[4] != storedID {
+		t.Errorf("Expected the new token to continue the session as a child of the old one, got %v", args)
+	}
+}
+
+func TestRefreshWithRevokedToken(t *testing.T) {
+	userID := uuid.New()
+
+	for _, c := range []struct {
+		name          string
+		rotated       bool
+		familyRevoked bool
+	}{
+		{"rotated token replayed", true, true},
+		{"logged out token", false, false},
+	} {
+		stored := stubRefreshTokenRow(userID)
+		stored[4] = time.Now().UTC()
+		familyID := stored[5]
+		dsn := stubDSN(t, map[string][]driver.Value{
+			"GetRefreshTokenByHash": stored,
+			"HasChildRefreshToken": {c.rotated},
+			"RevokeRefreshTokenFamily": {},
+		})
+		cfg := newTestConfig(t, dsn)
+
+		rec := postRefresh(t, cfg, "old-token")
+		if rec.Code != 401 {
+			t.Fatalf("%s: expected status 401, got %d: %s", c.name, rec.Code, rec.Body.String())
+		}
+
+		args := stubArgs(dsn, "RevokeRefreshTokenFamily")
+		if c.familyRevoked != (len(args) == 1 && args[0] == familyID) {
+			t.Errorf("%s: expected family revoked %v, got %v", c.name, c.familyRevoked, args)
+		}
+		audit := stubArgs(dsn, "CreateAuditEvent")
+		if c.familyRevoked != (len(audit) == 3 && audit[1] == auditRefreshTokenReuse) {
+			t.Errorf("%s: expected reuse audit event %v, got %v", c.name, c.familyRevoked, audit)
+		}
+	}
+}
+
+func TestLoginStoresRefreshTokenHash(t *testing.T) {
+	userID := uuid.New()
+	now := time.Now().UTC()
+	hash, err := auth.HashPassword("correct password")
+	if err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+	dsn := stubDSN(t, map[string][]driver.Value{
+		"GetUserByEmail": {userID.String(), now, now, "a@b.c", hash, false, now, "user", nil},
+		"CreateRefreshToken": stubRefreshTokenRow(userID),
+	})
+	cfg := newTestConfig(t, dsn)
+
+	rec := postLogin(t, cfg, `{"email": "a@b.c", "password": "correct password"}`)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	resp := struct {
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+
+	args := stubArgs(dsn, "CreateRefreshToken")
+	if len(args) != 8 || args[0] != auth.HashRefreshToken(resp.RefreshToken) {
+		t.Fatalf("Expected only the hash of the refresh token to be stored, got %v", args)
+	}
+	for _, arg := range args {
+		if arg == resp.RefreshToken {
+			t.Errorf("Expected the refresh token not to be stored, got %v", args)
+		}
+	}
+}
+
+func TestListSessions(t *testing.T) {
+	userID := uuid.New()
+	session := stubRefreshTokenRow(userID)
+	sessionID, _ := uuid.Parse(session[5].(string))
+
+	for _, c := range []struct {
+		name     string
+		tokenSID uuid.UUID
+		current  bool
+	}{
+		{"current session", sessionID, true},
+		{"other session", uuid.New(), false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dsn := stubDSN(t, map[string][]driver.Value{
+				"ListActiveSessions": session,
+			})
+			cfg := newTestConfig(t, dsn)
+			token, _, err := cfg.makeAccessToken(userID, c.tokenSID, time.Hour)
+			if err != nil {
+				t.Fatalf("Error making JWT: %v", err)
+			}
+
+			req := httptest.NewRequest("GET", "/api/sessions", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			cfg.routes().ServeHTTP(rec, req)
+			if rec.Code != 200 {
+				t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+
+			var sessions []Session
+			if err := json.Unmarshal(rec.Body.Bytes(), &sessions); err != nil {
+				t.Fatalf("Error decoding response: %v", err)
+			}
+			if len(sessions) != 1 || sessions[0].ID != sessionID || sessions[0].Current != c.current {
+				t.Errorf("Expected session %s with current %v, got %+v", sessionID, c.current, sessions)
+			}
+			if args := stubArgs(dsn, "ListActiveSessions"); len(args) != 1 || args[0] != userID.String() {
+				t.Errorf("Expected the sessions of the user to be listed, got %v", args)
+			}
+		})
+	}
+}
+
+func TestRevokeAllSessions(t *testing.T) {
+	userID := uuid.New()
+	dsn := stubDSN(t, map[string][]driver.Value{
+		"RevokeAllSessions": {},
+	})
+	cfg := newTestConfig(t, dsn)
+	token, _, err := cfg.makeAccessToken(userID, uuid.New(), time.Hour)
+	if err != nil {
+		t.Fatalf("Error making JWT: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/sessions/revoke-all", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 204 {
+		t.Fatalf("Expected status 204, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if args := stubArgs(dsn, "RevokeAllSessions"); len(args) != 1 || args[0] != userID.String() {
+		t.Errorf("Expected every session of the user to be revoked, got %v", args)
+	}
+}
+
+func TestTOTPEnrollmentRequiresReauthentication(t *testing.T) {
+	hash, err := auth.HashPassword("correct password")
+	if err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+
+	for _, c := range []struct {
+		name     string
+		path     string
+		hash     string
+		loginAge time.Duration
+		body     string
+		status   int
+	}{
+		{"enroll wrong password", "/api/users/me/2fa/enroll", hash, time.Minute, `{"current_password": "wrong password"}`, 403},
+		{"enroll correct password", "/api/users/me/2fa/enroll", hash, time.Minute, `{"current_password": "correct password"}`, 200},
+		{"enroll without password old login", "/api/users/me/2fa/enroll", auth.UnsetPasswordHash, time.Hour, `{}`, 403},
+		{"enroll without password recent login", "/api/users/me/2fa/enroll", auth.UnsetPasswordHash, time.Minute, `{}`, 200},
+		{"confirm wrong password", "/api/users/me/2fa/confirm", hash, time.Minute, `{"code": "123456", "current_password": "wrong password"}`, 403},
+		{"confirm without password old login", "/api/users/me/2fa/confirm", auth.UnsetPasswordHash, time.Hour, `{"code": "123456"}`, 403},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			userID := uuid.New()
+			now := time.Now().UTC()
+			dsn := stubDSN(t, map[string][]driver.Value{
+				"GetUserByID": {userID.String(), now, now, "a@b.c", c.hash, false, now, "user", nil},
+				"GetSessionStartedAt": {now.Add(-c.loginAge)},
+				"UpsertUserTOTP": {userID.String(), now, "JBSWY3DPEHPK3PXP", nil, int64(0)},
+				"GetUserTOTP": {userID.String(), now, "JBSWY3DPEHPK3PXP", nil, int64(0)},
+			})
+			cfg := newTestConfig(t, dsn)
+			token, _, err := cfg.makeAccessToken(userID, uuid.New(), time.Hour)
+			if err != nil {
+				t.Fatalf("Error making JWT: %v", err)
+			}
+
+			req := httptest.NewRequest("POST", c.path, strings.NewReader(c.body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			cfg.routes().ServeHTTP(rec, req)
+			if rec.Code != c.status {
+				t.Fatalf("Expected status %d, got %d: %s", c.status, rec.Code, rec.Body.String())
+			}
+			if c.status != 200 && stubArgs(dsn, "UpsertUserTOTP") != nil {
+				t.Errorf("Expected no secret to be stored, got %v", stubArgs(dsn, "UpsertUserTOTP"))
+			}
+		})
+	}
+}
+
+func TestConfirmTOTPIsOneTransaction(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Error generating secret: %v", err)
+	}
+
+	for _, c := range []struct {
+		name      string
+		confirmed bool
+		status    int
+		ended     string
+	}{
+		{"confirmed", true, 200, "COMMIT"},
+		{"confirmed concurrently", false, 409, "ROLLBACK"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			userID := uuid.New()
+			now := time.Now().UTC()
+			rows := map[string][]driver.Value{
+				"GetUserByID": {userID.String(), now, now, "a@b.c", auth.UnsetPasswordHash, false, now, "user", nil},
+				"GetSessionStartedAt": {now},
+				"GetUserTOTP": {userID.String(), now, secret, nil, int64(0)},
+			}
+			if c.confirmed {
+				rows["ConfirmUserTOTP"] = []driver.Value{}
+			}
+			dsn := stubDSN(t, rows)
+			cfg := newTestConfig(t, dsn)
+			token, _, err := cfg.makeAccessToken(userID, uuid.New(), time.Hour)
+			if err != nil {
+				t.Fatalf("Error making JWT: %v", err)
+			}
+			code, err := totp.Code(secret, time.Now(), totp.DefaultOptions)
+			if err != nil {
+				t.Fatalf("Error making code: %v", err)
+			}
+
+			req := httptest.NewRequest("POST", "/api/users/me/2fa/confirm", strings.NewReader(`{"code": "`+code+`"}`))
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			cfg.routes().ServeHTTP(rec, req)
+			if rec.Code != c.status {
+				t.Fatalf("Expected status %d, got %d: %s", c.status, rec.Code, rec.Body.String())
+			}
+			for _, end := range []string{"COMMIT", "ROLLBACK"} {
+				if ended := stubArgs(dsn, end) != nil; ended != (end == c.ended) {
+					t.Errorf("Expected the transaction to end with %s, got %s=%v", c.ended, end, ended)
+				}
+			}
+		})
+	}
+}
+
+func TestLoginWithTwoFactor(t *testing.T) {
+	userID := uuid.New()
+	now := time.Now().UTC()
+	hash, err := auth.HashPassword("correct password")
+	if err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Error generating secret: %v", err)
+	}
+	user := []driver.Value{userID.String(), now, now, "a@b.c", hash, false, now, "user", nil}
+
+	cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"GetUserByEmail": user,
+		"GetUserByID": user,
+		"GetUserTOTP": {userID.String(), now, secret, now, int64(0)},
+		"UseTOTPStep": {},
+		"CreateRefreshToken": stubRefreshTokenRow(userID),
+	}))
+
+	rec := postLogin(t, cfg, `{"email": "a@b.c", "password": "correct password"}`)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var challenge map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &challenge); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if challenge["mfa_required"] != true {
+		t.Fatalf("Expected an MFA challenge, got %v", challenge)
+	}
+	if _, ok := challenge["token"]; ok {
+		t.Errorf("Expected no access token before the second step, got %v", challenge)
+	}
+	mfaToken, _ := challenge["mfa_token"].(string)
+
+	code, err := totp.Code(secret, time.Now(), totp.DefaultOptions)
+	if err != nil {
+		t.Fatalf("Error generating code: %v", err)
+	}
+	req := httptest.NewRequest("POST", "/api/login/mfa", strings.NewReader(`{"mfa_token": "`+mfaToken+`", "code": "`+code+`"}`))
+	rec = httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	loggedIn := User{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &loggedIn); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if loggedIn.Token == "" || loggedIn.RefreshToken == "" {
+		t.Errorf("Expected tokens after the second step, got %+v", loggedIn)
+	}
+
+	// A code for a step that was already used is refused.
+	replayed := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"GetUserByID": user,
+		"GetUserTOTP": {userID.String(), now, secret, now, int64(0)},
+		"RecordLoginFailure": {"account:a@b.c", int64(1), now, nil},
+	}))
+	req = httptest.NewRequest("POST", "/api/login/mfa", strings.NewReader(`{"mfa_token": "`+mfaToken+`", "code": "`+code+`"}`))
+	rec = httptest.NewRecorder()
+	replayed.routes().ServeHTTP(rec, req)
+	if rec.Code != 401 {
+		t.Errorf("Expected status 401 for a replayed code, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	seen := map[string]bool{}
+	for range 20 {
+		code := generateRecoveryCode()
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("Unexpected recovery code format %q", code)
+		}
+		if seen[code] {
+			t.Errorf("Duplicate recovery code %q", code)
+		}
+		seen[code] = true
+	}
+
+	if hashRecoveryCode("ABCDE-23456") != hashRecoveryCode("abcde 23456") {
+		t.Error("Expected recovery code hashing to ignore case and separators")
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	userID := uuid.New()
+	now := time.Now().UTC()
+	readOnly := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"TouchAPIKey": {uuid.NewString(), now, userID.String(), "bot", "chirpy_abcdefgh", "hash", "{chirps:read}", now, nil},
+	}))
+
+	cases := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"GET", "/api/chirps", ``, 200},
+		{"POST", "/api/chirps", `{"body": "hi"}`, 403},
+		{"GET", "/api/sessions", ``, 401},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		req.Header.Set("Authorization", "ApiKey chirpy_abcdefgh_secret")
+		rec := httptest.NewRecorder()
+		readOnly.routes().ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("%s %s: expected status %d, got %d: %s", c.method, c.path, c.status, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestCreateAPIKey(t *testing.T) {
+	userID := uuid.New()
+	now := time.Now().UTC()
+	cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"CreateAPIKey": {uuid.NewString(), now, userID.String(), "bot", "chirpy_abcdefgh", "hash", "{chirps:read,chirps:write}", nil, nil},
+	}))
+	token, err := auth.MakeJWT(userID, cfg.JWTKeys, time.Hour)
+	if err != nil {
+		t.Fatalf("Error making JWT: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/api-keys", strings.NewReader(`{"name": "bot", "scopes": ["chirps:write", "chirps:read", "chirps:write"]}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 201 {
+		t.Fatalf("Expected status 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	key := APIKey{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &key); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if !strings.HasPrefix(key.Key, auth.APIKeyPrefix) {
+		t.Errorf("Expected the new key in the response, got %q", key.Key)
+	}
+	if len(key.Scopes) != 2 || key.LastUsedAt != nil {
+		t.Errorf("Unexpected key %+v", key)
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	server := oidctest.NewServer("chirpy", "secret")
+	defer server.Close()
+	server.Email = "oidc@example.com"
+
+	provider, err := oidc.Discover(context.Background(), server.Client(), oidc.Config{
+		Name: "mock",
+		Issuer: server.URL,
+		ClientID: "chirpy",
+		ClientSecret: "secret",
+		RedirectURL: "http://chirpy.test/api/auth/mock/callback",
+	})
+	if err != nil {
+		t.Fatalf("Error discovering provider: %v", err)
+	}
+
+	userID := uuid.New()
+	now := time.Now().UTC()
+	rows := map[string][]driver.Value{
+		"CreateOIDCLoginState": {},
+		"CreateUserWithoutPassword": {userID.String(), now, now, "oidc@example.com", auth.UnsetPasswordHash, false, now, "user", nil},
+		"CreateUserIdentity": {uuid.NewString(), now, userID.String(), "mock", server.Subject, "oidc@example.com"},
+		"CreateRefreshToken": stubRefreshTokenRow(userID),
+	}
+	dsn := stubDSN(t, rows)
+	cfg := newTestConfig(t, dsn)
+	cfg.OIDCProviders = map[string]*oidc.Provider{"mock": provider}
+
+	rec := httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, httptest.NewRequest("GET", "/api/auth/mock/login", nil))
+	if rec.Code != 302 {
+		t.Fatalf("Expected status 302, got %d: %s", rec.Code, rec.Body.String())
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("Expected an http only state cookie, got %v", cookies)
+	}
+
+	// The stub doesn't store anything, so hand the saved state back to the
+	// callback the way the database would.
+	saved := stubArgs(dsn, "CreateOIDCLoginState")
+	if len(saved) != 5 || saved[0] != auth.HashToken(cookies[0].Value) {
+		t.Fatalf("Expected the hashed state to be saved, got %v", saved)
+	}
+	rows["ConsumeOIDCLoginState"] = []driver.Value{saved[0], now, saved[1], saved[2], saved[3], saved[4]}
+
+	client := server.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Error calling authorization endpoint: %v", err)
+	}
+	resp.Body.Close()
+	callback := resp.Header.Get("Location")
+	if !strings.HasPrefix(callback, "http://chirpy.test/api/auth/mock/callback?") {
+		t.Fatalf("Unexpected redirect to %q", callback)
+	}
+
+	// Without the cookie the callback could be completed by someone else.
+	rec = httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, httptest.NewRequest("GET", callback, nil))
+	if rec.Code != 401 {
+		t.Errorf("Expected status 401 without the state cookie, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	req := httptest.NewRequest("GET", callback, nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	loggedIn := User{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &loggedIn); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if loggedIn.ID != userID || loggedIn.Token == "" || loggedIn.RefreshToken == "" {
+		t.Errorf("Expected tokens for the new user, got %+v", loggedIn)
+	}
+	if created := stubArgs(dsn, "CreateUserWithoutPassword"); len(created) != 3 || created[1] != auth.UnsetPasswordHash {
+		t.Errorf("Expected the new user to have no password, got %v", created)
+	}
+}
+
+func TestOIDCLinkingRequiresVerifiedEmails(t *testing.T) {
+	now := time.Now().UTC()
+	user := []driver.Value{uuid.NewString(), now, now, "oidc@example.com", "hash", false, nil, "user", nil}
+	cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"GetUserByEmail": user,
+	}))
+
+	_, err := cfg.userForIdentity(context.Background(), "mock", &oidc.IDTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "subject-1"},
+		Email: "oidc@example.com",
+		EmailVerified: true,
+	})
+	apiErr := apierror.From(err)
+	if apiErr.Status != 409 {
+		t.Errorf("Expected an unverified account not to be linked, got %v", err)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	userID := uuid.New()
+	now := time.Now().UTC()
+	hash, err := auth.HashPassword("correct password")
+	if err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+	cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"GetUserByID": {userID.String(), now, now, "a@b.c", hash, false, nil, "user", nil},
+		"SoftDeleteUser": {userID.String(), now, now, "a@b.c", hash, false, nil, "user", now},
+	}))
+	token, err := auth.MakeJWT(userID, cfg.JWTKeys, time.Hour)
+	if err != nil {
+		t.Fatalf("Error making JWT: %v", err)
+	}
+
+	for _, c := range []struct {
+		password string
+		status   int
+	}{
+		{"wrong password", 403},
+		{"correct password", 202},
+	} {
+		req := httptest.NewRequest("DELETE", "/api/users/me", strings.NewReader(`{"current_password": "`+c.password+`"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		cfg.routes().ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Fatalf("Expected status %d, got %d: %s", c.status, rec.Code, rec.Body.String())
+		}
+		if c.status != 202 {
+			continue
+		}
+
+		var resp struct {
+			PurgeAfter time.Time `json:"purge_after"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Error decoding response: %v", err)
+		}
+		if !resp.PurgeAfter.Equal(now.Add(defaultDeletionGracePeriod)) {
+			t.Errorf("Expected purge after the grace period, got %v", resp.PurgeAfter)
+		}
+	}
+}
+
+func TestDeleteAccountWithoutPassword(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		loginAge time.Duration
+		status   int
+	}{
+		{"recent login", time.Minute, 202},
+		{"old login", time.Hour, 403},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			userID := uuid.New()
+			now := time.Now().UTC()
+			cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+				"GetUserByID": {userID.String(), now, now, "a@b.c", auth.UnsetPasswordHash, false, now, "user", nil},
+				"GetSessionStartedAt": {now.Add(-c.loginAge)},
+				"SoftDeleteUser": {userID.String(), now, now, "a@b.c", auth.UnsetPasswordHash, false, now, "user", now},
+			}))
+			token, _, err := cfg.makeAccessToken(userID, uuid.New(), time.Hour)
+			if err != nil {
+				t.Fatalf("Error making JWT: %v", err)
+			}
+
+			req := httptest.NewRequest("DELETE", "/api/users/me", strings.NewReader(`{}`))
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			cfg.routes().ServeHTTP(rec, req)
+			if rec.Code != c.status {
+				t.Fatalf("Expected status %d, got %d: %s", c.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestDeletedAccountTokenRejected(t *testing.T) {
+	userID := uuid.New()
+	now := time.Now().UTC()
+	cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"GetUserDeletedAt": {now},
+		"GetUserByID": {userID.String(), now, now, "a@b.c", "hash", false, now, "user", now},
+	}))
+	token, err := auth.MakeJWT(userID, cfg.JWTKeys, time.Hour)
+	if err != nil {
+		t.Fatalf("Error making JWT: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/chirps", strings.NewReader(`{"body": "still here"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 401 {
+		t.Fatalf("Expected status 401, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestLoginRestoresDeletedAccount(t *testing.T) {
+	userID := uuid.New()
+	now := time.Now().UTC()
+	hash, err := auth.HashPassword("correct password")
+	if err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+	dsn := stubDSN(t, map[string][]driver.Value{
+		"GetUserByEmail": {userID.String(), now, now, "a@b.c", hash, false, nil, "user", now},
+		"RestoreUser": {},
+		"CreateRefreshToken": stubRefreshTokenRow(userID),
+	})
+	cfg := newTestConfig(t, dsn)
+
+	rec := postLogin(t, cfg, `{"email": "a@b.c", "password": "correct password"}`)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if args := stubArgs(dsn, "RestoreUser"); len(args) != 1 || args[0] != userID.String() {
+		t.Errorf("Expected the account to be restored, got %v", args)
+	}
+}
+
+func TestPurgeDeletedAccounts(t *testing.T) {
+	dsn := stubDSN(t, map[string][]driver.Value{
+		"PurgeDeletedUsers": {},
+	})
+	cfg := newTestConfig(t, dsn)
+
+	if err := cfg.purgeDeletedAccounts(context.Background()); err != nil {
+		t.Fatalf("Error purging: %v", err)
+	}
+	args := stubArgs(dsn, "PurgeDeletedUsers")
+	if len(args) != 1 {
+		t.Fatalf("Expected one argument, got %v", args)
+	}
+	cutoff, _ := args[0].(time.Time)
+	if d := time.Since(cutoff) - defaultDeletionGracePeriod; d < 0 || d > time.Minute {
+		t.Errorf("Expected accounts deleted before the grace period to be purged, got cutoff %v", cutoff)
+	}
+}
+
+func TestExportAccount(t *testing.T) {
+	userID := uuid.New()
+	now := time.Now().UTC()
+	cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"GetUserByID": {userID.String(), now, now, "a@b.c", "hash", true, now, "user", nil},
+		"GetChirpsByAuthor": {uuid.NewString(), now, now, "hello", userID.String(), nil, false, nil, nil, nil, nil, nil, nil},
+		"ListActiveSessions": stubRefreshTokenRow(userID),
+	}))
+	token, err := auth.MakeJWT(userID, cfg.JWTKeys, time.Hour)
+	if err != nil {
+		t.Fatalf("Error making JWT: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/users/me/export", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	export := AccountExport{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &export); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if export.Profile.Email != "a@b.c" || export.Subscription.Plan != "chirpy_red" || len(export.Chirps) != 1 || len(export.Sessions) != 1 {
+		t.Errorf("Unexpected export %+v", export)
+	}
+
+	req = httptest.NewRequest("GET", "/api/users/me/export?format=zip", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("Expected a zip archive, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	archive, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatalf("Error reading archive: %v", err)
+	}
+	var names []string
+	for _, f := range archive.File {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, ",") != "profile.json,subscription.json,chirps.json,sessions.json" {
+		t.Errorf("Unexpected files in archive: %v", names)
+	}
+}
+
+func TestCreateChirpLengthLimits(t *testing.T) {
+	userID := uuid.New()
+	now := time.Now().UTC()
+	body := strings.Repeat("\U0001F44D\U0001F3FD", 200)
+
+	for _, c := range []struct {
+		isChirpyRed bool
+		status      int
+	}{
+		{false, 422},
+		{true, 201},
+	} {
+		cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+			"GetUserByID": {userID.String(), now, now, "a@b.c", "hash", c.isChirpyRed, now, "user", nil},
+			"CreateChirp": {uuid.NewString(), now, now, body, userID.String(), nil, false, nil, nil, nil, nil, nil, nil},
+		}))
+		token, err := auth.MakeJWT(userID, cfg.JWTKeys, time.Hour)
+		if err != nil {
+			t.Fatalf("Error making JWT: %v", err)
+		}
+
+		req := httptest.NewRequest("POST", "/api/chirps", strings.NewReader(`{"body": "`+body+`"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		cfg.routes().ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("Chirpy Red %v: expected status %d, got %d: %s", c.isChirpyRed, c.status, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestEditChirp(t *testing.T) {
+	userID := uuid.New()
+	chirpID := uuid.NewString()
+	now := time.Now().UTC()
+
+	for _, c := range []struct {
+		name     string
+		createdAt time.Time
+		status   int
+	}{
+		{"within window", now.Add(-time.Minute), 200},
+		{"window passed", now.Add(-time.Hour), 403},
+	} {
+		cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+			"GetChirpByID": {chirpID, c.createdAt, c.createdAt, "helo", userID.String(), nil, false, nil, nil, nil, nil, nil, nil},
+			"GetUserByID": {userID.String(), now, now, "a@b.c", "hash", false, now, "user", nil},
+			"EditChirp": {chirpID, c.createdAt, now, "hello", userID.String(), nil, false, now, nil, nil, nil, nil, nil},
+			"CountReplies": {chirpID, int64(2)},
+		}))
+		token, err := auth.MakeJWT(userID, cfg.JWTKeys, time.Hour)
+		if err != nil {
+			t.Fatalf("Error making JWT: %v", err)
+		}
+
+		req := httptest.NewRequest("PATCH", "/api/chirps/"+chirpID, strings.NewReader(`{"body": "hello"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		cfg.routes().ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Fatalf("%s: expected status %d, got %d: %s", c.name, c.status, rec.Code, rec.Body.String())
+		}
+		if c.status != 200 {
+			continue
+		}
+
+		chirp := Chirp{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &chirp); err != nil {
+			t.Fatalf("Error decoding response: %v", err)
+		}
+		if chirp.Body != "hello" || !chirp.Edited || chirp.ReplyCount != 2 {
+			t.Errorf("%s: unexpected chirp %+v", c.name, chirp)
+		}
+	}
+}
+
+func TestRestoreChirp(t *testing.T) {
+	userID := uuid.New()
+	chirpID := uuid.NewString()
+	now := time.Now().UTC()
+
+	for _, c := range []struct {
+		name     string
+		deletedAt any
+		status   int
+	}{
+		{"deleted", now.Add(-time.Hour), 200},
+		{"not deleted", nil, 409},
+	} {
+		cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+			"GetChirpByIDWithDeleted": {chirpID, now, now, "hello", userID.String(), nil, false, nil, c.deletedAt, nil, nil, nil, nil},
+			"RestoreChirpByID": {chirpID, now, now, "hello", userID.String(), nil, false, nil, nil, nil, nil, nil, nil},
+			"CountReplies": {chirpID, int64(2)},
+		}))
+		token, err := auth.MakeJWT(userID, cfg.JWTKeys, time.Hour)
+		if err != nil {
+			t.Fatalf("Error making JWT: %v", err)
+		}
+
+		req := httptest.NewRequest("POST", "/api/chirps/"+chirpID+"/restore", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		cfg.routes().ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Fatalf("%s: expected status %d, got %d: %s", c.name, c.status, rec.Code, rec.Body.String())
+		}
+		if c.status == 200 && strings.Contains(rec.Body.String(), "deleted_at") {
+			t.Errorf("%s: expected the restored chirp not to be deleted, got %s", c.name, rec.Body.String())
+		}
+		if c.status == 200 && !strings.Contains(rec.Body.String(), `"reply_count":2`) {
+			t.Errorf("%s: expected the restored chirp to be expanded, got %s", c.name, rec.Body.String())
+		}
+	}
+}
+
+func TestGetThread(t *testing.T) {
+	rootID := uuid.NewString()
+	chirpID := uuid.NewString()
+	now := time.Now().UTC()
+	cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"GetChirpByID": {chirpID, now, now, "hi", uuid.NewString(), nil, false, nil, nil, rootID, rootID, nil, nil},
+		"ListChirpAncestors": {rootID, now, now, "", uuid.NewString(), nil, false, nil, now, nil, nil, nil, nil},
+		"ListChirpDescendants": {uuid.NewString(), now, now, "hello", uuid.NewString(), nil, false, nil, nil, chirpID, rootID, nil, nil},
+		"CountReplies": {chirpID, int64(1)},
+	}))
+
+	req := httptest.NewRequest("GET", "/api/chirps/"+chirpID+"/thread", nil)
+	rec := httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	thread := struct {
+		Ancestors []map[string]any `json:"ancestors"`
+		Chirp     Chirp            `json:"chirp"`
+		Replies   []Chirp          `json:"replies"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &thread); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if len(thread.Ancestors) != 1 || thread.Ancestors[0]["deleted"] != true || thread.Ancestors[0]["body"] != nil {
+		t.Errorf("Expected the deleted root to be a tombstone, got %v", thread.Ancestors)
+	}
+	if thread.Chirp.ReplyCount != 1 || thread.Chirp.RootID == nil || thread.Chirp.RootID.String() != rootID {
+		t.Errorf("Unexpected chirp %+v", thread.Chirp)
+	}
+	if len(thread.Replies) != 1 || thread.Replies[0].ParentID == nil || thread.Replies[0].ParentID.String() != chirpID {
+		t.Errorf("Unexpected replies %+v", thread.Replies)
+	}
+}
+
+func TestGetThreadWithPurgedAuthor(t *testing.T) {
+	rootID := uuid.NewString()
+	chirpID := uuid.NewString()
+	now := time.Now().UTC()
+	// Purging an account keeps its replied-to chirps as tombstones without
+	// an author.
+	cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"GetChirpByID": {chirpID, now, now, "hi", uuid.NewString(), nil, false, nil, nil, rootID, rootID, nil, nil},
+		"ListChirpAncestors": {rootID, now, now, "", nil, nil, false, nil, now, nil, nil, nil, nil},
+	}))
+
+	req := httptest.NewRequest("GET", "/api/chirps/"+chirpID+"/thread", nil)
+	rec := httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	thread := struct {
+		Ancestors []map[string]any `json:"ancestors"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &thread); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if len(thread.Ancestors) != 1 || thread.Ancestors[0]["id"] != rootID || thread.Ancestors[0]["deleted"] != true {
+		t.Errorf("Expected the purged root to be a tombstone, got %v", thread.Ancestors)
+	}
+}
+
+func TestRechirp(t *testing.T) {
+	userID := uuid.New()
+	originalID := uuid.NewString()
+	now := time.Now().UTC()
+	original := []driver.Value{originalID, now, now, "hi", uuid.NewString(), nil, false, nil, nil, nil, nil, nil, nil}
+	rechirp := []driver.Value{uuid.NewString(), now, now, "", userID.String(), nil, false, nil, nil, nil, nil, originalID, nil}
+
+	for _, c := range []struct {
+		name     string
+		existing []driver.Value
+		status   int
+	}{
+		{"new", nil, 201},
+		{"again", rechirp, 200},
+	} {
+		cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+			"GetUserByID": {userID.String(), now, now, "a@b.c", "hash", false, now, "user", nil},
+			"GetChirpByID": original,
+			"GetRechirp": c.existing,
+			"CreateRechirp": rechirp,
+			"ListChirpsByIDs": original,
+		}))
+		token, err := auth.MakeJWT(userID, cfg.JWTKeys, time.Hour)
+		if err != nil {
+			t.Fatalf("Error making JWT: %v", err)
+		}
+
+		req := httptest.NewRequest("POST", "/api/chirps/"+originalID+"/rechirp", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		cfg.routes().ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Fatalf("%s: expected status %d, got %d: %s", c.name, c.status, rec.Code, rec.Body.String())
+		}
+
+		chirp := Chirp{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &chirp); err != nil {
+			t.Fatalf("Error decoding response: %v", err)
+		}
+		if chirp.RechirpOf == nil || chirp.RechirpOf.ID.String() != originalID || chirp.RechirpOf.Body != "hi" {
+			t.Errorf("%s: expected the original chirp to be inlined, got %+v", c.name, chirp)
+		}
+	}
+}
+
+func TestUndoRechirp(t *testing.T) {
+	userID := uuid.New()
+	originalID := uuid.NewString()
+	now := time.Now().UTC()
+	dsn := stubDSN(t, map[string][]driver.Value{
+		"GetChirpByIDWithDeleted": {originalID, now, now, "hi", uuid.NewString(), nil, false, nil, now, nil, nil, nil, nil},
+		"DeleteRechirp": {},
+	})
+	cfg := newTestConfig(t, dsn)
+	token, err := auth.MakeJWT(userID, cfg.JWTKeys, time.Hour)
+	if err != nil {
+		t.Fatalf("Error making JWT: %v", err)
+	}
+
+	req := httptest.NewRequest("DELETE", "/api/chirps/"+originalID+"/rechirp", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 204 {
+		t.Fatalf("Expected status 204, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if args := stubArgs(dsn, "DeleteRechirp"); len(args) != 2 || args[0] != originalID || args[1] != userID.String() {
+		t.Errorf("Expected the user's rechirp of the deleted chirp to be removed, got %v", args)
+	}
+}
+
+func TestModeratorSeesOriginalBody(t *testing.T) {
+	chirpID := uuid.New()
+	now := time.Now().UTC()
+	cfg := newTestConfig(t, stubDSN(t, map[string][]driver.Value{
+		"GetUserRole": {"moderator"},
+		"GetChirpByIDWithDeleted": {chirpID.String(), now, now, "what a ****", uuid.NewString(), "what a kerfuffle", true, nil, now, nil, nil, nil, nil},
+	}))
+	token, err := auth.MakeJWT(uuid.New(), cfg.JWTKeys, time.Hour)
+	if err != nil {
+		t.Fatalf("Error making JWT: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/admin/chirps/"+chirpID.String(), nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	cfg.routes().ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var resp struct {
+		Body         string `json:"body"`
+		OriginalBody string `json:"original_body"`
+		Flagged      bool   `json:"flagged"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if resp.Body != "what a ****" || resp.OriginalBody != "what a kerfuffle" || !resp.Flagged {
+		t.Errorf("Expected the original body and flag, got %+v", resp)
+	}
+}
+
+func TestPurgeDeletedChirps(t *testing.T) {
+	dsn := stubDSN(t, map[string][]driver.Value{
+		"PurgeDeletedChirps": {},
+	})
+	cfg := newTestConfig(t, dsn)
+
+	if err := cfg.purgeDeletedChirps(context.Background()); err != nil {
+		t.Fatalf("Error purging: %v", err)
+	}
+	args := stubArgs(dsn, "PurgeDeletedChirps")
+	if len(args) != 1 {
+		t.Fatalf("Expected one argument, got %v", args)
+	}
+	cutoff, _ := args[0].(time.Time)
+	if d := time.Since(cutoff) - defaultChirpDeletionGracePeriod; d < 0 || d > time.Minute {
+		t.Errorf("Expected chirps deleted before the grace period to be purged, got cutoff %v", cutoff)
+	}
+}
+
+func TestLoadChirpLimits(t *testing.T) {
+	t.Setenv("CHIRP_MAX_LENGTH", "200")
+	limits, err := loadChirpLimits()
+	if err != nil {
+		t.Fatalf("Error loading limits: %v", err)
+	}
+	if limits.Default != 200 || limits.ChirpyRed != chirptext.DefaultLimits.ChirpyRed {
+		t.Errorf("Unexpected limits %+v", limits)
+	}
+
+	t.Setenv("CHIRP_MAX_LENGTH_CHIRPY_RED", "100")
+	if _, err := loadChirpLimits(); err == nil {
+		t.Error("Expected an error for a Chirpy Red limit below the default")
+	}
+}
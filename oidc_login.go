@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"grysha11/httpServersGo/internal/apierror"
+	"grysha11/httpServersGo/internal/auth"
+	"grysha11/httpServersGo/internal/database"
+	"grysha11/httpServersGo/internal/oidc"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// oidcStateTTL is how long the user has to sign in at the provider.
+const oidcStateTTL = 10 * time.Minute
+
+const oidcStateCookie = "chirpy_oidc_state"
+
+// loadOIDCProviders discovers the provider configured through the OIDC_*
+// environment variables. Without OIDC_ISSUER external login is disabled.
+func loadOIDCProviders(ctx context.Context) (map[string]*oidc.Provider, error) {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+
+	name := os.Getenv("OIDC_PROVIDER")
+	if name == "" {
+		name = "oidc"
+	}
+	provider, err := oidc.Discover(ctx, nil, oidc.Config{
+		Name: name,
+		Issuer: issuer,
+		ClientID: os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL: os.Getenv("OIDC_REDIRECT_URL"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]*oidc.Provider{name: provider}, nil
+}
+
+func (cfg *apiConfig) oidcProvider(r *http.Request) (*oidc.Provider, error) {
+	provider, ok := cfg.OIDCProviders[r.PathValue("provider")]
+	if !ok {
+		return nil, apierror.NotFound("identity provider not found", nil)
+	}
+	return provider, nil
+}
+
+// handleOIDCLogin sends the user to the provider. The state, nonce and PKCE
+// verifier are kept server side, and the state is also set as a cookie so
+// the callback can only be completed by the browser that started the login.
+func (cfg *apiConfig) handleOIDCLogin(w http.ResponseWriter, r *http.Request) error {
+	provider, err := cfg.oidcProvider(r)
+	if err != nil {
+		return err
+	}
+
+	err = cfg.DB.DeleteExpiredOIDCLoginStates(r.Context())
+	if err != nil {
+		return err
+	}
+
+	state := oidc.RandomString()
+	nonce := oidc.RandomString()
+	verifier := oidc.RandomString()
+	err = cfg.DB.CreateOIDCLoginState(r.Context(), database.CreateOIDCLoginStateParams{
+		StateHash: auth.HashToken(state),
+		Provider: provider.Name,
+		Nonce: nonce,
+		CodeVerifier: verifier,
+		ExpiresAt: time.Now().UTC().Add(oidcStateTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name: oidcStateCookie,
+		Value: state,
+		Path: "/api/auth/" + provider.Name,
+		MaxAge: int(oidcStateTTL / time.Second),
+		HttpOnly: true,
+		Secure: r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, provider.AuthCodeURL(state, nonce, verifier), http.StatusFound)
+	return nil
+}
+
+// handleOIDCCallback finishes the authorization code flow and logs the user
+// in with the same tokens handleLogin issues.
+func (cfg *apiConfig) handleOIDCCallback(w http.ResponseWriter, r *http.Request) error {
+	provider, err := cfg.oidcProvider(r)
+	if err != nil {
+		return err
+	}
+
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		return apierror.Unauthorized("identity provider refused the login: "+providerErr, nil)
+	}
+	state := query.Get("state")
+	code := query.Get("code")
+	if state == "" || code == "" {
+		return apierror.BadRequest("state and code are required", nil)
+	}
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return apierror.Unauthorized("login state does not match this browser", err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name: oidcStateCookie,
+		Path: "/api/auth/" + provider.Name,
+		MaxAge: -1,
+	})
+
+	// Deleting the state makes every login attempt single use.
+	stored, err := cfg.DB.ConsumeOIDCLoginState(r.Context(), auth.HashToken(state))
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.Unauthorized("login state is invalid", err)
+	}
+	if err != nil {
+		return err
+	}
+	if stored.Provider != provider.Name || !stored.ExpiresAt.After(time.Now()) {
+		return apierror.Unauthorized("login state has expired", nil)
+	}
+
+	rawIDToken, err := provider.Exchange(r.Context(), code, stored.CodeVerifier)
+	if err != nil {
+		return apierror.Unauthorized("authorization code was rejected", err)
+	}
+	claims, err := provider.VerifyIDToken(r.Context(), rawIDToken, stored.Nonce)
+	if err != nil {
+		return apierror.Unauthorized("id token is invalid", err)
+	}
+
+	user, err := cfg.userForIdentity(r.Context(), provider.Name, claims)
+	if err != nil {
+		return err
+	}
+
+	return cfg.respondWithLoginOrChallenge(w, r, user, 0)
+}
+
+// userForIdentity finds the user linked to the provider account, linking or
+// creating one on the first login. An existing account is only linked when
+// both sides have verified the address, otherwise whoever registered the
+// address first could take over the other account.
+func (cfg *apiConfig) userForIdentity(ctx context.Context, providerName string, claims *oidc.IDTokenClaims) (database.User, error) {
+	user, err := cfg.DB.GetUserByIdentity(ctx, database.GetUserByIdentityParams{
+		Provider: providerName,
+		Subject: claims.Subject,
+	})
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return database.User{}, err
+	}
+
+	email := strings.TrimSpace(claims.Email)
+	if validateEmail(email) != "" {
+		return database.User{}, apierror.Forbidden("identity provider did not share a usable email address")
+	}
+
+	user, err = cfg.DB.GetUserByEmail(ctx, email)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		verifiedAt := sql.NullTime{}
+		if claims.EmailVerified {
+			verifiedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+		}
+		user, err = cfg.DB.CreateUserWithoutPassword(ctx, database.CreateUserWithoutPasswordParams{
+			Email: email,
+			HashedPassword: auth.UnsetPasswordHash,
+			EmailVerifiedAt: verifiedAt,
+		})
+		if apierror.IsUniqueViolation(err) {
+			return database.User{}, apierror.Conflict("email already in use", err)
+		}
+		if err != nil {
+			return database.User{}, err
+		}
+	case err != nil:
+		return database.User{}, err
+	case !claims.EmailVerified || !user.EmailVerifiedAt.Valid:
+		return database.User{}, apierror.Conflict("an account with this email already exists, log in with your password first", nil)
+	}
+
+	_, err = cfg.DB.CreateUserIdentity(ctx, database.CreateUserIdentityParams{
+		UserID: user.ID,
+		Provider: providerName,
+		Subject: claims.Subject,
+		Email: email,
+	})
+	if apierror.IsUniqueViolation(err) {
+		return database.User{}, apierror.Conflict("identity is already linked", err)
+	}
+	if err != nil {
+		return database.User{}, err
+	}
+	cfg.recordAuditEvent(ctx, user.ID, auditIdentityLinked, map[string]any{
+		"provider": providerName,
+		"subject": claims.Subject,
+	})
+	return user, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"grysha11/httpServersGo/internal/apierror"
+	"grysha11/httpServersGo/internal/auth"
+	"grysha11/httpServersGo/internal/database"
+	"grysha11/httpServersGo/internal/mailer"
+	"log"
+	"net/http"
+	"time"
+)
+
+const passwordResetTTL = time.Hour
+
+// defaultPasswordResetEmailLimit keeps a single address from being flooded
+// with reset emails.
+var defaultPasswordResetEmailLimit = auth.LockoutPolicy{
+	FreeAttempts: 3,
+	BaseDelay: time.Minute,
+	MaxDelay: time.Hour,
+	ResetAfter: time.Hour,
+}
+
+// defaultPasswordResetIPLimit keeps one client from requesting resets for
+// many addresses.
+var defaultPasswordResetIPLimit = auth.LockoutPolicy{
+	FreeAttempts: 10,
+	BaseDelay: time.Minute,
+	MaxDelay: time.Hour,
+	ResetAfter: time.Hour,
+}
+
+// passwordResetThrottles have keys of their own, so reset requests never
+// lock anyone out of logging in.
+func passwordResetThrottles(r *http.Request, email string) []throttle {
+	return []throttle{
+		{key: "password-reset:" + accountThrottleKey(email), policy: defaultPasswordResetEmailLimit},
+		{key: "password-reset:ip:" + clientIP(r), policy: defaultPasswordResetIPLimit},
+	}
+}
+
+// handleRequestPasswordReset mails a reset token if the email belongs to an
+// account. It always answers 202 so it can't be used to find out which
+// emails are registered.
+func (cfg *apiConfig) handleRequestPasswordReset(w http.ResponseWriter, r *http.Request) error {
+	type parameters struct {
+		Email	string	`json:"email"`
+	}
+
+	params := parameters{}
+	err := decodeJSON(w, r, &params)
+	if err != nil {
+		return err
+	}
+
+	if problem := validateEmail(params.Email); problem != "" {
+		return apierror.Validation(map[string]string{
+			"email": problem,
+		})
+	}
+
+	// Every request counts against the limits, whether or not the email is
+	// registered, so they don't give that away either.
+	throttles := passwordResetThrottles(r, params.Email)
+	err = cfg.checkThrottles(w, r, throttles, "too many password reset requests, try again later")
+	if err != nil {
+		return err
+	}
+	err = cfg.countAttempts(r.Context(), throttles)
+	if err != nil {
+		return err
+	}
+
+	// The account lookup and the email happen after answering, so known and
+	// unknown emails take the same time.
+	cfg.inBackground(r, func(ctx context.Context) {
+		cfg.sendPasswordReset(ctx, params.Email)
+	})
+
+	w.WriteHeader(202)
+	return nil
+}
+
+// offerPasswordReset mails a reset token to an account without a password
+// that someone tried to log in to with one, since a reset is the only way
+// to set it. It counts against the same throttles as reset requests and
+// quietly does nothing while they are locked. All of it happens in the
+// background so the login answers as fast as for any wrong password.
+func (cfg *apiConfig) offerPasswordReset(r *http.Request, email string) {
+	throttles := passwordResetThrottles(r, email)
+	cfg.inBackground(r, func(ctx context.Context) {
+		retryAfter, err := cfg.throttleRetryAfter(ctx, throttles)
+		if err != nil {
+			log.Printf("Error checking password reset throttles: %v\n", err)
+			return
+		}
+		if retryAfter > 0 {
+			return
+		}
+		err = cfg.countAttempts(ctx, throttles)
+		if err != nil {
+			log.Printf("Error counting password reset attempt: %v\n", err)
+			return
+		}
+		cfg.sendPasswordReset(ctx, email)
+	})
+}
+
+// sendPasswordReset creates a reset token and mails it if the email belongs
+// to an account. The request has already been answered, so errors are only
+// logged.
+func (cfg *apiConfig) sendPasswordReset(ctx context.Context, email string) {
+	user, err := cfg.DB.GetUserByEmail(ctx, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up user for password reset: %v\n", err)
+		return
+	}
+
+	token, err := auth.MakeRefreshToken()
+	if err != nil {
+		log.Printf("Error making password reset token for user %v: %v\n", user.ID, err)
+		return
+	}
+	err = cfg.DB.CreatePasswordResetToken(ctx, database.CreatePasswordResetTokenParams{
+		TokenHash: auth.HashToken(token),
+		UserID: user.ID,
+		ExpiresAt: time.Now().UTC().Add(passwordResetTTL),
+	})
+	if err != nil {
+		log.Printf("Error saving password reset token for user %v: %v\n", user.ID, err)
+		return
+	}
+
+	err = cfg.Mailer.Send(ctx, mailer.Message{
+		To: user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf("Someone asked to reset the password for this account. If it was you, send the token below with a new password to POST /api/password-reset/confirm.\nIt expires in %v and can only be used once.\n\n%s\n", passwordResetTTL, token),
+	})
+	if err != nil {
+		log.Printf("Error sending password reset email to user %v: %v\n", user.ID, err)
+	}
+}
+
+func (cfg *apiConfig) handleConfirmPasswordReset(w http.ResponseWriter, r *http.Request) error {
+	type parameters struct {
+		Token		string	`json:"token"`
+		Password	string	`json:"password"`
+	}
+
+	params := parameters{}
+	err := decodeJSON(w, r, &params)
+	if err != nil {
+		return err
+	}
+
+	problems := map[string]string{}
+	if params.Token == "" {
+		problems["token"] = "is required"
+	}
+	if params.Password == "" {
+		problems["password"] = "is required"
+	} else if problem := auth.CheckPasswordStrength(params.Password, ""); problem != "" {
+		// The email isn't known until the token is consumed, and a token
+		// must not be burned on a password that gets rejected.
+		problems["password"] = problem
+	}
+	if len(problems) > 0 {
+		return apierror.Validation(problems)
+	}
+
+	stored, err := cfg.DB.ConsumePasswordResetToken(r.Context(), auth.HashToken(params.Token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.New(http.StatusUnauthorized, apierror.CodeInvalidToken, "reset token is invalid or has expired", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	passwordHash, err := auth.HashPassword(params.Password)
+	if err != nil {
+		return err
+	}
+	user, err := cfg.DB.UpdateUserPassword(r.Context(), database.UpdateUserPasswordParams{
+		ID: stored.UserID,
+		HashedPassword: passwordHash,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Anyone holding an older reset token or a session started with the old
+	// password loses access.
+	err = cfg.DB.InvalidatePasswordResetTokens(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+	err = cfg.DB.RevokeAllSessions(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+	err = cfg.DB.DeleteLoginThrottle(r.Context(), accountThrottleKey(user.Email))
+	if err != nil {
+		return err
+	}
+	cfg.recordAuditEvent(r.Context(), user.ID, auditPasswordReset, nil)
+
+	w.WriteHeader(204)
+	return nil
+}
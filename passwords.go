@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"grysha11/httpServersGo/internal/apierror"
+	"grysha11/httpServersGo/internal/auth"
+	"grysha11/httpServersGo/internal/database"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// recentLoginWindow is how long after logging in a user without a password
+// can still make changes that need the password re-checked for everyone
+// else.
+const recentLoginWindow = 10 * time.Minute
+
+// loadPasswordParams reads the argon2id cost parameters from the
+// environment, falling back to auth.DefaultPasswordParams.
+func loadPasswordParams() (auth.PasswordParams, error) {
+	params := auth.DefaultPasswordParams
+	envs := []struct {
+		name	string
+		bits	int
+		set		func(uint64)
+	}{
+		{"ARGON2_MEMORY_KIB", 32, func(v uint64) { params.Memory = uint32(v) }},
+		{"ARGON2_ITERATIONS", 32, func(v uint64) { params.Iterations = uint32(v) }},
+		{"ARGON2_PARALLELISM", 8, func(v uint64) { params.Parallelism = uint8(v) }},
+	}
+	for _, env := range envs {
+		value := os.Getenv(env.name)
+		if value == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(value, 10, env.bits)
+		if err != nil {
+			return auth.PasswordParams{}, fmt.Errorf("%s: %w", env.name, err)
+		}
+		if v == 0 {
+			return auth.PasswordParams{}, fmt.Errorf("%s must be positive", env.name)
+		}
+		env.set(v)
+	}
+
+	// argon2 needs at least 8 KiB of memory per lane.
+	if params.Memory < 8*uint32(params.Parallelism) {
+		return auth.PasswordParams{}, fmt.Errorf("ARGON2_MEMORY_KIB must be at least 8 times ARGON2_PARALLELISM")
+	}
+	return params, nil
+}
+
+// verifyPassword checks password against the user's stored hash. Hashes made
+// with weaker parameters than the configured ones are replaced while the
+// plain password is at hand. Accounts that never had a password, such as
+// ones created through OpenID Connect, never match, and take as long to say
+// so as any other account.
+func (cfg *apiConfig) verifyPassword(ctx context.Context, user database.User, password string) (bool, error) {
+	match, needsRehash, err := auth.CheckPasswordHash(password, user.HashedPassword)
+	if errors.Is(err, auth.ErrPasswordNotSet) {
+		auth.CheckDummyPasswordHash(password)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !needsRehash {
+		return match, nil
+	}
+
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		log.Printf("Error rehashing password for user %v: %v\n", user.ID, err)
+		return match, nil
+	}
+	err = cfg.DB.UpdateUserPasswordHash(ctx, database.UpdateUserPasswordHashParams{
+		ID: user.ID,
+		HashedPassword: hash,
+	})
+	if err != nil {
+		log.Printf("Error storing rehashed password for user %v: %v\n", user.ID, err)
+	}
+	return match, nil
+}
+
+// reauthenticate confirms a sensitive change with the user's current
+// password, or with a recent login for accounts that have no password.
+func (cfg *apiConfig) reauthenticate(r *http.Request, user database.User, currentPassword string) error {
+	if user.HashedPassword == auth.UnsetPasswordHash {
+		return cfg.requireRecentLogin(r, user.ID)
+	}
+
+	if currentPassword == "" {
+		return apierror.Validation(map[string]string{
+			"current_password": "is required",
+		})
+	}
+	isCorrect, err := cfg.verifyPassword(r.Context(), user, currentPassword)
+	if err != nil {
+		return err
+	}
+	if !isCorrect {
+		return apierror.Forbidden("current password is incorrect")
+	}
+	return nil
+}
+
+// requireRecentLogin re-authenticates users who have no password to
+// confirm, such as accounts created through OIDC: the session the request
+// comes from must have been started by a login within recentLoginWindow.
+// Refreshing the session does not count as logging in.
+func (cfg *apiConfig) requireRecentLogin(r *http.Request, userID uuid.UUID) error {
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	if !ok {
+		return apierror.Forbidden("log in again to confirm this action")
+	}
+	sessionID, err := uuid.Parse(claims.SessionID)
+	if err != nil {
+		return apierror.Forbidden("log in again to confirm this action")
+	}
+
+	startedAt, err := cfg.DB.GetSessionStartedAt(r.Context(), database.GetSessionStartedAtParams{
+		FamilyID: sessionID,
+		UserID: userID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.Forbidden("log in again to confirm this action")
+	}
+	if err != nil {
+		return err
+	}
+	if time.Since(startedAt) > recentLoginWindow {
+		return apierror.Forbidden("log in again to confirm this action")
+	}
+	return nil
+}
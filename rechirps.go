@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"grysha11/httpServersGo/internal/apierror"
+	"grysha11/httpServersGo/internal/auth"
+	"grysha11/httpServersGo/internal/database"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// originalChirp returns the chirp with the given ID, or the chirp it
+// rechirps. Replies, quotes and rechirps of a rechirp all go to the original.
+func (cfg *apiConfig) originalChirp(ctx context.Context, chirpID uuid.UUID) (database.Chirp, error) {
+	chirp, err := cfg.DB.GetChirpByID(ctx, chirpID)
+	if err != nil {
+		return database.Chirp{}, err
+	}
+	if !chirp.RechirpOfID.Valid {
+		return chirp, nil
+	}
+	return cfg.DB.GetChirpByID(ctx, chirp.RechirpOfID.UUID)
+}
+
+// inlineSharedChirps sets RechirpOf and QuoteOf and returns the chirps it
+// inlined. Chirps that were deleted since are left out.
+func (cfg *apiConfig) inlineSharedChirps(ctx context.Context, chirps []*Chirp) ([]*Chirp, error) {
+	var ids []uuid.UUID
+	for _, chirp := range chirps {
+		if chirp.RechirpOfID != nil {
+			ids = append(ids, *chirp.RechirpOfID)
+		}
+		if chirp.QuoteOfID != nil {
+			ids = append(ids, *chirp.QuoteOfID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	shared, err := cfg.DB.ListChirpsByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uuid.UUID]*Chirp, len(shared))
+	inlined := make([]*Chirp, 0, len(shared))
+	for _, chirp := range shared {
+		c := chirpFromDB(chirp)
+		byID[chirp.ID] = &c
+		inlined = append(inlined, &c)
+	}
+	for _, chirp := range chirps {
+		if chirp.RechirpOfID != nil {
+			chirp.RechirpOf = byID[*chirp.RechirpOfID]
+		}
+		if chirp.QuoteOfID != nil {
+			chirp.QuoteOf = byID[*chirp.QuoteOfID]
+		}
+	}
+	return inlined, nil
+}
+
+// addShareCounts fills in RechirpCount and QuoteCount with a single query.
+func (cfg *apiConfig) addShareCounts(ctx context.Context, chirps []*Chirp) error {
+	if len(chirps) == 0 {
+		return nil
+	}
+	ids := make([]uuid.UUID, len(chirps))
+	for i, chirp := range chirps {
+		ids[i] = chirp.ID
+	}
+
+	counts, err := cfg.DB.CountShares(ctx, ids)
+	if err != nil {
+		return err
+	}
+	byID := make(map[uuid.UUID]database.CountSharesRow, len(counts))
+	for _, count := range counts {
+		byID[count.ChirpID] = count
+	}
+	for _, chirp := range chirps {
+		chirp.RechirpCount = int(byID[chirp.ID].RechirpCount)
+		chirp.QuoteCount = int(byID[chirp.ID].QuoteCount)
+	}
+	return nil
+}
+
+// handleRechirp shares a chirp on the user's timeline. Rechirping the same
+// chirp again returns the existing rechirp.
+func (cfg *apiConfig) handleRechirp(w http.ResponseWriter, r *http.Request) error {
+	chirpID, err := parseUUIDPathValue(r, "chirpID")
+	if err != nil {
+		return err
+	}
+
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
+	}
+
+	user, err := cfg.DB.GetUserByID(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+	err = cfg.requireVerifiedEmail(user)
+	if err != nil {
+		return err
+	}
+
+	original, err := cfg.originalChirp(r.Context(), chirpID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.NotFound("chirp not found", err)
+	}
+	if err != nil {
+		return err
+	}
+	rechirpOfID := uuid.NullUUID{UUID: original.ID, Valid: true}
+
+	status := 201
+	rechirp, err := cfg.DB.GetRechirp(r.Context(), database.GetRechirpParams{
+		RechirpOfID: rechirpOfID,
+		UserID: userID,
+	})
+	if err == nil && !rechirp.DeletedAt.Valid {
+		status = 200
+	} else if err == nil || errors.Is(err, sql.ErrNoRows) {
+		// A deleted rechirp is brought back rather than conflicting with a
+		// new one.
+		rechirp, err = cfg.DB.CreateRechirp(r.Context(), database.CreateRechirpParams{
+			RechirpOfID: rechirpOfID,
+			UserID: userID,
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	return cfg.respondWithChirp(w, r, status, rechirp)
+}
+
+// handleUndoRechirp removes the user's rechirp of a chirp. Like rechirping,
+// it can safely be repeated.
+func (cfg *apiConfig) handleUndoRechirp(w http.ResponseWriter, r *http.Request) error {
+	chirpID, err := parseUUIDPathValue(r, "chirpID")
+	if err != nil {
+		return err
+	}
+
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
+	}
+
+	// The original may have been deleted since, which shouldn't stop anyone
+	// from undoing their rechirp of it.
+	chirp, err := cfg.DB.GetChirpByIDWithDeleted(r.Context(), chirpID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.NotFound("chirp not found", err)
+	}
+	if err != nil {
+		return err
+	}
+	if chirp.RechirpOfID.Valid {
+		chirpID = chirp.RechirpOfID.UUID
+	}
+
+	_, err = cfg.DB.DeleteRechirp(r.Context(), database.DeleteRechirpParams{
+		RechirpOfID: uuid.NullUUID{UUID: chirpID, Valid: true},
+		UserID: userID,
+	})
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(204)
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"grysha11/httpServersGo/internal/apierror"
+	"grysha11/httpServersGo/internal/auth"
+	"grysha11/httpServersGo/internal/database"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// lookupRole returns the current role of an authenticated user.
+func (cfg *apiConfig) lookupRole(ctx context.Context, userID uuid.UUID) (auth.Role, error) {
+	role, err := cfg.DB.GetUserRole(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", apierror.Unauthorized("user no longer exists", err)
+	}
+	if err != nil {
+		return "", err
+	}
+	return auth.Role(role), nil
+}
+
+// handleBootstrapAdmin makes the caller an admin if there is none yet and
+// they know the ADMIN_BOOTSTRAP_KEY. It is how the first admin is created,
+// every later role change goes through handleSetUserRole.
+func (cfg *apiConfig) handleBootstrapAdmin(w http.ResponseWriter, r *http.Request) error {
+	type parameters struct {
+		BootstrapKey	string	`json:"bootstrap_key"`
+	}
+
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
+	}
+
+	if cfg.BootstrapKey == "" {
+		return apierror.Forbidden("admin bootstrap is disabled")
+	}
+
+	params := parameters{}
+	err := decodeJSON(w, r, &params)
+	if err != nil {
+		return err
+	}
+
+	if params.BootstrapKey == "" {
+		return apierror.Validation(map[string]string{
+			"bootstrap_key": "is required",
+		})
+	}
+	if subtle.ConstantTimeCompare([]byte(params.BootstrapKey), []byte(cfg.BootstrapKey)) != 1 {
+		return apierror.Unauthorized("bootstrap key is invalid", nil)
+	}
+
+	// The update only matches while no admin exists, so the key stops
+	// working once it has been used.
+	rows, err := cfg.DB.BootstrapAdmin(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return apierror.Conflict("an admin already exists", nil)
+	}
+	cfg.recordAuditEvent(r.Context(), userID, auditRoleChanged, map[string]any{
+		"role": auth.RoleAdmin,
+		"bootstrap": true,
+	})
+
+	w.WriteHeader(204)
+	return nil
+}
+
+func (cfg *apiConfig) handleSetUserRole(w http.ResponseWriter, r *http.Request) error {
+	type parameters struct {
+		Role	string	`json:"role"`
+	}
+
+	adminID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
+	}
+
+	userID, err := parseUUIDPathValue(r, "userID")
+	if err != nil {
+		return err
+	}
+
+	params := parameters{}
+	err = decodeJSON(w, r, &params)
+	if err != nil {
+		return err
+	}
+
+	if !auth.ValidRole(params.Role) {
+		roles := make([]string, 0, len(auth.Roles))
+		for _, role := range auth.Roles {
+			roles = append(roles, string(role))
+		}
+		return apierror.Validation(map[string]string{
+			"role": "must be one of " + strings.Join(roles, ", "),
+		})
+	}
+	// Admins can't demote themselves, so there is always someone left who
+	// can undo a mistake.
+	if userID == adminID {
+		return apierror.Forbidden("admins can't change their own role")
+	}
+
+	user, err := cfg.DB.SetUserRole(r.Context(), database.SetUserRoleParams{
+		ID: userID,
+		Role: params.Role,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.NotFound("user not found", err)
+	}
+	if err != nil {
+		return err
+	}
+	cfg.recordAuditEvent(r.Context(), userID, auditRoleChanged, map[string]any{
+		"role": params.Role,
+		"changed_by": adminID,
+	})
+
+	return respondWithJSON(w, 200, User{
+		ID: user.ID,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+		Email: user.Email,
+		IsChirpyRed: user.IsChirpyRed,
+		IsEmailVerified: user.EmailVerifiedAt.Valid,
+		Role: user.Role,
+	})
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"grysha11/httpServersGo/internal/apierror"
+	"grysha11/httpServersGo/internal/auth"
+	"grysha11/httpServersGo/internal/database"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Session is a login as seen by the user. Its ID is the refresh token family,
+// which stays the same while the refresh token itself is rotated.
+type Session struct {
+	ID			uuid.UUID	`json:"id"`
+	CreatedAt	time.Time	`json:"created_at"`
+	LastUsedAt	time.Time	`json:"last_used_at"`
+	ExpiresAt	time.Time	`json:"expires_at"`
+	UserAgent	string		`json:"user_agent"`
+	IPAddress	string		`json:"ip_address"`
+	Current		bool		`json:"current"`
+}
+
+// accessTokenLeeway absorbs clock skew between us and other services that
+// verify our tokens.
+const accessTokenLeeway = 30 * time.Second
+
+func (cfg *apiConfig) accessTokenOptions() auth.ValidateOptions {
+	return auth.ValidateOptions{
+		Issuer: auth.Issuer,
+		Audience: cfg.JWTAudience,
+		Leeway: accessTokenLeeway,
+		TokenType: auth.TokenTypeAccess,
+	}
+}
+
+// tokenTTLs are the server enforced token lifetimes. Clients may ask for a
+// shorter or longer access token, but never outside of AccessMin..AccessMax.
+type tokenTTLs struct {
+	AccessMin		time.Duration
+	AccessMax		time.Duration
+	AccessDefault	time.Duration
+	Refresh			time.Duration
+}
+
+var defaultTokenTTLs = tokenTTLs{
+	AccessMin: time.Minute,
+	AccessMax: time.Hour,
+	AccessDefault: time.Hour,
+	Refresh: 60 * 24 * time.Hour,
+}
+
+// loadTokenTTLs reads token lifetimes from the environment, e.g.
+// ACCESS_TOKEN_MAX_TTL=30m, falling back to defaultTokenTTLs.
+func loadTokenTTLs() (tokenTTLs, error) {
+	ttls := defaultTokenTTLs
+	envs := []struct {
+		name	string
+		dst		*time.Duration
+	}{
+		{"ACCESS_TOKEN_MIN_TTL", &ttls.AccessMin},
+		{"ACCESS_TOKEN_MAX_TTL", &ttls.AccessMax},
+		{"ACCESS_TOKEN_DEFAULT_TTL", &ttls.AccessDefault},
+		{"REFRESH_TOKEN_TTL", &ttls.Refresh},
+	}
+	for _, env := range envs {
+		value := os.Getenv(env.name)
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return tokenTTLs{}, fmt.Errorf("%s: %w", env.name, err)
+		}
+		if d <= 0 {
+			return tokenTTLs{}, fmt.Errorf("%s must be positive", env.name)
+		}
+		*env.dst = d
+	}
+
+	if ttls.AccessMin > ttls.AccessMax {
+		return tokenTTLs{}, fmt.Errorf("ACCESS_TOKEN_MIN_TTL must not exceed ACCESS_TOKEN_MAX_TTL")
+	}
+	if ttls.AccessDefault < ttls.AccessMin || ttls.AccessDefault > ttls.AccessMax {
+		return tokenTTLs{}, fmt.Errorf("ACCESS_TOKEN_DEFAULT_TTL must be between the min and max TTL")
+	}
+	return ttls, nil
+}
+
+// accessTTL clamps a client requested lifetime into the allowed range.
+// Zero means the client didn't ask for anything.
+func (ttls tokenTTLs) accessTTL(requested time.Duration) time.Duration {
+	if requested <= 0 {
+		return ttls.AccessDefault
+	}
+	return min(max(requested, ttls.AccessMin), ttls.AccessMax)
+}
+
+// makeAccessToken issues an access token tied to the session it was
+// created for and returns it with its expiry.
+func (cfg *apiConfig) makeAccessToken(userID, sessionID uuid.UUID, expiresIn time.Duration) (string, time.Time, error) {
+	claims := auth.NewClaims(userID, auth.TokenTypeAccess, expiresIn)
+	claims.SessionID = sessionID.String()
+	if cfg.JWTAudience != "" {
+		claims.Audience = jwt.ClaimStrings{cfg.JWTAudience}
+	}
+
+	token, err := auth.SignJWT(claims, cfg.JWTKeys)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, claims.ExpiresAt.Time, nil
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// startSession issues the first refresh token of a new session and returns
+// it together with the session ID.
+func (cfg *apiConfig) startSession(r *http.Request, userID uuid.UUID) (string, uuid.UUID, error) {
+	sessionID := uuid.New()
+	refreshToken, err := cfg.issueRefreshToken(r, database.CreateRefreshTokenParams{
+		UserID: userID,
+		FamilyID: sessionID,
+		SessionStartedAt: time.Now(),
+	})
+	if err != nil {
+		return "", uuid.Nil, err
+	}
+	return refreshToken, sessionID, nil
+}
+
+// rotateSession issues the successor of an already revoked refresh token.
+func (cfg *apiConfig) rotateSession(r *http.Request, parent database.RefreshToken) (string, error) {
+	return cfg.issueRefreshToken(r, database.CreateRefreshTokenParams{
+		UserID: parent.UserID,
+		FamilyID: parent.FamilyID,
+		ParentID: uuid.NullUUID{UUID: parent.ID, Valid: true},
+		SessionStartedAt: parent.SessionStartedAt,
+	})
+}
+
+func (cfg *apiConfig) issueRefreshToken(r *http.Request, params database.CreateRefreshTokenParams) (string, error) {
+	refreshToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	params.TokenHash = auth.HashRefreshToken(refreshToken)
+	params.ExpiresAt = time.Now().Add(cfg.TokenTTLs.Refresh)
+	params.UserAgent = r.UserAgent()
+	params.IpAddress = clientIP(r)
+
+	_, err = cfg.DB.CreateRefreshToken(r.Context(), params)
+	if err != nil {
+		return "", err
+	}
+	return refreshToken, nil
+}
+
+func (cfg *apiConfig) handleListSessions(w http.ResponseWriter, r *http.Request) error {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
+	}
+
+	tokens, err := cfg.DB.ListActiveSessions(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	currentSessionID := ""
+	if claims, ok := auth.ClaimsFromContext(r.Context()); ok {
+		currentSessionID = claims.SessionID
+	}
+
+	sessions := make([]Session, len(tokens))
+	for i, token := range tokens {
+		sessions[i] = Session{
+			ID: token.FamilyID,
+			CreatedAt: token.SessionStartedAt,
+			LastUsedAt: token.LastUsedAt,
+			ExpiresAt: token.ExpiresAt,
+			UserAgent: token.UserAgent,
+			IPAddress: token.IpAddress,
+			Current: token.FamilyID.String() == currentSessionID,
+		}
+	}
+
+	return respondWithJSON(w, 200, sessions)
+}
+
+func (cfg *apiConfig) handleRevokeSession(w http.ResponseWriter, r *http.Request) error {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
+	}
+
+	sessionID, err := parseUUIDPathValue(r, "sessionID")
+	if err != nil {
+		return err
+	}
+
+	revoked, err := cfg.DB.RevokeSession(r.Context(), database.RevokeSessionParams{
+		FamilyID: sessionID,
+		UserID: userID,
+	})
+	if err != nil {
+		return err
+	}
+	if revoked == 0 {
+		return apierror.NotFound("session not found", sql.ErrNoRows)
+	}
+
+	w.WriteHeader(204)
+	return nil
+}
+
+func (cfg *apiConfig) handleRevokeAllSessions(w http.ResponseWriter, r *http.Request) error {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
+	}
+
+	err := cfg.DB.RevokeAllSessions(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(204)
+	return nil
+}
+
+// revokeOtherSessions ends every session of the user except the one the
+// request was made from. Access tokens without a session ID end them all.
+func (cfg *apiConfig) revokeOtherSessions(r *http.Request, userID uuid.UUID) error {
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	if !ok {
+		return cfg.DB.RevokeAllSessions(r.Context(), userID)
+	}
+	sessionID, err := uuid.Parse(claims.SessionID)
+	if err != nil {
+		return cfg.DB.RevokeAllSessions(r.Context(), userID)
+	}
+
+	return cfg.DB.RevokeOtherSessions(r.Context(), database.RevokeOtherSessionsParams{
+		UserID: userID,
+		FamilyID: sessionID,
+	})
+}
@@ -0,0 +1,34 @@
+-- name: CreateAPIKey :one
+INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes)
+VALUES (
+    $1,
+    $2,
+    $3,
+    $4,
+    $5
+)
+RETURNING *;
+
+-- name: ListAPIKeys :many
+SELECT * FROM api_keys
+WHERE user_id = $1
+AND revoked_at IS NULL
+ORDER BY created_at DESC;
+
+-- name: TouchAPIKey :one
+UPDATE api_keys
+SET last_used_at = NOW()
+WHERE key_hash = $1
+AND revoked_at IS NULL
+AND user_id IN (
+    SELECT id FROM users
+    WHERE deleted_at IS NULL
+)
+RETURNING *;
+
+-- name: RevokeAPIKey :execrows
+UPDATE api_keys
+SET revoked_at = NOW()
+WHERE id = $1
+AND user_id = $2
+AND revoked_at IS NULL;
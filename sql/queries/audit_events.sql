@@ -0,0 +1,8 @@
+-- name: CreateAuditEvent :one
+INSERT INTO audit_events (user_id, event_type, details)
+VALUES (
+    $1,
+    $2,
+    $3
+)
+RETURNING *;
\ No newline at end of file
@@ -0,0 +1,28 @@
+-- name: EditChirp :one
+WITH previous AS (
+    SELECT id, body, original_body, flagged, COALESCE(edited_at, created_at) AS written_at FROM chirps
+    WHERE id = sqlc.arg('id')
+    AND user_id = sqlc.arg('user_id')
+    AND created_at > sqlc.arg('editable_after')::timestamp
+    AND deleted_at IS NULL
+    AND rechirp_of_id IS NULL
+    FOR UPDATE
+), revision AS (
+    INSERT INTO chirp_revisions (chirp_id, body, original_body, flagged, written_at)
+    SELECT id, body, original_body, flagged, written_at FROM previous
+    RETURNING chirp_id
+)
+UPDATE chirps
+SET body = sqlc.arg('body'),
+    original_body = sqlc.narg('original_body'),
+    flagged = sqlc.arg('flagged'),
+    updated_at = NOW(),
+    edited_at = NOW()
+FROM revision
+WHERE chirps.id = revision.chirp_id
+RETURNING chirps.*;
+
+-- name: ListChirpRevisions :many
+SELECT * FROM chirp_revisions
+WHERE chirp_id = $1
+ORDER BY created_at DESC, id DESC;
@@ -0,0 +1,70 @@
+-- name: ListChirpAncestors :many
+WITH RECURSIVE ancestors AS (
+    SELECT chirps.*, 1 AS depth FROM chirps
+    WHERE chirps.id = (
+        SELECT parent_id FROM chirps AS child
+        WHERE child.id = $1
+    )
+    UNION ALL
+    SELECT chirps.*, ancestors.depth + 1 FROM chirps
+    JOIN ancestors ON chirps.id = ancestors.parent_id
+)
+SELECT
+    ancestors.id,
+    ancestors.created_at,
+    ancestors.updated_at,
+    ancestors.body,
+    ancestors.user_id,
+    ancestors.original_body,
+    ancestors.flagged,
+    ancestors.edited_at,
+    COALESCE(ancestors.deleted_at, users.deleted_at) AS deleted_at,
+    ancestors.parent_id,
+    ancestors.root_id,
+    ancestors.rechirp_of_id,
+    ancestors.quote_of_id
+FROM ancestors
+LEFT JOIN users ON users.id = ancestors.user_id
+ORDER BY ancestors.depth DESC;
+
+-- name: ListChirpDescendants :many
+WITH RECURSIVE descendants AS (
+    SELECT chirps.* FROM chirps
+    WHERE chirps.parent_id = sqlc.arg('id')
+    UNION ALL
+    SELECT chirps.* FROM chirps
+    JOIN descendants ON chirps.parent_id = descendants.id
+)
+SELECT
+    descendants.id,
+    descendants.created_at,
+    descendants.updated_at,
+    descendants.body,
+    descendants.user_id,
+    descendants.original_body,
+    descendants.flagged,
+    descendants.edited_at,
+    COALESCE(descendants.deleted_at, users.deleted_at) AS deleted_at,
+    descendants.parent_id,
+    descendants.root_id,
+    descendants.rechirp_of_id,
+    descendants.quote_of_id
+FROM descendants
+LEFT JOIN users ON users.id = descendants.user_id
+WHERE (
+    sqlc.narg('after_created_at')::timestamp IS NULL
+    OR (descendants.created_at, descendants.id) > (sqlc.narg('after_created_at')::timestamp, sqlc.narg('after_id')::uuid)
+)
+ORDER BY descendants.created_at ASC, descendants.id ASC
+LIMIT sqlc.arg('page_limit');
+
+-- name: CountReplies :many
+SELECT parent_id, COUNT(*) AS reply_count FROM chirps
+WHERE parent_id = ANY(sqlc.arg('parent_ids')::uuid[])
+AND deleted_at IS NULL
+AND NOT EXISTS (
+    SELECT 1 FROM users
+    WHERE users.id = chirps.user_id
+    AND users.deleted_at IS NOT NULL
+)
+GROUP BY parent_id;
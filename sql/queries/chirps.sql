@@ -1,26 +1,141 @@
 -- name: CreateChirp :one
-INSERT INTO chirps (body, user_id)
+INSERT INTO chirps (body, user_id, original_body, flagged, parent_id, root_id, quote_of_id)
 VALUES (
     $1,
-    $2
+    $2,
+    $3,
+    $4,
+    $5,
+    $6,
+    $7
 )
 RETURNING *;
 
 -- name: DeleteChirps :exec
 DELETE FROM chirps;
 
--- name: DeleteChirpByID :exec
+-- name: SoftDeleteChirpByID :one
+UPDATE chirps
+SET deleted_at = NOW()
+WHERE id = $1
+AND deleted_at IS NULL
+RETURNING *;
+
+-- name: RestoreChirpByID :one
+UPDATE chirps
+SET deleted_at = NULL
+WHERE id = sqlc.arg('id')
+AND user_id = sqlc.arg('user_id')
+AND deleted_at > sqlc.arg('deleted_after')::timestamp
+RETURNING *;
+
+-- name: PurgeDeletedChirps :execrows
+WITH tombstoned AS (
+    UPDATE chirps
+    SET body = '',
+        original_body = NULL
+    WHERE deleted_at < $1
+    AND body <> ''
+    AND EXISTS (
+        SELECT 1 FROM chirps AS replies
+        WHERE replies.parent_id = chirps.id
+    )
+    RETURNING id
+), revisions AS (
+    DELETE FROM chirp_revisions
+    WHERE chirp_id IN (SELECT id FROM tombstoned)
+)
 DELETE FROM chirps
-WHERE id = $1;
+WHERE deleted_at < $1
+AND NOT EXISTS (
+    SELECT 1 FROM chirps AS replies
+    WHERE replies.parent_id = chirps.id
+);
 
 -- name: GetAllChirps :many
-SELECT * FROM chirps;
+SELECT * FROM chirps
+WHERE deleted_at IS NULL;
 
 -- name: GetChirpsByAuthor :many
 SELECT * FROM chirps
 WHERE user_id = $1
+AND deleted_at IS NULL
 ORDER BY created_at ASC;
 
 -- name: GetChirpByID :one
 SELECT * FROM chirps
-WHERE id = $1 LIMIT 1;
\ No newline at end of file
+WHERE id = $1
+AND deleted_at IS NULL
+AND NOT EXISTS (
+    SELECT 1 FROM users
+    WHERE users.id = chirps.user_id
+    AND users.deleted_at IS NOT NULL
+)
+LIMIT 1;
+
+-- name: ListChirpsAsc :many
+SELECT * FROM chirps
+WHERE (sqlc.narg('author_id')::uuid IS NULL OR user_id = sqlc.narg('author_id')::uuid)
+AND deleted_at IS NULL
+AND (
+    sqlc.narg('after_created_at')::timestamp IS NULL
+    OR (created_at, id) > (sqlc.narg('after_created_at')::timestamp, sqlc.narg('after_id')::uuid)
+)
+AND NOT EXISTS (
+    SELECT 1 FROM users
+    WHERE users.id = chirps.user_id
+    AND users.deleted_at IS NOT NULL
+)
+AND (
+    rechirp_of_id IS NULL
+    OR EXISTS (
+        SELECT 1 FROM chirps AS original
+        JOIN users ON users.id = original.user_id
+        WHERE original.id = chirps.rechirp_of_id
+        AND original.deleted_at IS NULL
+        AND users.deleted_at IS NULL
+    )
+)
+ORDER BY created_at ASC, id ASC
+LIMIT sqlc.arg('page_limit');
+
+-- name: ListChirpsDesc :many
+SELECT * FROM chirps
+WHERE (sqlc.narg('author_id')::uuid IS NULL OR user_id = sqlc.narg('author_id')::uuid)
+AND deleted_at IS NULL
+AND (
+    sqlc.narg('after_created_at')::timestamp IS NULL
+    OR (created_at, id) < (sqlc.narg('after_created_at')::timestamp, sqlc.narg('after_id')::uuid)
+)
+AND NOT EXISTS (
+    SELECT 1 FROM users
+    WHERE users.id = chirps.user_id
+    AND users.deleted_at IS NOT NULL
+)
+AND (
+    rechirp_of_id IS NULL
+    OR EXISTS (
+        SELECT 1 FROM chirps AS original
+        JOIN users ON users.id = original.user_id
+        WHERE original.id = chirps.rechirp_of_id
+        AND original.deleted_at IS NULL
+        AND users.deleted_at IS NULL
+    )
+)
+ORDER BY created_at DESC, id DESC
+LIMIT sqlc.arg('page_limit');
+-- name: GetChirpByIDWithDeleted :one
+SELECT * FROM chirps
+WHERE id = $1
+LIMIT 1;
+
+-- name: ListDeletedChirps :many
+SELECT * FROM chirps
+WHERE deleted_at IS NOT NULL
+AND (sqlc.narg('author_id')::uuid IS NULL OR user_id = sqlc.narg('author_id')::uuid)
+AND (
+    sqlc.narg('before_deleted_at')::timestamp IS NULL
+    OR (deleted_at, id) < (sqlc.narg('before_deleted_at')::timestamp, sqlc.narg('before_id')::uuid)
+)
+ORDER BY deleted_at DESC, id DESC
+LIMIT sqlc.arg('page_limit');
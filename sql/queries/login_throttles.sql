@@ -0,0 +1,26 @@
+-- name: GetLoginThrottle :one
+SELECT * FROM login_throttles
+WHERE throttle_key = $1;
+
+-- name: RecordLoginFailure :one
+INSERT INTO login_throttles (throttle_key, failures, last_failure_at)
+VALUES (sqlc.arg('throttle_key'), 1, NOW())
+ON CONFLICT (throttle_key) DO UPDATE
+SET failures = CASE
+        WHEN login_throttles.last_failure_at < sqlc.arg('reset_before')::timestamp THEN 1
+        ELSE login_throttles.failures + 1
+    END,
+    last_failure_at = NOW()
+RETURNING *;
+
+-- name: LockLoginThrottle :exec
+UPDATE login_throttles
+SET locked_until = $2
+WHERE throttle_key = $1;
+
+-- name: DeleteLoginThrottle :exec
+DELETE FROM login_throttles
+WHERE throttle_key = $1;
+
+-- name: DeleteLoginThrottles :exec
+DELETE FROM login_throttles;
\ No newline at end of file
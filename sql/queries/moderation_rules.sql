@@ -0,0 +1,3 @@
+-- name: GetModerationRules :many
+SELECT * FROM moderation_rules
+ORDER BY word ASC;
\ No newline at end of file
@@ -0,0 +1,46 @@
+-- name: GetRechirp :one
+SELECT * FROM chirps
+WHERE rechirp_of_id = $1
+AND user_id = $2;
+
+-- name: CreateRechirp :one
+INSERT INTO chirps (body, user_id, flagged, rechirp_of_id)
+VALUES (
+    '',
+    $2,
+    false,
+    $1
+)
+ON CONFLICT (rechirp_of_id, user_id) WHERE rechirp_of_id IS NOT NULL DO UPDATE
+SET deleted_at = NULL
+RETURNING *;
+
+-- name: DeleteRechirp :execrows
+DELETE FROM chirps
+WHERE rechirp_of_id = $1
+AND user_id = $2;
+
+-- name: ListChirpsByIDs :many
+SELECT * FROM chirps
+WHERE id = ANY(sqlc.arg('ids')::uuid[])
+AND deleted_at IS NULL
+AND NOT EXISTS (
+    SELECT 1 FROM users
+    WHERE users.id = chirps.user_id
+    AND users.deleted_at IS NOT NULL
+);
+
+-- name: CountShares :many
+SELECT
+    COALESCE(rechirp_of_id, quote_of_id)::uuid AS chirp_id,
+    COUNT(rechirp_of_id) AS rechirp_count,
+    COUNT(quote_of_id) AS quote_count
+FROM chirps
+WHERE (rechirp_of_id = ANY(sqlc.arg('chirp_ids')::uuid[]) OR quote_of_id = ANY(sqlc.arg('chirp_ids')::uuid[]))
+AND deleted_at IS NULL
+AND NOT EXISTS (
+    SELECT 1 FROM users
+    WHERE users.id = chirps.user_id
+    AND users.deleted_at IS NOT NULL
+)
+GROUP BY 1;
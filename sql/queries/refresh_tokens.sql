@@ -1,16 +1,25 @@
 -- name: CreateRefreshToken :one
-INSERT INTO refresh_tokens (token, user_id, expires_at)
+INSERT INTO refresh_tokens (token_hash, user_id, expires_at, family_id, parent_id, session_started_at, user_agent, ip_address)
 VALUES (
     $1,
     $2,
-    $3
+    $3,
+    $4,
+    $5,
+    $6,
+    $7,
+    $8
 )
 RETURNING *;
 
+-- name: GetRefreshTokenByHash :one
+SELECT * FROM refresh_tokens
+WHERE token_hash = $1;
+
 -- name: GetUserFromRefreshToken :one
 SELECT users.* FROM users
 JOIN refresh_tokens ON users.id = refresh_tokens.user_id
-WHERE refresh_tokens.token = $1
+WHERE refresh_tokens.token_hash = $1
 AND refresh_tokens.revoked_at IS NULL
 AND refresh_tokens.expires_at > NOW();
 
@@ -18,7 +27,64 @@ AND refresh_tokens.expires_at > NOW();
 UPDATE refresh_tokens
 SET revoked_at = NOW(),
     updated_at = NOW()
-WHERE token = $1;
+WHERE token_hash = $1;
+
+-- name: RevokeActiveRefreshToken :execrows
+UPDATE refresh_tokens
+SET revoked_at = NOW(),
+    updated_at = NOW()
+WHERE id = $1
+AND revoked_at IS NULL;
+
+-- name: RevokeRefreshTokenFamily :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(),
+    updated_at = NOW()
+WHERE family_id = $1
+AND revoked_at IS NULL;
+
+-- name: ListActiveSessions :many
+SELECT * FROM refresh_tokens
+WHERE user_id = $1
+AND revoked_at IS NULL
+AND expires_at > NOW()
+ORDER BY last_used_at DESC;
+
+-- name: RevokeSession :execrows
+UPDATE refresh_tokens
+SET revoked_at = NOW(),
+    updated_at = NOW()
+WHERE family_id = $1
+AND user_id = $2
+AND revoked_at IS NULL;
+
+-- name: GetSessionStartedAt :one
+SELECT session_started_at FROM refresh_tokens
+WHERE family_id = $1
+AND user_id = $2
+AND revoked_at IS NULL
+AND expires_at > NOW()
+LIMIT 1;
+
+-- name: RevokeAllSessions :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(),
+    updated_at = NOW()
+WHERE user_id = $1
+AND revoked_at IS NULL;
+
+-- name: RevokeOtherSessions :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(),
+    updated_at = NOW()
+WHERE user_id = $1
+AND family_id <> $2
+AND revoked_at IS NULL;
 
 -- name: DeleteRefreshTokens :exec
-DELETE FROM refresh_tokens;
\ No newline at end of file
+DELETE FROM refresh_tokens;
+-- name: HasChildRefreshToken :one
+SELECT EXISTS (
+    SELECT 1 FROM refresh_tokens
+    WHERE parent_id = $1
+);
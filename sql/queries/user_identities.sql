@@ -0,0 +1,34 @@
+-- name: CreateUserIdentity :one
+INSERT INTO user_identities (user_id, provider, subject, email)
+VALUES (
+    $1,
+    $2,
+    $3,
+    $4
+)
+RETURNING *;
+
+-- name: GetUserByIdentity :one
+SELECT users.* FROM users
+JOIN user_identities ON users.id = user_identities.user_id
+WHERE user_identities.provider = $1
+AND user_identities.subject = $2;
+
+-- name: CreateOIDCLoginState :exec
+INSERT INTO oidc_login_states (state_hash, provider, nonce, code_verifier, expires_at)
+VALUES (
+    $1,
+    $2,
+    $3,
+    $4,
+    $5
+);
+
+-- name: ConsumeOIDCLoginState :one
+DELETE FROM oidc_login_states
+WHERE state_hash = $1
+RETURNING *;
+
+-- name: DeleteExpiredOIDCLoginStates :exec
+DELETE FROM oidc_login_states
+WHERE expires_at <= NOW();
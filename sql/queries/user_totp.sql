@@ -0,0 +1,34 @@
+-- name: UpsertUserTOTP :one
+INSERT INTO user_totp (user_id, secret)
+VALUES (
+    $1,
+    $2
+)
+ON CONFLICT (user_id) DO UPDATE
+SET secret = EXCLUDED.secret,
+    created_at = NOW(),
+    last_used_step = 0
+WHERE user_totp.confirmed_at IS NULL
+RETURNING *;
+
+-- name: GetUserTOTP :one
+SELECT * FROM user_totp
+WHERE user_id = $1;
+
+-- name: ConfirmUserTOTP :execrows
+UPDATE user_totp
+SET confirmed_at = NOW(),
+    last_used_step = $2
+WHERE user_id = $1
+AND confirmed_at IS NULL;
+
+-- name: UseTOTPStep :execrows
+UPDATE user_totp
+SET last_used_step = $2
+WHERE user_id = $1
+AND confirmed_at IS NOT NULL
+AND last_used_step < $2;
+
+-- name: DeleteUserTOTP :exec
+DELETE FROM user_totp
+WHERE user_id = $1;
@@ -6,18 +6,45 @@ VALUES (
 )
 RETURNING *;
 
+-- name: GetUserByID :one
+SELECT * FROM users
+WHERE id = $1;
+
 -- name: GetUserByEmail :one
 SELECT * FROM users
 WHERE email = $1;
 
--- name: UpdateUserByID :one
+-- name: PatchUserByID :one
 UPDATE users
-SET email = $2,
-    hashed_password = $3,
+SET email = COALESCE(sqlc.narg('email'), email),
+    hashed_password = COALESCE(sqlc.narg('hashed_password'), hashed_password),
+    email_verified_at = CASE
+        WHEN sqlc.narg('email') IS NULL OR sqlc.narg('email') = email THEN email_verified_at
+    END,
+    updated_at = NOW()
+WHERE id = sqlc.arg('id')
+RETURNING *;
+
+-- name: UpdateUserPassword :one
+UPDATE users
+SET hashed_password = $2,
     updated_at = NOW()
 WHERE id = $1
 RETURNING *;
 
+-- name: UpdateUserPasswordHash :exec
+UPDATE users
+SET hashed_password = $2
+WHERE id = $1;
+
+-- name: VerifyUserEmail :execrows
+UPDATE users
+SET email_verified_at = NOW(),
+    updated_at = NOW()
+WHERE id = $1
+AND email = $2
+AND email_verified_at IS NULL;
+
 -- name: UpgradeUserChirpyRedByID :one
 UPDATE users
 SET is_chirpy_red = $2,
@@ -26,4 +53,78 @@ WHERE id = $1
 RETURNING *;
 
 -- name: DeleteUsers :exec
-DELETE FROM users;
\ No newline at end of file
+DELETE FROM users;
+-- name: CreateUserWithoutPassword :one
+INSERT INTO users (email, hashed_password, email_verified_at)
+VALUES (
+    $1,
+    $2,
+    $3
+)
+RETURNING *;
+
+-- name: GetUserRole :one
+SELECT role FROM users
+WHERE id = $1
+AND deleted_at IS NULL;
+
+-- name: GetUserDeletedAt :one
+SELECT deleted_at FROM users
+WHERE id = $1;
+
+-- name: SetUserRole :one
+UPDATE users
+SET role = $2, updated_at = NOW()
+WHERE id = $1
+RETURNING *;
+
+-- name: BootstrapAdmin :execrows
+UPDATE users
+SET role = 'admin', updated_at = NOW()
+WHERE id = $1
+AND NOT EXISTS (
+    SELECT 1 FROM users
+    WHERE role = 'admin'
+);
+
+-- name: SoftDeleteUser :one
+UPDATE users
+SET deleted_at = NOW(), updated_at = NOW()
+WHERE id = $1
+AND deleted_at IS NULL
+RETURNING *;
+
+-- name: RestoreUser :execrows
+UPDATE users
+SET deleted_at = NULL, updated_at = NOW()
+WHERE id = $1
+AND deleted_at IS NOT NULL;
+
+-- name: PurgeDeletedUsers :execrows
+WITH purged AS (
+    SELECT id FROM users
+    WHERE deleted_at < sqlc.arg('deleted_before')::timestamp
+), tombstoned AS (
+    UPDATE chirps
+    SET body = '',
+        original_body = NULL,
+        deleted_at = COALESCE(deleted_at, NOW())
+    WHERE user_id IN (SELECT id FROM purged)
+    AND EXISTS (
+        SELECT 1 FROM chirps AS replies
+        WHERE replies.parent_id = chirps.id
+    )
+    RETURNING id
+), revisions AS (
+    DELETE FROM chirp_revisions
+    WHERE chirp_id IN (SELECT id FROM tombstoned)
+), chirps_deleted AS (
+    DELETE FROM chirps
+    WHERE user_id IN (SELECT id FROM purged)
+    AND NOT EXISTS (
+        SELECT 1 FROM chirps AS replies
+        WHERE replies.parent_id = chirps.id
+    )
+)
+DELETE FROM users
+WHERE id IN (SELECT id FROM purged);
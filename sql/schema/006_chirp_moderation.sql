@@ -0,0 +1,18 @@
+-- +goose Up
+ALTER TABLE chirps
+ADD COLUMN original_body TEXT,
+ADD COLUMN flagged BOOL NOT NULL DEFAULT FALSE;
+
+CREATE TABLE moderation_rules (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    word TEXT UNIQUE NOT NULL,
+    action TEXT NOT NULL DEFAULT 'mask' CHECK (action IN ('mask', 'reject', 'flag'))
+);
+
+-- +goose Down
+DROP TABLE moderation_rules;
+
+ALTER TABLE chirps
+DROP COLUMN flagged,
+DROP COLUMN original_body;
\ No newline at end of file
@@ -0,0 +1,58 @@
+-- +goose Up
+ALTER TABLE refresh_tokens
+ADD COLUMN id UUID NOT NULL DEFAULT gen_random_uuid(),
+ADD COLUMN token_hash TEXT,
+ADD COLUMN parent_id UUID,
+ADD COLUMN session_started_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ADD COLUMN last_used_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ADD COLUMN user_agent TEXT NOT NULL DEFAULT '',
+ADD COLUMN ip_address TEXT NOT NULL DEFAULT '';
+
+UPDATE refresh_tokens
+SET token_hash = encode(sha256(convert_to(token, 'UTF8')), 'hex'),
+    session_started_at = created_at,
+    last_used_at = updated_at;
+
+UPDATE refresh_tokens AS child
+SET parent_id = parent.id
+FROM refresh_tokens AS parent
+WHERE child.parent_token = parent.token;
+
+ALTER TABLE refresh_tokens
+DROP CONSTRAINT refresh_tokens_pkey;
+
+ALTER TABLE refresh_tokens
+DROP COLUMN parent_token,
+DROP COLUMN token;
+
+ALTER TABLE refresh_tokens
+ALTER COLUMN token_hash SET NOT NULL;
+
+ALTER TABLE refresh_tokens
+ADD PRIMARY KEY (id),
+ADD CONSTRAINT refresh_tokens_token_hash_key UNIQUE (token_hash);
+
+CREATE INDEX refresh_tokens_user_id_idx ON refresh_tokens (user_id);
+
+-- +goose Down
+-- Plaintext tokens can't be recovered, so every session is dropped.
+DELETE FROM refresh_tokens;
+
+DROP INDEX refresh_tokens_user_id_idx;
+
+ALTER TABLE refresh_tokens
+DROP CONSTRAINT refresh_tokens_token_hash_key,
+DROP CONSTRAINT refresh_tokens_pkey;
+
+ALTER TABLE refresh_tokens
+ADD COLUMN token TEXT PRIMARY KEY,
+ADD COLUMN parent_token TEXT;
+
+ALTER TABLE refresh_tokens
+DROP COLUMN ip_address,
+DROP COLUMN user_agent,
+DROP COLUMN last_used_at,
+DROP COLUMN session_started_at,
+DROP COLUMN parent_id,
+DROP COLUMN token_hash,
+DROP COLUMN id;
\ No newline at end of file
@@ -0,0 +1,10 @@
+-- +goose Up
+CREATE TABLE login_throttles (
+    throttle_key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    locked_until TIMESTAMP
+);
+
+-- +goose Down
+DROP TABLE login_throttles;
\ No newline at end of file
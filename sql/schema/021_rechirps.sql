@@ -0,0 +1,15 @@
+-- +goose Up
+ALTER TABLE chirps
+ADD COLUMN rechirp_of_id UUID REFERENCES chirps(id) ON DELETE CASCADE,
+ADD COLUMN quote_of_id UUID REFERENCES chirps(id) ON DELETE SET NULL,
+ADD CONSTRAINT chirps_rechirp_or_quote CHECK (rechirp_of_id IS NULL OR quote_of_id IS NULL);
+
+CREATE UNIQUE INDEX chirps_rechirp_of_id_user_id_idx ON chirps (rechirp_of_id, user_id)
+WHERE rechirp_of_id IS NOT NULL;
+CREATE INDEX chirps_quote_of_id_idx ON chirps (quote_of_id);
+
+-- +goose Down
+ALTER TABLE chirps
+DROP CONSTRAINT chirps_rechirp_or_quote,
+DROP COLUMN quote_of_id,
+DROP COLUMN rechirp_of_id;
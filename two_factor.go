@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"grysha11/httpServersGo/internal/apierror"
+	"grysha11/httpServersGo/internal/auth"
+	"grysha11/httpServersGo/internal/database"
+	"grysha11/httpServersGo/internal/totp"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	totpIssuer = "Chirpy"
+	// mfaChallengeTTL is how long the user has to enter a code after the
+	// password step of a login.
+	mfaChallengeTTL = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+// MFAChallenge is returned by handleLogin instead of tokens when the user
+// has two-factor authentication enabled.
+type MFAChallenge struct {
+	MFARequired	bool		`json:"mfa_required"`
+	MFAToken	string		`json:"mfa_token"`
+	ExpiresAt	time.Time	`json:"expires_at"`
+}
+
+func (cfg *apiConfig) mfaChallengeOptions() auth.ValidateOptions {
+	return auth.ValidateOptions{
+		Issuer: auth.Issuer,
+		Audience: cfg.JWTAudience,
+		TokenType: auth.TokenTypeMFAChallenge,
+	}
+}
+
+func (cfg *apiConfig) respondWithMFAChallenge(w http.ResponseWriter, userID uuid.UUID) error {
+	claims := auth.NewClaims(userID, auth.TokenTypeMFAChallenge, mfaChallengeTTL)
+	if cfg.JWTAudience != "" {
+		claims.Audience = jwt.ClaimStrings{cfg.JWTAudience}
+	}
+	token, err := auth.SignJWT(claims, cfg.JWTKeys)
+	if err != nil {
+		return err
+	}
+
+	return respondWithJSON(w, 200, MFAChallenge{
+		MFARequired: true,
+		MFAToken: token,
+		ExpiresAt: claims.ExpiresAt.Time,
+	})
+}
+
+// generateRecoveryCode returns a random code like "abcde-23456", 50 bits
+// of base32.
+func generateRecoveryCode() string {
+	text := strings.ToLower(rand.Text())
+	return text[:5] + "-" + text[5:10]
+}
+
+// hashRecoveryCode hashes a recovery code the way it is stored, ignoring
+// case, dashes and spaces.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return auth.HashToken(code)
+}
+
+// handleEnrollTOTP starts two-factor enrollment. Like every change to how
+// the user logs in, it needs the current password or a recent login, so a
+// stolen token can't be used to lock the owner out.
+func (cfg *apiConfig) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) error {
+	type parameters struct {
+		CurrentPassword	string	`json:"current_password"`
+	}
+	type ResponseSuccess struct {
+		Secret		string	`json:"secret"`
+		OTPAuthURI	string	`json:"otpauth_uri"`
+	}
+
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
+	}
+
+	params := parameters{}
+	err := decodeJSON(w, r, &params)
+	if err != nil {
+		return err
+	}
+
+	user, err := cfg.DB.GetUserByID(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.Unauthorized("user no longer exists", err)
+	}
+	if err != nil {
+		return err
+	}
+	err = cfg.reauthenticate(r, user, params.CurrentPassword)
+	if err != nil {
+		return err
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return err
+	}
+
+	// Enrolling again before confirming replaces the secret, but an
+	// enabled secret is never overwritten.
+	_, err = cfg.DB.UpsertUserTOTP(r.Context(), database.UpsertUserTOTPParams{
+		UserID: userID,
+		Secret: secret,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.Conflict("two-factor authentication is already enabled", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	return respondWithJSON(w, 200, ResponseSuccess{
+		Secret: secret,
+		OTPAuthURI: totp.URI(totpIssuer, user.Email, secret, totp.DefaultOptions),
+	})
+}
+
+func (cfg *apiConfig) handleConfirmTOTP(w http.ResponseWriter, r *http.Request) error {
+	type parameters struct {
+		Code			string	`json:"code"`
+		CurrentPassword	string	`json:"current_password"`
+	}
+	type ResponseSuccess struct {
+		RecoveryCodes	[]string	`json:"recovery_codes"`
+	}
+
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
+	}
+
+	params := parameters{}
+	err := decodeJSON(w, r, &params)
+	if err != nil {
+		return err
+	}
+
+	if params.Code == "" {
+		return apierror.Validation(map[string]string{
+			"code": "is required",
+		})
+	}
+
+	stored, err := cfg.DB.GetUserTOTP(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.NotFound("two-factor enrollment has not been started", err)
+	}
+	if err != nil {
+		return err
+	}
+	if stored.ConfirmedAt.Valid {
+		return apierror.Conflict("two-factor authentication is already enabled", nil)
+	}
+
+	user, err := cfg.DB.GetUserByID(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.Unauthorized("user no longer exists", err)
+	}
+	if err != nil {
+		return err
+	}
+	err = cfg.reauthenticate(r, user, params.CurrentPassword)
+	if err != nil {
+		return err
+	}
+
+	step, valid, err := totp.Validate(params.Code, stored.Secret, time.Now(), totp.DefaultOptions)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return apierror.Validation(map[string]string{
+			"code": "is incorrect",
+		})
+	}
+
+	// 2FA must never end up enabled without recovery codes, so both are
+	// written in one transaction.
+	codes := make([]string, 0, recoveryCodeCount)
+	err = cfg.inTx(r.Context(), func(q *database.Queries) error {
+		rows, err := q.ConfirmUserTOTP(r.Context(), database.ConfirmUserTOTPParams{
+			UserID: userID,
+			LastUsedStep: step,
+		})
+		if err != nil {
+			return err
+		}
+		if rows == 0 {
+			return apierror.Conflict("two-factor authentication is already enabled", nil)
+		}
+
+		err = q.DeleteRecoveryCodes(r.Context(), userID)
+		if err != nil {
+			return err
+		}
+		for range recoveryCodeCount {
+			code := generateRecoveryCode()
+			err = q.CreateRecoveryCode(r.Context(), database.CreateRecoveryCodeParams{
+				UserID: userID,
+				CodeHash: hashRecoveryCode(code),
+			})
+			if err != nil {
+				return err
+			}
+			codes = append(codes, code)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	cfg.recordAuditEvent(r.Context(), userID, auditTwoFactorEnabled, nil)
+
+	return respondWithJSON(w, 200, ResponseSuccess{
+		RecoveryCodes: codes,
+	})
+}
+
+func (cfg *apiConfig) handleDisableTOTP(w http.ResponseWriter, r *http.Request) error {
+	type parameters struct {
+		CurrentPassword	string	`json:"current_password"`
+	}
+
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
+	}
+
+	params := parameters{}
+	err := decodeJSON(w, r, &params)
+	if err != nil {
+		return err
+	}
+
+	user, err := cfg.DB.GetUserByID(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apierror.Unauthorized("user no longer exists", err)
+	}
+	if err != nil {
+		return err
+	}
+	err = cfg.reauthenticate(r, user, params.CurrentPassword)
+	if err != nil {
+		return err
+	}
+
+	err = cfg.DB.DeleteUserTOTP(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+	err = cfg.DB.DeleteRecoveryCodes(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+	cfg.recordAuditEvent(r.Context(), userID, auditTwoFactorDisabled, nil)
+
+	w.WriteHeader(204)
+	return nil
+}
+
+// handleLoginMFA is the second step of a login with two-factor
+// authentication. It takes the challenge token from handleLogin and either a
+// TOTP code or an unused recovery code.
+func (cfg *apiConfig) handleLoginMFA(w http.ResponseWriter, r *http.Request) error {
+	type parameters struct {
+		MFAToken			string	`json:"mfa_token"`
+		Code				string	`json:"code"`
+		RecoveryCode		string	`json:"recovery_code"`
+		ExpiresInSeconds	int		`json:"expires_in_seconds"`
+	}
+
+	params := parameters{}
+	err := decodeJSON(w, r, &params)
+	if err != nil {
+		return err
+	}
+
+	problems := map[string]string{}
+	if params.MFAToken == "" {
+		problems["mfa_token"] = "is required"
+	}
+	if (params.Code == "") == (params.RecoveryCode == "") {
+		problems["code"] = "exactly one of code and recovery_code is required"
+	}
+	if params.ExpiresInSeconds < 0 {
+		problems["expires_in_seconds"] = "must not be negative"
+	}
+	if len(problems) > 0 {
+		return apierror.Validation(problems)
+	}
+
+	claims, err := auth.ParseJWT(params.MFAToken, cfg.JWTKeys, cfg.mfaChallengeOptions())
+	if err != nil {
+		return err
+	}
+	userID, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return apierror.New(http.StatusUnauthorized, apierror.CodeInvalidToken, "token is invalid", err)
+	}
+
+	user, err := cfg.DB.GetUserByID(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	// Codes are short, so guesses count against the same throttles as
+	// passwords.
+	throttles := cfg.loginThrottles(r, user.Email)
+	err = cfg.checkThrottles(w, r, throttles, "too many failed login attempts, try again later")
+	if err != nil {
+		return err
+	}
+
+	var valid bool
+	if params.Code != "" {
+		valid, err = cfg.useTOTPCode(r, userID, params.Code)
+	} else {
+		var rows int64
+		rows, err = cfg.DB.UseRecoveryCode(r.Context(), database.UseRecoveryCodeParams{
+			UserID: userID,
+			CodeHash: hashRecoveryCode(params.RecoveryCode),
+		})
+		valid = rows > 0
+		if valid {
+			cfg.recordAuditEvent(r.Context(), userID, auditRecoveryCodeUsed, nil)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if !valid {
+		if err := cfg.recordLoginFailure(r.Context(), throttles, &user); err != nil {
+			return err
+		}
+		return apierror.Unauthorized("two-factor code is incorrect", nil)
+	}
+
+	err = cfg.DB.DeleteLoginThrottle(r.Context(), throttles[0].key)
+	if err != nil {
+		return err
+	}
+
+	return cfg.respondWithLogin(w, r, user, params.ExpiresInSeconds)
+}
+
+// useTOTPCode checks code against the user's confirmed secret. Each time step
+// is only accepted once, so a code seen over someone's shoulder can't be
+// replayed.
+func (cfg *apiConfig) useTOTPCode(r *http.Request, userID uuid.UUID, code string) (bool, error) {
+	stored, err := cfg.DB.GetUserTOTP(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !stored.ConfirmedAt.Valid {
+		return false, nil
+	}
+
+	step, valid, err := totp.Validate(code, stored.Secret, time.Now(), totp.DefaultOptions)
+	if err != nil || !valid {
+		return false, err
+	}
+
+	rows, err := cfg.DB.UseTOTPStep(r.Context(), database.UseTOTPStepParams{
+		UserID: userID,
+		LastUsedStep: step,
+	})
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"grysha11/httpServersGo/internal/apierror"
+	"grysha11/httpServersGo/internal/auth"
+	"grysha11/httpServersGo/internal/database"
+	"grysha11/httpServersGo/internal/mailer"
+	"log"
+	"net/http"
+	"net/mail"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const emailVerificationTTL = 24 * time.Hour
+
+// maxEmailLength is the longest address SMTP can deliver to.
+const maxEmailLength = 254
+
+// validateEmail returns what is wrong with email, or an empty string if it
+// is a plain address like "user@example.com".
+func validateEmail(email string) string {
+	if email == "" {
+		return "is required"
+	}
+	if len(email) > maxEmailLength {
+		return fmt.Sprintf("must be at most %d characters", maxEmailLength)
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return "must be a valid email address"
+	}
+	return ""
+}
+
+func (cfg *apiConfig) emailVerificationOptions() auth.ValidateOptions {
+	return auth.ValidateOptions{
+		Issuer: auth.Issuer,
+		Audience: cfg.JWTAudience,
+		TokenType: auth.TokenTypeEmailVerification,
+	}
+}
+
+func (cfg *apiConfig) makeEmailVerificationToken(userID uuid.UUID, email string) (string, error) {
+	claims := auth.NewClaims(userID, auth.TokenTypeEmailVerification, emailVerificationTTL)
+	claims.ID = uuid.NewString()
+	claims.Email = email
+	if cfg.JWTAudience != "" {
+		claims.Audience = jwt.ClaimStrings{cfg.JWTAudience}
+	}
+	return auth.SignJWT(claims, cfg.JWTKeys)
+}
+
+// sendVerificationEmail mails a verification token to the user. A failed
+// delivery is logged but doesn't fail the request, the user can ask for
+// another email later.
+func (cfg *apiConfig) sendVerificationEmail(ctx context.Context, user database.User) {
+	token, err := cfg.makeEmailVerificationToken(user.ID, user.Email)
+	if err != nil {
+		log.Printf("Error making verification token for user %v: %v\n", user.ID, err)
+		return
+	}
+
+	err = cfg.Mailer.Send(ctx, mailer.Message{
+		To: user.Email,
+		Subject: "Verify your Chirpy email address",
+		Body: fmt.Sprintf("Confirm this address by sending the token below to POST /api/users/verify.\nIt expires in %v.\n\n%s\n", emailVerificationTTL, token),
+	})
+	if err != nil {
+		log.Printf("Error sending verification email to user %v: %v\n", user.ID, err)
+	}
+}
+
+func (cfg *apiConfig) handleVerifyEmail(w http.ResponseWriter, r *http.Request) error {
+	type parameters struct {
+		Token	string	`json:"token"`
+	}
+
+	params := parameters{}
+	err := decodeJSON(w, r, &params)
+	if err != nil {
+		return err
+	}
+
+	if params.Token == "" {
+		return apierror.Validation(map[string]string{
+			"token": "is required",
+		})
+	}
+
+	claims, err := auth.ParseJWT(params.Token, cfg.JWTKeys, cfg.emailVerificationOptions())
+	if err != nil {
+		return err
+	}
+	userID, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return apierror.New(http.StatusUnauthorized, apierror.CodeInvalidToken, "token is invalid", err)
+	}
+
+	// The update only matches while the address is still the one the token
+	// was sent to and hasn't been verified yet, which makes tokens single use.
+	rows, err := cfg.DB.VerifyUserEmail(r.Context(), database.VerifyUserEmailParams{
+		ID: userID,
+		Email: claims.Email,
+	})
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return apierror.New(http.StatusUnauthorized, apierror.CodeInvalidToken, "token has already been used", nil)
+	}
+
+	w.WriteHeader(204)
+	return nil
+}
+
+func (cfg *apiConfig) handleResendVerification(w http.ResponseWriter, r *http.Request) error {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		return apierror.Unauthorized("authentication required", nil)
+	}
+
+	user, err := cfg.DB.GetUserByID(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+	if user.EmailVerifiedAt.Valid {
+		return apierror.Conflict("email is already verified", nil)
+	}
+
+	cfg.sendVerificationEmail(r.Context(), user)
+	w.WriteHeader(202)
+	return nil
+}
+
+// requireVerifiedEmail rejects the request if verification is enforced and
+// the authenticated user hasn't verified their email yet.
+func (cfg *apiConfig) requireVerifiedEmail(user database.User) error {
+	if !cfg.RequireVerifiedEmail {
+		return nil
+	}
+	if !user.EmailVerifiedAt.Valid {
+		return apierror.Forbidden("email address must be verified first")
+	}
+	return nil
+}